@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"errors"
 	"os"
 	"strconv"
 
@@ -35,15 +36,27 @@ func Register(c *fiber.Ctx) error {
 		})
 	}
 
+	if violations := utils.ValidatePassword(nu.Password); violations != nil {
+		c.Status(400)
+		return c.JSON(utils.PasswordPolicyError(violations))
+	}
+
+	// Self-registered accounts cannot choose their role: the very first account
+	// bootstraps the admin, every later one is an inactive clerk until an
+	// administrator enables it.
+	role, status := "clerk", false
+	if (&models.User{}).Count(database.DB) == 0 {
+		role, status = "admin", true
+	}
+
 	u := &models.User{
-		Fullname:   nu.Fullname,
-		Email:      nu.Email,
-		Title:      nu.Title,
-		Phone:      nu.Phone,
-		Role:       nu.Role,
-		Permission: nu.Permission,
-		Status:     nu.Status,
-		Signature:  nu.Signature,
+		Fullname:  nu.Fullname,
+		Email:     nu.Email,
+		Title:     nu.Title,
+		Phone:     nu.Phone,
+		Role:      role,
+		Status:    status,
+		Signature: nu.Signature,
 	}
 
 	u.SetPassword(nu.Password)
@@ -81,6 +94,13 @@ func Login(c *fiber.Ctx) error {
 		return c.JSON(err)
 	}
 
+	policy := utils.GetLoginLockoutPolicy()
+	ipKey := utils.LoginThrottleIPKey(c.IP())
+
+	if block := utils.CheckLoginThrottle(database.DB, ipKey); block != nil {
+		return loginBlocked(c, block, lu.Identifier)
+	}
+
 	u := &models.User{}
 
 	phoneNumber, err := strconv.Atoi(lu.Identifier)
@@ -91,6 +111,8 @@ func Login(c *fiber.Ctx) error {
 	}
 
 	if u.UUID == "" {
+		utils.RecordLoginFailure(database.DB, ipKey, policy.IPMaxFailures)
+
 		utils.LogErrorWithDB(database.DB, c, "login_failed", "Invalid email or phone", map[string]interface{}{
 			"identifier": lu.Identifier,
 			"ip_address": c.IP(),
@@ -103,7 +125,14 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
+	// Checked before the password so a locked account cannot be probed
+	if block := utils.CheckLoginThrottle(database.DB, utils.LoginThrottleUserKey(u.UUID)); block != nil {
+		return loginBlocked(c, block, lu.Identifier)
+	}
+
 	if err := u.ComparePassword(lu.Password); err != nil {
+		recordLoginFailure(c, u)
+
 		utils.LogErrorWithDB(database.DB, c, "login_failed", "Incorrect password", map[string]interface{}{
 			"user_uuid":  u.UUID,
 			"identifier": lu.Identifier,
@@ -131,7 +160,26 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
-	token, err := utils.GenerateJwt(u.UUID)
+	// With 2FA the password only opens a short-lived challenge, see LoginTwoFactor
+	if u.TwoFactorEnabled {
+		challenge, err := utils.GenerateTwoFactorChallenge(u)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "challenge", nil)
+
+		return c.JSON(fiber.Map{
+			"message":             "two_factor_required",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int64(utils.GetTwoFactorChallengeTTL().Seconds()),
+		})
+	}
+
+	utils.ClearLoginThrottle(database.DB, utils.LoginThrottleUserKey(u.UUID))
+
+	tokens, err := utils.IssueTokenPair(database.DB, c, u)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -144,12 +192,67 @@ func Login(c *fiber.Ctx) error {
 	})
 
 	return c.JSON(fiber.Map{
-		"message": "success",
-		"data":    token,
+		"message":            "success",
+		"data":               tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"token_type":         tokens.TokenType,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+		"password_expired":   utils.PasswordExpired(u),
 	})
 
 }
 
+// recordLoginFailure counts a failed password or second factor against the
+// account and the client address, and notifies the user when the account locks
+func recordLoginFailure(c *fiber.Ctx, u *models.User) {
+	policy := utils.GetLoginLockoutPolicy()
+
+	utils.RecordLoginFailure(database.DB, utils.LoginThrottleIPKey(c.IP()), policy.IPMaxFailures)
+
+	block, lockedNow, err := utils.RecordLoginFailure(database.DB, utils.LoginThrottleUserKey(u.UUID), policy.MaxFailures)
+	if err != nil || !lockedNow {
+		return
+	}
+
+	utils.LogErrorWithDB(database.DB, c, "account_locked", "Too many failed login attempts", map[string]interface{}{
+		"user_uuid":    u.UUID,
+		"locked_until": block.Until,
+		"ip_address":   c.IP(),
+		"user_agent":   c.Get("User-Agent"),
+	})
+
+	utils.NotifyAccountLocked(u, block.Until, c.IP())
+}
+
+// loginBlocked refuses an attempt while a backoff delay or a lockout is active
+func loginBlocked(c *fiber.Ctx, block *utils.LoginBlock, identifier string) error {
+	utils.LogErrorWithDB(database.DB, c, "login_blocked", "Login attempt while throttled", map[string]interface{}{
+		"identifier": identifier,
+		"locked":     block.Locked,
+		"ip_address": c.IP(),
+		"user_agent": c.Get("User-Agent"),
+	})
+
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(block.RetryAfter, 10))
+
+	if block.Locked {
+		c.Status(fiber.StatusLocked)
+		return c.JSON(fiber.Map{
+			"message":     "compte temporairement verrouillé, trop de tentatives échouées 😰",
+			"locked":      true,
+			"retry_after": block.RetryAfter,
+		})
+	}
+
+	c.Status(fiber.StatusTooManyRequests)
+	return c.JSON(fiber.Map{
+		"message":     "trop de tentatives, veuillez réessayer plus tard 😰",
+		"locked":      false,
+		"retry_after": block.RetryAfter,
+	})
+}
+
 func AuthUser(c *fiber.Ctx) error {
 
 	userUUID, err := utils.GetUserUUIDFromToken(c)
@@ -167,26 +270,109 @@ func AuthUser(c *fiber.Ctx) error {
 
 	// Create a response with user information
 	response := fiber.Map{
-		"uuid":       u.UUID,
-		"fullname":   u.Fullname,
-		"email":      u.Email,
-		"phone":      u.Phone,
-		"title":      u.Title,
-		"role":       u.Role,
-		"permission": u.Permission,
-		"status":     u.Status,
-		"signature":  u.Signature,
-		"created_at": u.CreatedAt,
-		"updated_at": u.UpdatedAt,
+		"uuid":        u.UUID,
+		"fullname":    u.Fullname,
+		"email":       u.Email,
+		"phone":       u.Phone,
+		"title":       u.Title,
+		"role":        u.Role,
+		"permission":  u.Permission,
+		"permissions": utils.ResolveUserPermissions(database.DB, &u),
+		"status":      u.Status,
+		"two_factor":  u.TwoFactorEnabled,
+		"signature":   u.Signature,
+		"created_at":  u.CreatedAt,
+		"updated_at":  u.UpdatedAt,
 	}
 
 	return c.JSON(response)
 }
 
+// Refresh exchanges a refresh token for a new access token and a rotated refresh token
+func Refresh(c *fiber.Ctx) error {
+	type RefreshInput struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	var input RefreshInput
+	if err := c.BodyParser(&input); err != nil || input.RefreshToken == "" {
+		c.Status(400)
+		return c.JSON(fiber.Map{
+			"message": "refresh_token is required",
+		})
+	}
+
+	tokens, user, err := utils.RotateRefreshToken(database.DB, c, input.RefreshToken)
+	if err != nil {
+		if errors.Is(err, utils.ErrRefreshTokenReused) {
+			utils.LogErrorWithDB(database.DB, c, "refresh_token_reuse", err.Error(), map[string]interface{}{
+				"ip_address": c.IP(),
+				"user_agent": c.Get("User-Agent"),
+			})
+		}
+
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":            "success",
+		"data":               tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"token_type":         tokens.TokenType,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+		"user_uuid":          user.UUID,
+	})
+}
+
+// Logout revokes the current access token and the session's refresh tokens
 func Logout(c *fiber.Ctx) error {
+	type LogoutInput struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	var input LogoutInput
+	c.BodyParser(&input)
+
+	claims := utils.CurrentTokenClaims(c)
+	if err := utils.RevokeSession(database.DB, claims, input.RefreshToken); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"message": "failed to revoke session",
+		})
+	}
+
+	if claims != nil {
+		utils.LogLogoutWithDB(database.DB, c, claims.Issuer)
+	}
+
 	return c.JSON(fiber.Map{
 		"message": "successfully logged out",
-		"info":    "please discard your token on the client side",
+	})
+}
+
+// LogoutAll revokes every session of the current user on all devices
+func LogoutAll(c *fiber.Ctx) error {
+	user := utils.CurrentUser(c)
+	if user == nil {
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": "authentication required",
+		})
+	}
+
+	if err := utils.RevokeUserSessions(database.DB, user.UUID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"message": "failed to revoke sessions",
+		})
+	}
+
+	utils.LogLogoutWithDB(database.DB, c, user.UUID)
+
+	return c.JSON(fiber.Map{
+		"message": "all sessions have been logged out",
 	})
 }
 
@@ -277,22 +463,40 @@ func ChangePassword(c *fiber.Ctx) error {
 		})
 	}
 
-	p, err := utils.HashPassword(updateData.Password)
-	if err != nil {
-		return err
+	db := database.DB
+
+	if violations := utils.ValidateNewPassword(db, user, updateData.Password); violations != nil {
+		c.Status(400)
+		return c.JSON(utils.PasswordPolicyError(violations))
 	}
 
-	db := database.DB
+	if err := utils.SetUserPassword(db, user, updateData.Password); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update password",
+		})
+	}
+	utils.InvalidatePasswordResets(db, user.UUID)
 
-	db.First(&user, user.UUID)
-	user.Password = p
+	// A new password ends every other session, this client gets fresh tokens
+	if err := utils.RevokeUserSessions(db, user.UUID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to revoke existing sessions",
+		})
+	}
+	db.Where("uuid = ?", user.UUID).First(&user)
 
-	db.Save(&user)
+	tokens, err := utils.IssueTokenPair(db, c, user)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
 
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Password successfully updated",
 		"data":    user,
+		"tokens":  tokens,
 	})
 
 }
@@ -1,119 +1,128 @@
 package auth
 
 import (
-	"net/smtp"
-	"time"
+	"strings"
 
 	"github.com/Danny19977/certikiosk.git/database"
 	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/Danny19977/certikiosk.git/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/joho/godotenv"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func Forgot(c *fiber.Ctx) error {
-	godotenv.Load()
 	u := new(models.PasswordReset)
 
 	if err := c.BodyParser(&u); err != nil {
-		return err
-	}
-
-	token := utils.GenerateRandomString(12)
-	uuid := utils.GenerateUUID()
-
-	pr := &models.PasswordReset{
-		UUID:  uuid,
-		Email: u.Email,
-		Token: token,
+		c.Status(400)
+		return c.JSON(fiber.Map{
+			"message": err.Error(),
+		})
 	}
 
-	// search for the email in the database, if the user exist
-	um := &models.User{}
-
-	database.DB.Where("email = ?", u.Email).First(um)
-
-	if um.UUID == "" {
+	email := strings.TrimSpace(u.Email)
+	if email == "" {
 		c.Status(400)
 		return c.JSON(fiber.Map{
-			"message": "invalid email address 😰",
+			"message": "email is required",
 		})
 	}
 
-	// token expiration time is 3hr
-	pr.ExpirationTime = time.Now().Add(time.Hour * time.Duration(3))
-	pr.CreatedAt = time.Now()
-
-	database.DB.Create(pr)
-
-	from := utils.Env("EMAIL_FROM")
-
-	to := []string{
-		u.Email,
+	// Same answer whether the address exists or not, so accounts cannot be enumerated
+	response := fiber.Map{
+		"message": "if an account exists for this email, a reset link has been sent",
 	}
 
-	auth := smtp.PlainAuth("", utils.Env("EMAIL_USERNAME"), utils.Env("EMAIL_PASSWORD"), utils.Env("EMAIL_HOST"))
-
-	url := utils.Env("RESET_URL") + token
-
-	msg := []byte("Click <a href=\"" + url + "\">here</a> to reset your password!")
+	um := &models.User{}
+	if err := database.DB.Where("email = ?", email).First(um).Error; err != nil || !um.Status {
+		utils.LogErrorWithDB(database.DB, c, "password_reset_unknown", "Password reset requested for an unknown or disabled account", map[string]interface{}{
+			"email":      email,
+			"ip_address": c.IP(),
+			"user_agent": c.Get("User-Agent"),
+		})
+		return c.JSON(response)
+	}
 
-	err := smtp.SendMail(utils.Env("EMAIL_HOST")+":"+utils.Env("EMAIL_PORT"), auth, from, to, msg)
+	token, err := utils.CreatePasswordReset(database.DB, um, c.IP())
 	if err != nil {
-		c.Status(400)
-		return c.JSON(fiber.Map{
-			"message": "email was not sent 😰",
-		})
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	return c.JSON(fiber.Map{
-		"message": "success",
-	})
+	utils.SendPasswordResetEmail(um, token)
+
+	utils.LogPasswordResetWithDB(database.DB, c, um.UUID, "requested", nil)
+
+	return c.JSON(response)
 
 }
 
 func ResetPassword(c *fiber.Ctx) error {
 
-	rp := &models.PasswordReset{}
+	r := new(models.Reset)
 
-	if err := database.DB.Where("token = ?", c.Params("token")).Last(rp); err.Error != nil {
+	if err := c.BodyParser(r); err != nil {
 		c.Status(400)
 		return c.JSON(fiber.Map{
-			"message": "invalid token",
+			"message": err.Error(),
 		})
 	}
 
-	if rp.UUID == "" {
+	if err := utils.ValidateStruct(*r); err != nil {
 		c.Status(400)
-		return c.JSON(fiber.Map{
-			"message": "invalid token",
-		})
+		return c.JSON(err)
 	}
 
-	now, _ := time.Parse(time.RFC3339, time.Now().Format(time.RFC3339))
-
-	if now.After(rp.ExpirationTime) {
+	if r.Password != r.PasswordConfirm {
 		c.Status(400)
 		return c.JSON(fiber.Map{
-			"message": "token has expired",
+			"message": "password does not match",
 		})
 	}
 
-	r := new(models.Reset)
+	rp, err := utils.FindPasswordReset(database.DB, c.Params("token"))
+	if err != nil {
+		return invalidResetToken(c, err)
+	}
 
-	if r.Password != r.PasswordConfirm {
+	user := models.User{}
+	if err := database.DB.Where("uuid = ?", rp.UserUUID).First(&user).Error; err != nil {
+		return invalidResetToken(c, err)
+	}
+
+	// The policy is checked before consuming so a rejected password does not burn the single-use token
+	if violations := utils.ValidateNewPassword(database.DB, &user, r.Password); violations != nil {
 		c.Status(400)
-		return c.JSON(fiber.Map{
-			"message": "password does not match",
-		})
+		return c.JSON(utils.PasswordPolicyError(violations))
+	}
+
+	if _, err := utils.ConsumePasswordReset(database.DB, c.Params("token")); err != nil {
+		return invalidResetToken(c, err)
 	}
 
-	password, _ := bcrypt.GenerateFromPassword([]byte(r.Password), 14)
-	database.DB.Model(&models.User{}).Where("email = ?", rp.Email).Update("password", password)
+	if err := utils.SetUserPassword(database.DB, &user, r.Password); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Other pending links and sessions opened with the old password must not survive the reset
+	utils.InvalidatePasswordResets(database.DB, user.UUID)
+	utils.RevokeUserSessions(database.DB, user.UUID)
+	utils.ClearLoginThrottle(database.DB, utils.LoginThrottleUserKey(user.UUID))
+
+	utils.LogPasswordResetWithDB(database.DB, c, user.UUID, "completed", nil)
 
 	return c.JSON(fiber.Map{
 		"message": "success",
 	})
 
 }
+
+func invalidResetToken(c *fiber.Ctx, err error) error {
+	utils.LogErrorWithDB(database.DB, c, "password_reset_invalid", err.Error(), map[string]interface{}{
+		"ip_address": c.IP(),
+		"user_agent": c.Get("User-Agent"),
+	})
+
+	c.Status(400)
+	return c.JSON(fiber.Map{
+		"message": utils.ErrPasswordResetInvalid.Error(),
+	})
+}
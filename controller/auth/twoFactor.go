@@ -0,0 +1,382 @@
+package auth
+
+import (
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+type twoFactorCodeInput struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	Password     string `json:"password"`
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code
+func verifySecondFactor(u *models.User, input twoFactorCodeInput) (string, bool, error) {
+	if input.Code != "" {
+		ok, err := utils.VerifyUserTOTP(database.DB, u, input.Code)
+		return "totp", ok, err
+	}
+	if input.RecoveryCode != "" {
+		ok, err := utils.UseRecoveryCode(database.DB, u.UUID, input.RecoveryCode)
+		return "recovery_code", ok, err
+	}
+	return "", false, nil
+}
+
+// LoginTwoFactor completes a login by exchanging the challenge token and a
+// TOTP or recovery code for a session
+func LoginTwoFactor(c *fiber.Ctx) error {
+	type LoginTwoFactorInput struct {
+		ChallengeToken string `json:"challenge_token"`
+		twoFactorCodeInput
+	}
+
+	var input LoginTwoFactorInput
+	if err := c.BodyParser(&input); err != nil {
+		c.Status(400)
+		return c.JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
+
+	claims, err := utils.ParseTwoFactorChallenge(input.ChallengeToken)
+	if err != nil || utils.IsAccessTokenRevoked(database.DB, claims.Id) {
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": utils.ErrTwoFactorChallengeInvalid.Error(),
+		})
+	}
+
+	u := &models.User{}
+	if err := database.DB.Where("uuid = ?", claims.Issuer).First(u).Error; err != nil ||
+		claims.TokenVersion != u.TokenVersion || !u.TwoFactorEnabled {
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": utils.ErrTwoFactorChallengeInvalid.Error(),
+		})
+	}
+
+	if !u.Status {
+		c.Status(fiber.StatusForbidden)
+		return c.JSON(fiber.Map{
+			"message": "vous n'êtes pas autorisé de se connecter 😰",
+		})
+	}
+
+	// Codes are short, failures count toward the same lockout as passwords
+	if block := utils.CheckLoginThrottle(database.DB, utils.LoginThrottleUserKey(u.UUID)); block != nil {
+		return loginBlocked(c, block, u.Email)
+	}
+
+	method, ok, err := verifySecondFactor(u, input.twoFactorCodeInput)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !ok {
+		recordLoginFailure(c, u)
+
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "failed", map[string]interface{}{
+			"method": method,
+		})
+
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": utils.ErrTwoFactorCodeInvalid.Error(),
+		})
+	}
+
+	// A challenge opens a single session
+	utils.RevokeAccessToken(database.DB, claims)
+	utils.ClearLoginThrottle(database.DB, utils.LoginThrottleUserKey(u.UUID))
+
+	tokens, err := utils.IssueTokenPair(database.DB, c, u)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	utils.LogLoginWithDB(database.DB, c, u.UUID, map[string]interface{}{
+		"fullname":      u.Fullname,
+		"email":         u.Email,
+		"role":          u.Role,
+		"title":         u.Title,
+		"second_factor": method,
+	})
+
+	response := fiber.Map{
+		"message":            "success",
+		"data":               tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"token_type":         tokens.TokenType,
+		"expires_in":         tokens.ExpiresIn,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
+		"password_expired":   utils.PasswordExpired(u),
+	}
+
+	if method == "recovery_code" {
+		remaining := utils.RemainingRecoveryCodes(database.DB, u.UUID)
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "recovery_code_used", map[string]interface{}{
+			"remaining": remaining,
+		})
+		response["recovery_codes_remaining"] = remaining
+	}
+
+	return c.JSON(response)
+}
+
+// GetTwoFactorStatus tells whether the current user has 2FA enabled
+func GetTwoFactorStatus(c *fiber.Ctx) error {
+	u := utils.CurrentUser(c)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Two-factor status",
+		"data": fiber.Map{
+			"enabled":                  u.TwoFactorEnabled,
+			"pending":                  !u.TwoFactorEnabled && u.TwoFactorSecret != "",
+			"recovery_codes_remaining": utils.RemainingRecoveryCodes(database.DB, u.UUID),
+		},
+	})
+}
+
+// SetupTwoFactor generates a new TOTP secret for the current user. It stays
+// pending until confirmed with EnableTwoFactor.
+func SetupTwoFactor(c *fiber.Ctx) error {
+	u := utils.CurrentUser(c)
+
+	if u.TwoFactorEnabled {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	sealed, err := utils.SealTOTPSecret(u.UUID, secret)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to protect the two-factor secret",
+			"error":   err.Error(),
+		})
+	}
+
+	if err := database.DB.Model(&models.User{}).Where("uuid = ?", u.UUID).Updates(map[string]interface{}{
+		"two_factor_secret":    sealed,
+		"two_factor_last_step": 0,
+	}).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to start two-factor setup",
+			"error":   err.Error(),
+		})
+	}
+
+	account := u.Email
+	if account == "" {
+		account = u.Phone
+	}
+	uri := utils.TOTPProvisioningURI(account, secret)
+
+	qrCode, err := utils.TOTPQRCode(uri)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to generate QR code",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "setup", nil)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Scan the QR code with an authenticator app, then confirm with a code",
+		"data": fiber.Map{
+			"secret":      secret,
+			"otpauth_url": uri,
+			"qr_code":     qrCode,
+		},
+	})
+}
+
+// EnableTwoFactor confirms the pending secret with a code and returns the recovery codes
+func EnableTwoFactor(c *fiber.Ctx) error {
+	u := utils.CurrentUser(c)
+
+	var input twoFactorCodeInput
+	if err := c.BodyParser(&input); err != nil || input.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A code from the authenticator app is required",
+		})
+	}
+
+	if u.TwoFactorEnabled {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Two-factor authentication is already enabled",
+		})
+	}
+	if u.TwoFactorSecret == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Start the two-factor setup first",
+		})
+	}
+
+	ok, err := utils.VerifyUserTOTP(database.DB, u, input.Code)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !ok {
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "failed", map[string]interface{}{
+			"method": "totp",
+			"during": "enable",
+		})
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": utils.ErrTwoFactorCodeInvalid.Error(),
+		})
+	}
+
+	codes, err := utils.GenerateRecoveryCodes(database.DB, u.UUID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to generate recovery codes",
+			"error":   err.Error(),
+		})
+	}
+
+	database.DB.Model(&models.User{}).Where("uuid = ?", u.UUID).Update("two_factor_enabled", true)
+
+	utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "enabled", nil)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Two-factor authentication enabled, store the recovery codes now: they will not be shown again",
+		"data": fiber.Map{
+			"recovery_codes": codes,
+		},
+	})
+}
+
+// DisableTwoFactor turns 2FA off for the current user, it requires the
+// password and a TOTP or recovery code
+func DisableTwoFactor(c *fiber.Ctx) error {
+	u := utils.CurrentUser(c)
+
+	var input twoFactorCodeInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Review your input",
+			"errors":  err.Error(),
+		})
+	}
+
+	if !u.TwoFactorEnabled {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Two-factor authentication is not enabled",
+		})
+	}
+
+	if err := u.ComparePassword(input.Password); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "votre mot de passe n'est pas correct! 😰",
+		})
+	}
+
+	method, ok, err := verifySecondFactor(u, input)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !ok {
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "failed", map[string]interface{}{
+			"method": method,
+			"during": "disable",
+		})
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": utils.ErrTwoFactorCodeInvalid.Error(),
+		})
+	}
+
+	if err := utils.ResetTwoFactor(database.DB, u.UUID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to disable two-factor authentication",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "disabled", nil)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	u := utils.CurrentUser(c)
+
+	var input twoFactorCodeInput
+	if err := c.BodyParser(&input); err != nil || input.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A code from the authenticator app is required",
+		})
+	}
+
+	if !u.TwoFactorEnabled {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Two-factor authentication is not enabled",
+		})
+	}
+
+	ok, err := utils.VerifyUserTOTP(database.DB, u, input.Code)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !ok {
+		utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "failed", map[string]interface{}{
+			"method": "totp",
+			"during": "recovery_codes",
+		})
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": utils.ErrTwoFactorCodeInvalid.Error(),
+		})
+	}
+
+	codes, err := utils.GenerateRecoveryCodes(database.DB, u.UUID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to generate recovery codes",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogTwoFactorWithDB(database.DB, c, u.UUID, "recovery_codes_regenerated", nil)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Recovery codes regenerated, the previous ones no longer work",
+		"data": fiber.Map{
+			"recovery_codes": codes,
+		},
+	})
+}
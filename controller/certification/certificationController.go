@@ -1,7 +1,11 @@
 package certification
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Danny19977/certikiosk.git/database"
@@ -17,7 +21,9 @@ func CertifyDocument(c *fiber.Ctx) error {
 		DocumentUUID    string `json:"document_uuid"`
 		FingerprintData string `json:"fingerprint_data"`
 		StampDetails    string `json:"stamp_details"`
-		OutputFormat    string `json:"output_format"` // "pdf" or "print"
+		StampPage       int    `json:"stamp_page"`     // 0 stamps every page
+		StampPosition   string `json:"stamp_position"` // "bottom-right" (default), "bottom-left", "top-right", "top-left", "center"
+		OutputFormat    string `json:"output_format"`  // "pdf" or "print"
 	}
 
 	var input CertificationInput
@@ -31,10 +37,10 @@ func CertifyDocument(c *fiber.Ctx) error {
 	}
 
 	// Validate required fields
-	if input.CitizensUUID == "" || input.DocumentUUID == "" || input.FingerprintData == "" {
+	if input.CitizensUUID == "" || input.DocumentUUID == "" {
 		return c.Status(400).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Citizens UUID, Document UUID, and Fingerprint data are required",
+			"message": "Citizens UUID and Document UUID are required",
 			"data":    nil,
 		})
 	}
@@ -49,17 +55,7 @@ func CertifyDocument(c *fiber.Ctx) error {
 		})
 	}
 
-	// Step 2: Verify fingerprint
-	var fingerprint models.Fingerprint
-	if err := database.DB.Where("citizens_uuid = ? AND fingerprint_data = ?", input.CitizensUUID, input.FingerprintData).First(&fingerprint).Error; err != nil {
-		return c.Status(401).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Fingerprint verification failed",
-			"data":    nil,
-		})
-	}
-
-	// Step 3: Verify document exists
+	// Step 2: Verify document exists
 	var document models.Documents
 	if err := database.DB.Where("uuid = ?", input.DocumentUUID).First(&document).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
@@ -69,7 +65,7 @@ func CertifyDocument(c *fiber.Ctx) error {
 		})
 	}
 
-	// Step 4: Check if document is active
+	// Step 3: Check if document is active
 	if !document.IsActive {
 		return c.Status(400).JSON(fiber.Map{
 			"status":  "error",
@@ -78,26 +74,230 @@ func CertifyDocument(c *fiber.Ctx) error {
 		})
 	}
 
-	// Step 5: Apply certification stamp (placeholder - will use PDF utility)
-	// TODO: Integrate with PDF generation utility to add stamp
-	certifiedDocumentUrl := document.DocumentDataUrl + "_certified"
+	// Step 4: Check the document type against the catalogue
+	documentType, err := utils.GetActiveDocumentType(database.DB, document.DocumentType)
+	if err != nil {
+		status := 500
+		if err == utils.ErrUnknownDocumentType || err == utils.ErrInactiveDocumentType {
+			status = 422
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type cannot be certified",
+			"error":   err.Error(),
+		})
+	}
+
+	if expiry := utils.GetDocumentExpiry(&document, documentType, time.Now()); expiry.Status == utils.DocumentExpired {
+		return c.Status(422).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document has expired and cannot be certified",
+			"data":    expiry,
+		})
+	}
+
+	// Step 5: Verify fingerprint (1:1 against the citizen's enrolled templates),
+	// always checked when given even if the document type does not require it
+	if input.FingerprintData == "" && documentType.RequiresFingerprint {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Fingerprint data is required for this document type",
+			"data":    nil,
+		})
+	}
+	var fingerprintMatch *utils.FingerprintMatchResult // nil when no fingerprint was checked
+	if input.FingerprintData != "" {
+		var fingerprints []models.Fingerprint
+		database.DB.Where("citizens_uuid = ?", input.CitizensUUID).Find(&fingerprints)
+
+		templates := make([]string, 0, len(fingerprints))
+		for _, fingerprint := range fingerprints {
+			template, err := utils.OpenFingerprint(fingerprint)
+			if err != nil {
+				continue
+			}
+			templates = append(templates, template)
+		}
+
+		if len(templates) == 0 {
+			return c.Status(401).JSON(fiber.Map{
+				"status":  "error",
+				"message": "No fingerprint enrolled for this citizen",
+				"data":    nil,
+			})
+		}
+
+		probe, err := utils.DecodeFingerprintTemplate(input.FingerprintData)
+		if err == nil {
+			_, err = utils.ParseFingerprintTemplate(probe)
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid fingerprint data",
+				"error":   err.Error(),
+			})
+		}
+
+		match := utils.FingerprintMatchResult{Threshold: utils.GetFingerprintMatchThreshold()}
+		for _, template := range templates {
+			result, err := utils.MatchFingerprintTemplates(input.FingerprintData, template)
+			if err != nil {
+				continue // skip unreadable stored templates
+			}
+			if result.Score >= match.Score {
+				match = result
+			}
+		}
+
+		if !match.Matched {
+			utils.LogErrorWithDB(database.DB, c, "fingerprint_verification", "Fingerprint verification failed", map[string]interface{}{
+				"citizens_uuid": input.CitizensUUID,
+				"score":         match.Score,
+			})
+			return c.Status(401).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Fingerprint verification failed",
+				"data": fiber.Map{
+					"fingerprint_match": match,
+				},
+			})
+		}
+		fingerprintMatch = &match
+	}
+
+	// Step 6: Fetch the current version of the source document
+	version, err := utils.CurrentDocumentVersion(database.DB, &document)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to load document version",
+			"error":   err.Error(),
+		})
+	}
+
+	sourceData, err := utils.FetchDocumentVersionContent(c.UserContext(), version)
+	if err == utils.ErrDocumentContentChanged {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Source document no longer matches its registered version",
+			"data":    nil,
+		})
+	}
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to retrieve source document",
+			"error":   err.Error(),
+		})
+	}
+
+	if extension, _ := utils.DetectFileType(sourceData); !documentType.AllowsFormat(extension) {
+		return c.Status(422).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Source document format is not accepted for this document type",
+			"data": fiber.Map{
+				"format":          extension,
+				"allowed_formats": documentType.FormatList(),
+			},
+		})
+	}
+
+	// Step 7: Apply certification stamp
+	certifierName := "CertiKiosk System"
+	certifierUUID, _ := utils.GetUserUUIDFromToken(c)
+	if certifierUUID != "" {
+		var certifier models.User
+		if err := database.DB.Where("uuid = ?", certifierUUID).First(&certifier).Error; err == nil && certifier.Fullname != "" {
+			certifierName = certifier.Fullname
+		}
+	}
+
+	certificationUUID := utils.GenerateUUID()
+	certifiedAt := time.Now()
+	certInfo := utils.CertificationInfo{
+		CitizenName:   citizen.FirstName + " " + citizen.LastName,
+		NationalID:    strconv.Itoa(citizen.NationalID),
+		DocumentType:  documentType.Name(models.DefaultDocumentLanguage),
+		CertifiedDate: certifiedAt,
+		CertifierName: certifierName,
+		StampDetails:  input.StampDetails,
+		StampPage:     input.StampPage,
+		StampPosition: input.StampPosition,
+		// QR code lets third parties check the certification on the public verify endpoint
+		VerificationURL: utils.GetVerificationURL(certificationUUID),
+	}
+
+	// Lines required by the document type come before the free stamp details
+	if lines := utils.RenderStampTemplate(documentType.StampTemplate, documentType, certInfo); lines != "" {
+		certInfo.StampDetails = strings.TrimSpace(lines + "\n" + input.StampDetails)
+	}
+
+	certifiedPDF, err := utils.GenerateCertifiedPDF(certInfo, sourceData)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to stamp document",
+			"error":   err.Error(),
+		})
+	}
+
+	// Step 8: Digitally sign the stamped document with the server certificate
+	signatureFingerprint := ""
+	signer, err := utils.GetPDFSigner()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document signing is misconfigured",
+			"error":   err.Error(),
+		})
+	}
+	if signer != nil {
+		signedPDF, err := signer.SignPDF(certifiedPDF, "Certified copy of "+certInfo.DocumentType, "CertiKiosk")
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to sign certified document",
+				"error":   err.Error(),
+			})
+		}
+		certifiedPDF = signedPDF
+		signatureFingerprint = utils.CertificateFingerprint(signer.Certificate)
+	}
+
+	// Step 9: Store the certified document
+	storageKey, storageBackend, err := utils.SaveCertifiedDocument(certificationUUID+".pdf", certifiedPDF)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to store certified document",
+			"error":   err.Error(),
+		})
+	}
 
 	// Set default output format if not provided
 	if input.OutputFormat == "" {
 		input.OutputFormat = "pdf"
 	}
 
-	// Step 6: Create certification record
+	// Step 10: Create certification record
 	certification := models.Certification{
-		UUID:              utils.GenerateUUID(),
-		CitizensUUID:      input.CitizensUUID,
-		DocumentUUID:      input.DocumentUUID,
-		Aprovel:           true,
-		CertifiedDocument: certifiedDocumentUrl,
-		StampDetails:      input.StampDetails,
-		OutputFormat:      input.OutputFormat,
-		CreatedAt:         time.Now(),
-		UpdatedAt:         time.Now(),
+		UUID:                  certificationUUID,
+		CitizensUUID:          input.CitizensUUID,
+		DocumentUUID:          input.DocumentUUID,
+		DocumentVersionUUID:   version.UUID,
+		SourceDocumentHash:    utils.HashSHA256(sourceData),
+		Aprovel:               true,
+		CertifiedDocument:     storageKey,
+		CertifiedStorage:      storageBackend,
+		CertifiedDocumentHash: utils.HashSHA256(certifiedPDF),
+		CertifiedBy:           certifierUUID,
+		SignatureFingerprint:  signatureFingerprint,
+		StampDetails:          input.StampDetails,
+		StampPage:             input.StampPage,
+		OutputFormat:          input.OutputFormat,
+		CreatedAt:             certifiedAt,
+		UpdatedAt:             certifiedAt,
 	}
 
 	if err := database.DB.Create(&certification).Error; err != nil {
@@ -115,9 +315,11 @@ func CertifyDocument(c *fiber.Ctx) error {
 		"status":  "success",
 		"message": "Document certified successfully",
 		"data": fiber.Map{
-			"certification": certification,
-			"citizen":       citizen,
-			"document":      document,
+			"certification":     certification,
+			"citizen":           citizen,
+			"document":          document,
+			"verification_url":  certInfo.VerificationURL,
+			"fingerprint_match": fingerprintMatch,
 		},
 	})
 }
@@ -267,6 +469,16 @@ func GetCertificationsByDocument(c *fiber.Ctx) error {
 
 // DownloadCertifiedDocument - Download the certified document as PDF
 func DownloadCertifiedDocument(c *fiber.Ctx) error {
+	return sendCertifiedDocument(c, "attachment")
+}
+
+// PrintCertifiedDocument - Serve the certified document inline for kiosk printing
+func PrintCertifiedDocument(c *fiber.Ctx) error {
+	return sendCertifiedDocument(c, "inline")
+}
+
+// sendCertifiedDocument streams the stamped PDF of a certification with the given disposition
+func sendCertifiedDocument(c *fiber.Ctx, disposition string) error {
 	certificationUUID := c.Params("uuid")
 	db := database.DB
 	var certification models.Certification
@@ -279,44 +491,53 @@ func DownloadCertifiedDocument(c *fiber.Ctx) error {
 		})
 	}
 
-	// TODO: Implement actual PDF download functionality
-	// This should generate/retrieve the certified PDF and send it as download
-
-	return c.JSON(fiber.Map{
-		"status":  "success",
-		"message": "Certified document ready for download",
-		"data": fiber.Map{
-			"download_url": certification.CertifiedDocument,
-			"format":       certification.OutputFormat,
-		},
-	})
-}
+	if !certification.Aprovel {
+		return c.Status(410).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Certification has been revoked, the certified document is no longer available",
+			"data":    nil,
+		})
+	}
 
-// PrintCertifiedDocument - Prepare document for printing
-func PrintCertifiedDocument(c *fiber.Ctx) error {
-	certificationUUID := c.Params("uuid")
-	db := database.DB
-	var certification models.Certification
+	etag := "\"" + certification.CertifiedDocumentHash + "\""
+	if certification.CertifiedDocumentHash != "" && c.Get("If-None-Match") == etag {
+		c.Set("ETag", etag)
+		return c.SendStatus(fiber.StatusNotModified)
+	}
 
-	if err := db.Where("uuid = ?", certificationUUID).First(&certification).Error; err != nil {
+	pdfData, err := utils.ReadCertifiedDocument(certification.CertifiedStorage, certification.CertifiedDocument)
+	if err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Certification not found",
+			"message": "Certified document file not found",
+			"error":   err.Error(),
+		})
+	}
+
+	// Refuse to serve a file that no longer matches the recorded hash
+	if certification.CertifiedDocumentHash != "" && utils.HashSHA256(pdfData) != certification.CertifiedDocumentHash {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Certified document failed integrity check",
 			"data":    nil,
 		})
 	}
 
-	// TODO: Implement print queue or direct print functionality
-	// This could integrate with a print service
+	if disposition == "inline" {
+		utils.LogViewWithDB(db, c, "certification_print", "Certified document printed", certification.UUID)
+	} else {
+		utils.LogViewWithDB(db, c, "certification_download", "Certified document downloaded", certification.UUID)
+	}
 
-	return c.JSON(fiber.Map{
-		"status":  "success",
-		"message": "Document sent to print queue",
-		"data": fiber.Map{
-			"certification_uuid": certification.UUID,
-			"print_url":          certification.CertifiedDocument,
-		},
-	})
+	c.Set("Content-Type", "application/pdf")
+	c.Set("Content-Disposition", disposition+"; filename=\"certified_"+certification.UUID+".pdf\"")
+	c.Set("Content-Length", strconv.Itoa(len(pdfData)))
+	c.Set("Cache-Control", "private, no-cache")
+	if certification.CertifiedDocumentHash != "" {
+		c.Set("ETag", etag)
+	}
+
+	return c.Send(pdfData)
 }
 
 // RevokeCertification - Revoke a certification (set approval to false)
@@ -379,3 +600,150 @@ func DeleteCertification(c *fiber.Ctx) error {
 		"data":    nil,
 	})
 }
+
+// VerifyCertification - Public verification of a certified document (target of the stamp QR code)
+func VerifyCertification(c *fiber.Ctx) error {
+	certificationUUID := c.Params("uuid")
+	db := database.DB
+	var certification models.Certification
+
+	if err := db.Where("uuid = ?", certificationUUID).First(&certification).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Certification not found",
+			"data": fiber.Map{
+				"certification_uuid":   certificationUUID,
+				"certification_status": "unknown",
+			},
+		})
+	}
+
+	var citizen models.Citizens
+	var document models.Documents
+	db.Where("uuid = ?", certification.CitizensUUID).First(&citizen)
+	db.Where("uuid = ?", certification.DocumentUUID).First(&document)
+
+	// Report the issue that was certified, not a later re-issue of the document
+	issueDate := document.IssueDate
+	var version models.DocumentVersion
+	if certification.DocumentVersionUUID != "" && db.Where("uuid = ?", certification.DocumentVersionUUID).First(&version).Error == nil {
+		issueDate = version.IssueDate
+	}
+
+	certificationStatus := "valid"
+	if !certification.Aprovel {
+		certificationStatus = "revoked"
+	}
+
+	result := fiber.Map{
+		"certification_uuid":      certification.UUID,
+		"certification_status":    certificationStatus,
+		"document_type":           utils.DocumentTypeLabel(db, document.DocumentType, c.Query("lang")),
+		"document_issue_date":     issueDate,
+		"document_version":        version.Version,
+		"certified_at":            certification.CreatedAt,
+		"citizen_name":            maskName(citizen.FirstName) + " " + maskName(citizen.LastName),
+		"certified_document_hash": certification.CertifiedDocumentHash,
+		"hash_algorithm":          "SHA-256",
+	}
+
+	// Optionally compare an uploaded copy against the recorded hash
+	if file, err := c.FormFile("document"); err == nil {
+		fileHandle, err := file.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to read uploaded file",
+				"error":   err.Error(),
+			})
+		}
+		defer fileHandle.Close()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, fileHandle); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to read file content",
+				"error":   err.Error(),
+			})
+		}
+
+		uploadedHash := hex.EncodeToString(hasher.Sum(nil))
+		result["uploaded_document_hash"] = uploadedHash
+		result["hash_match"] = uploadedHash == certification.CertifiedDocumentHash
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Certification status retrieved",
+		"data":    result,
+	})
+}
+
+// maskName keeps the first letter of each word of a name, e.g. "Jean" -> "J***"
+func maskName(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		runes := []rune(word)
+		words[i] = string(runes[0]) + strings.Repeat("*", 3)
+	}
+	return strings.Join(words, " ")
+}
+
+// ValidateCertifiedSignature - Validate the digital signature of an uploaded certified PDF
+func ValidateCertifiedSignature(c *fiber.Ctx) error {
+	file, err := c.FormFile("document")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A PDF file is required in the 'document' field",
+			"data":    nil,
+		})
+	}
+
+	fileHandle, err := file.Open()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to read uploaded file",
+			"error":   err.Error(),
+		})
+	}
+	defer fileHandle.Close()
+
+	pdfData, err := io.ReadAll(fileHandle)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to read file content",
+			"error":   err.Error(),
+		})
+	}
+
+	signer, err := utils.GetPDFSigner()
+	if err != nil || signer == nil {
+		return c.Status(503).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document signing is not configured on this server",
+			"data":    nil,
+		})
+	}
+
+	result := utils.ValidatePDFSignature(pdfData, signer.TrustPool())
+
+	// Link the signature to a certification when the signed file is one we issued
+	var certification models.Certification
+	certificationUUID := ""
+	if err := database.DB.Where("certified_document_hash = ?", utils.HashSHA256(pdfData)).First(&certification).Error; err == nil {
+		certificationUUID = certification.UUID
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Signature validation completed",
+		"data": fiber.Map{
+			"signature":          result,
+			"certification_uuid": certificationUUID,
+		},
+	})
+}
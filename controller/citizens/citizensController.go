@@ -1,6 +1,7 @@
 package citizens
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/Danny19977/certikiosk.git/database"
@@ -8,6 +9,7 @@ import (
 	"github.com/Danny19977/certikiosk.git/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // GetPaginatedCitizens - Get paginated list of citizens with search
@@ -180,15 +182,44 @@ func CreateCitizen(c *fiber.Ctx) error {
 	}
 
 	citizen := models.Citizens{
-		UUID:        uuid.New(),
-		NationalID:  input.NationalID,
-		FirstName:   input.FirstName,
-		LastName:    input.LastName,
-		Phone:       input.Email,
-		Fingerprint: input.Fingerprint,
+		UUID:       uuid.New(),
+		NationalID: input.NationalID,
+		FirstName:  input.FirstName,
+		LastName:   input.LastName,
+		Phone:      input.Email,
 	}
 
-	if err := database.DB.Create(&citizen).Error; err != nil {
+	// Optional fingerprint captured during registration
+	var enrollment *models.Fingerprint
+	if input.Fingerprint != "" {
+		fingerprint, err := utils.NewFingerprintEnrollment(citizen.UUID.String(), input.Fingerprint, 0, 0, "")
+		if err != nil {
+			if errors.Is(err, utils.ErrFingerprintEncryption) {
+				return c.Status(500).JSON(fiber.Map{
+					"status":  "error",
+					"message": "Failed to encrypt fingerprint",
+					"error":   err.Error(),
+				})
+			}
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid fingerprint data",
+				"error":   err.Error(),
+			})
+		}
+		enrollment = &fingerprint
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&citizen).Error; err != nil {
+			return err
+		}
+		if enrollment != nil {
+			return tx.Create(enrollment).Error
+		}
+		return nil
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to create citizen",
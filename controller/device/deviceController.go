@@ -0,0 +1,299 @@
+package device
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetPaginatedDevices - Get paginated list of kiosk devices
+func GetPaginatedDevices(c *fiber.Ctx) error {
+	db := database.DB
+
+	page, err := strconv.Atoi(c.Query("page", "1"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "15"))
+	if err != nil || limit <= 0 {
+		limit = 15
+	}
+	offset := (page - 1) * limit
+
+	search := c.Query("search", "")
+
+	var devices []models.KioskDevice
+	var totalRecords int64
+
+	query := db.Model(&models.KioskDevice{})
+	if search != "" {
+		query = query.Where("device_id ILIKE ? OR name ILIKE ? OR location ILIKE ?", "%"+search+"%", "%"+search+"%", "%"+search+"%")
+	}
+	query.Count(&totalRecords)
+
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&devices).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch devices",
+			"error":   err.Error(),
+		})
+	}
+
+	totalPages := int((totalRecords + int64(limit) - 1) / int64(limit))
+
+	pagination := map[string]interface{}{
+		"total_records": totalRecords,
+		"total_pages":   totalPages,
+		"current_page":  page,
+		"page_size":     limit,
+	}
+
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"message":    "Devices retrieved successfully",
+		"data":       devices,
+		"pagination": pagination,
+	})
+}
+
+// GetDevice - Get a kiosk device by UUID
+func GetDevice(c *fiber.Ctx) error {
+	var device models.KioskDevice
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Device not found",
+			"data":    nil,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Device found",
+		"data":    device,
+	})
+}
+
+// RegisterDevice - Register a kiosk and return its API key (shown only once)
+func RegisterDevice(c *fiber.Ctx) error {
+	type DeviceInput struct {
+		DeviceID              string `json:"device_id"`
+		Name                  string `json:"name"`
+		Location              string `json:"location"`
+		ClientCertFingerprint string `json:"client_cert_fingerprint"`
+	}
+
+	var input DeviceInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	input.DeviceID = strings.TrimSpace(input.DeviceID)
+	if input.DeviceID == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Device ID is required",
+			"data":    nil,
+		})
+	}
+
+	var count int64
+	database.DB.Model(&models.KioskDevice{}).Where("device_id = ?", input.DeviceID).Count(&count)
+	if count > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A device with this ID is already registered",
+			"data":    nil,
+		})
+	}
+
+	apiKey, err := utils.GenerateDeviceKey()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to generate device key",
+			"error":   err.Error(),
+		})
+	}
+
+	device := models.KioskDevice{
+		UUID:                  utils.GenerateUUID(),
+		DeviceID:              input.DeviceID,
+		Name:                  input.Name,
+		Location:              input.Location,
+		Status:                true,
+		APIKeyHash:            utils.HashDeviceKey(apiKey),
+		APIKeyPrefix:          apiKey[:8],
+		ClientCertFingerprint: normalizeFingerprint(input.ClientCertFingerprint),
+		CreatedAt:             time.Now(),
+		UpdatedAt:             time.Now(),
+	}
+
+	if err := database.DB.Create(&device).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to register device",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogCreateWithDB(database.DB, c, "kiosk_device", device.DeviceID, device.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Device registered successfully, store the API key now: it will not be shown again",
+		"data": fiber.Map{
+			"device":  device,
+			"api_key": apiKey,
+		},
+	})
+}
+
+// UpdateDevice - Update a kiosk's details, status or client certificate
+func UpdateDevice(c *fiber.Ctx) error {
+	type UpdateDeviceInput struct {
+		Name                  string `json:"name"`
+		Location              string `json:"location"`
+		Status                *bool  `json:"status"`
+		ClientCertFingerprint string `json:"client_cert_fingerprint"`
+	}
+
+	var input UpdateDeviceInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	var device models.KioskDevice
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Device not found",
+			"data":    nil,
+		})
+	}
+
+	if input.Name != "" {
+		device.Name = input.Name
+	}
+	if input.Location != "" {
+		device.Location = input.Location
+	}
+	if input.Status != nil {
+		device.Status = *input.Status
+	}
+	if input.ClientCertFingerprint != "" {
+		device.ClientCertFingerprint = normalizeFingerprint(input.ClientCertFingerprint)
+	}
+	device.UpdatedAt = time.Now()
+
+	if err := database.DB.Save(&device).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update device",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "kiosk_device", device.DeviceID, device.UUID, map[string]interface{}{
+		"status":   device.Status,
+		"location": device.Location,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Device updated successfully",
+		"data":    device,
+	})
+}
+
+// RotateDeviceKey - Issue a new API key for a kiosk, the previous one stops working
+func RotateDeviceKey(c *fiber.Ctx) error {
+	var device models.KioskDevice
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Device not found",
+			"data":    nil,
+		})
+	}
+
+	apiKey, err := utils.GenerateDeviceKey()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to generate device key",
+			"error":   err.Error(),
+		})
+	}
+
+	device.APIKeyHash = utils.HashDeviceKey(apiKey)
+	device.APIKeyPrefix = apiKey[:8]
+	device.UpdatedAt = time.Now()
+
+	if err := database.DB.Save(&device).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to rotate device key",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "kiosk_device", device.DeviceID, device.UUID, map[string]interface{}{
+		"api_key": "rotated",
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Device key rotated, store the API key now: it will not be shown again",
+		"data": fiber.Map{
+			"device":  device,
+			"api_key": apiKey,
+		},
+	})
+}
+
+// DeleteDevice - Remove a kiosk from the registry
+func DeleteDevice(c *fiber.Ctx) error {
+	var device models.KioskDevice
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&device).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Device not found",
+			"data":    nil,
+		})
+	}
+
+	if err := database.DB.Delete(&device).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to delete device",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogDeleteWithDB(database.DB, c, "kiosk_device", device.DeviceID, device.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Device deleted successfully",
+		"data":    nil,
+	})
+}
+
+// normalizeFingerprint accepts "AB:CD:..." as printed by openssl and stores lowercase hex
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
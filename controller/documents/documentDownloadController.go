@@ -0,0 +1,183 @@
+package documents
+
+import (
+	"errors"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// CreateDocumentDownloadToken - Issue a short-lived link to the Google Drive file of a document.
+// On a kiosk the link is bound to the device, and to the citizen identified by
+// fingerprint when an X-Kiosk-Session header is sent (required with KIOSK_REQUIRE_CITIZEN_SESSION).
+func CreateDocumentDownloadToken(c *fiber.Ctx) error {
+	db := database.DB
+
+	var document models.Documents
+	if err := db.Where("uuid = ?", c.Params("uuid")).First(&document).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document not found",
+			"data":    nil,
+		})
+	}
+
+	device := utils.CurrentDevice(c)
+	if device != nil {
+		if _, err := kioskDocumentAccess(c, device, &document); err != nil {
+			return driveAccessDenied(c, err)
+		}
+	}
+
+	token, expiresAt, err := utils.IssueDocumentDownloadToken(&document, device)
+	if err != nil {
+		return driveAccessDenied(c, err)
+	}
+
+	utils.LogViewWithDB(db, c, "document_download", "Download link issued for document "+document.UUID, document.UUID)
+
+	links := downloadLinks(c, token)
+	links["document_uuid"] = document.UUID
+	links["expires_at"] = expiresAt
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Download link issued",
+		"data":    links,
+	})
+}
+
+// kioskDocumentAccess applies the kiosk rules to a document: it must be active
+// and, when a citizen session is sent or required, belong to that citizen.
+// The citizen is nil when the session is optional and none was sent.
+func kioskDocumentAccess(c *fiber.Ctx, device *models.KioskDevice, document *models.Documents) (*models.Citizens, error) {
+	if !document.IsActive {
+		return nil, utils.ErrDocumentInactive
+	}
+
+	citizen, err := kioskCitizen(c, device)
+	if err != nil {
+		return nil, err
+	}
+	if citizen != nil && int64(citizen.NationalID) != document.NationalID {
+		utils.LogErrorWithDB(database.DB, c, "document_download", "Access refused, document of another citizen", map[string]interface{}{
+			"document_uuid": document.UUID,
+			"citizen_uuid":  citizen.UUID.String(),
+			"device_uuid":   device.UUID,
+		})
+		return nil, utils.ErrDocumentNotOwned
+	}
+	return citizen, nil
+}
+
+// kioskCitizen returns the citizen of the kiosk session sent with the
+// request, nil when there is none and the session is optional
+func kioskCitizen(c *fiber.Ctx, device *models.KioskDevice) (*models.Citizens, error) {
+	session := c.Get("X-Kiosk-Session")
+	if session == "" {
+		if utils.KioskSessionRequired() {
+			return nil, utils.ErrKioskSessionRequired
+		}
+		return nil, nil
+	}
+
+	claims, err := utils.ParseKioskSession(session, device)
+	if err != nil {
+		return nil, err
+	}
+
+	var citizen models.Citizens
+	if err := database.DB.Where("uuid = ?", claims.Subject).First(&citizen).Error; err != nil {
+		return nil, utils.ErrKioskSessionInvalid
+	}
+	return &citizen, nil
+}
+
+// resolveDriveDocument returns the registered document, and its Drive file,
+// behind a proxy request. Kiosks present a download token; authenticated
+// staff may also name the file as long as it belongs to a document.
+func resolveDriveDocument(c *fiber.Ctx, token, fileID string) (*models.Documents, string, error) {
+	if token == "" {
+		if fileID == "" || utils.CurrentUser(c) == nil {
+			return nil, "", utils.ErrDownloadTokenRequired
+		}
+		document, err := utils.FindDocumentByDriveFileID(database.DB, fileID)
+		if err != nil {
+			return nil, "", err
+		}
+		return document, fileID, nil
+	}
+
+	claims, err := utils.ParseDocumentDownloadToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	device := utils.CurrentDevice(c)
+	if claims.DeviceUUID != "" && (device == nil || device.UUID != claims.DeviceUUID) {
+		return nil, "", utils.ErrDownloadTokenInvalid
+	}
+
+	var document models.Documents
+	if err := database.DB.Where("uuid = ?", claims.Subject).First(&document).Error; err != nil {
+		return nil, "", utils.ErrDocumentNotRegistered
+	}
+
+	// A re-issued document points to another file, and kiosks only see active documents
+	if utils.DocumentDriveFileID(&document) != claims.FileID || (device != nil && !document.IsActive) {
+		return nil, "", utils.ErrDownloadTokenInvalid
+	}
+
+	return &document, claims.FileID, nil
+}
+
+// documentDownloadToken returns the token of the request, or a new one for
+// the document when the file was named directly
+func documentDownloadToken(c *fiber.Ctx, document *models.Documents, token string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	token, _, err := utils.IssueDocumentDownloadToken(document, utils.CurrentDevice(c))
+	return token, err
+}
+
+// downloadLinks builds the proxy URLs of a download token, under the kiosk
+// or the staff routes depending on who asked
+func downloadLinks(c *fiber.Ctx, token string) fiber.Map {
+	prefix := "/api/documents"
+	if utils.CurrentDevice(c) != nil {
+		prefix = "/api/public/documents"
+	}
+
+	return fiber.Map{
+		"token":           token,
+		"download_url":    prefix + "/gdrive/download?token=" + token,
+		"metadata_url":    prefix + "/gdrive/metadata?token=" + token,
+		"stamped_pdf_url": prefix + "/generate-stamped-pdf?token=" + token,
+	}
+}
+
+// driveAccessErrorStatus maps a refused document file access to its HTTP status
+func driveAccessErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrDownloadTokenInvalid), errors.Is(err, utils.ErrKioskSessionRequired), errors.Is(err, utils.ErrKioskSessionInvalid):
+		return 401
+	case errors.Is(err, utils.ErrDownloadTokenRequired), errors.Is(err, utils.ErrDocumentNotOwned), errors.Is(err, utils.ErrDocumentInactive):
+		return 403
+	case errors.Is(err, utils.ErrDocumentNotRegistered):
+		return 404
+	case errors.Is(err, utils.ErrDocumentNotOnDrive):
+		return 422
+	}
+	return 500
+}
+
+func driveAccessDenied(c *fiber.Ctx, err error) error {
+	return c.Status(driveAccessErrorStatus(err)).JSON(fiber.Map{
+		"status":  "error",
+		"message": "Access to the document file was refused",
+		"error":   err.Error(),
+	})
+}
@@ -0,0 +1,249 @@
+package documents
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetDocumentVersions - List every version of a document, newest first
+func GetDocumentVersions(c *fiber.Ctx) error {
+	documentUUID := c.Params("uuid")
+	db := database.DB
+
+	var document models.Documents
+	if err := db.Where("uuid = ?", documentUUID).First(&document).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document not found",
+			"data":    nil,
+		})
+	}
+
+	var versions []models.DocumentVersion
+	if err := db.Where("document_uuid = ?", documentUUID).Order("version DESC").Find(&versions).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch document versions",
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document versions retrieved successfully",
+		"data": fiber.Map{
+			"document_uuid":        document.UUID,
+			"current_version":      document.CurrentVersion,
+			"current_version_uuid": document.CurrentVersionUUID,
+			"versions":             versions,
+		},
+	})
+}
+
+// DownloadDocumentVersion - Download the file of one version of a document
+func DownloadDocumentVersion(c *fiber.Ctx) error {
+	documentUUID := c.Params("uuid")
+	db := database.DB
+
+	versionNumber, err := strconv.Atoi(c.Params("version"))
+	if err != nil || versionNumber <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid version number",
+			"data":    nil,
+		})
+	}
+
+	var version models.DocumentVersion
+	if err := db.Where("document_uuid = ? AND version = ?", documentUUID, versionNumber).First(&version).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document version not found",
+			"data":    nil,
+		})
+	}
+
+	etag := "\"" + version.FileHash + "\""
+	if version.FileHash != "" && c.Get("If-None-Match") == etag {
+		c.Set("ETag", etag)
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	data, err := utils.FetchDocumentVersionContent(c.UserContext(), &version)
+	if err == utils.ErrDocumentContentChanged {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document file failed integrity check",
+			"data":    nil,
+		})
+	}
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to retrieve document file",
+			"error":   err.Error(),
+		})
+	}
+
+	extension, contentType := utils.DetectFileType(data)
+	if version.ContentType != "" {
+		contentType = version.ContentType
+	}
+	if extension == "" {
+		extension = "bin"
+	}
+
+	utils.LogViewWithDB(db, c, "document_version", fmt.Sprintf("Document version %d downloaded", version.Version), version.UUID)
+
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"document_%s_v%d.%s\"", documentUUID, version.Version, extension))
+	c.Set("Content-Length", strconv.Itoa(len(data)))
+	c.Set("Cache-Control", "private, no-cache")
+	if version.FileHash != "" {
+		c.Set("ETag", etag)
+	}
+
+	return c.Send(data)
+}
+
+// CreateDocumentVersion - Re-issue a document with a new file (multipart
+// "document" field) or a new URL ("document_data"). Older versions are kept.
+// The re-issue starts a new validity period (expiry_date, or the validity of
+// the document type) and reactivates a document deactivated by expiry.
+func CreateDocumentVersion(c *fiber.Ctx) error {
+	documentUUID := c.Params("uuid")
+	db := database.DB
+
+	type VersionInput struct {
+		DocumentDataUrl string `json:"document_data" form:"document_data"`
+		IssueDate       string `json:"issue_date" form:"issue_date"`
+		ExpiryDate      string `json:"expiry_date" form:"expiry_date"`
+		Reason          string `json:"reason" form:"reason"`
+	}
+
+	var input VersionInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	expiryDate, err := utils.ParseExpiryDate(input.ExpiryDate)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+			"data":    nil,
+		})
+	}
+
+	var document models.Documents
+	if err := db.Where("uuid = ?", documentUUID).First(&document).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document not found",
+			"data":    nil,
+		})
+	}
+
+	issuer, _ := utils.GetUserUUIDFromToken(c)
+	version := models.DocumentVersion{
+		DocumentDataUrl: input.DocumentDataUrl,
+		IssueDate:       parseIssueDate(input.IssueDate),
+		IssuedBy:        issuer,
+		Reason:          input.Reason,
+	}
+
+	var stored *utils.StoredDocument
+	file, err := c.FormFile("document")
+	if err != nil {
+		file, err = c.FormFile("file")
+	}
+
+	if err == nil {
+		fileHandle, err := file.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to read uploaded file",
+				"error":   err.Error(),
+			})
+		}
+		defer fileHandle.Close()
+
+		// Types missing from the catalogue put no restriction on the format
+		documentType, _ := utils.GetDocumentType(db, document.DocumentType)
+
+		// Every version gets its own file, older versions are never overwritten
+		stored, err = utils.StoreDocumentUpload(c.UserContext(), fileHandle, file.Size, document.UUID+"-"+utils.GenerateUUID(), documentType)
+		if err != nil {
+			return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to upload document",
+				"error":   err.Error(),
+			})
+		}
+
+		version.DocumentDataUrl = ""
+		version.StorageBackend = stored.Backend
+		version.StorageKey = stored.Key
+		version.ContentType = stored.ContentType
+		version.FileSize = stored.Size
+		version.FileHash = stored.SHA256
+	} else if input.DocumentDataUrl == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A file in the 'document' field or a document_data URL is required",
+			"data":    nil,
+		})
+	} else if err := utils.PinDocumentVersion(c.UserContext(), &version); err != nil {
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to read the document file",
+			"error":   err.Error(),
+		})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := utils.AddDocumentVersion(tx, &document, &version); err != nil {
+			return err
+		}
+		return utils.RenewDocumentExpiry(tx, &document, expiryDate, true, time.Now())
+	})
+	if err != nil {
+		// Do not leave an orphan file behind
+		if stored != nil {
+			if store, openErr := utils.OpenStorage(stored.Backend); openErr == nil {
+				store.Delete(c.UserContext(), stored.Key)
+			}
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create document version",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(db, c, "document", document.DocumentType, document.UUID, map[string]interface{}{
+		"version": version.Version,
+		"reason":  version.Reason,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document re-issued successfully",
+		"data": fiber.Map{
+			"document": document,
+			"version":  version,
+		},
+	})
+}
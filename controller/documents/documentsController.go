@@ -1,27 +1,19 @@
 package documents
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/Danny19977/certikiosk.git/database"
 	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/Danny19977/certikiosk.git/utils"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
-// Helper functions
-func contains(s, substr string) bool {
-	return strings.Contains(s, substr)
-}
-
-func splitString(s, sep string) []string {
-	return strings.Split(s, sep)
-}
-
 // GetPaginatedDocuments - Get paginated list of documents
 func GetPaginatedDocuments(c *fiber.Ctx) error {
 	db := database.DB
@@ -135,7 +127,7 @@ func GetDocumentsByNationalID(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Documents retrieved successfully",
-		"data":    documents,
+		"data":    withExpiry(db, documents, time.Now()),
 	})
 }
 
@@ -173,13 +165,53 @@ func GetActiveDocuments(c *fiber.Ctx) error {
 		})
 	}
 
+	// Documents past their expiry date are left out even before the expiry job deactivates them
+	active := []documentWithExpiry{}
+	for _, document := range withExpiry(db, documents, time.Now()) {
+		if document.Expiry.Status != utils.DocumentExpired {
+			active = append(active, document)
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Active documents retrieved successfully",
-		"data":    documents,
+		"data":    active,
 	})
 }
 
+// documentWithExpiry is a document with its expiry status, as shown on the kiosk
+type documentWithExpiry struct {
+	models.Documents
+	Expiry utils.DocumentExpiry `json:"expiry"`
+}
+
+// withExpiry adds the expiry status to documents, loading their types once
+func withExpiry(db *gorm.DB, documents []models.Documents, now time.Time) []documentWithExpiry {
+	var codes []string
+	for _, document := range documents {
+		codes = append(codes, document.DocumentType)
+	}
+
+	types := map[string]*models.DocumentType{}
+	if len(codes) > 0 {
+		var documentTypes []models.DocumentType
+		db.Where("code IN ?", codes).Find(&documentTypes)
+		for i := range documentTypes {
+			types[documentTypes[i].Code] = &documentTypes[i]
+		}
+	}
+
+	result := make([]documentWithExpiry, 0, len(documents))
+	for i := range documents {
+		result = append(result, documentWithExpiry{
+			Documents: documents[i],
+			Expiry:    utils.GetDocumentExpiry(&documents[i], types[documents[i].DocumentType], now),
+		})
+	}
+	return result
+}
+
 // CreateDocument - Upload/Register a new document
 func CreateDocument(c *fiber.Ctx) error {
 	type DocumentInput struct {
@@ -188,6 +220,7 @@ func CreateDocument(c *fiber.Ctx) error {
 		DocumentType    string `json:"document_type"`
 		DocumentDataUrl string `json:"document_data"`
 		IssueDate       string `json:"issue_date"`
+		ExpiryDate      string `json:"expiry_date"` // Defaults to the validity of the document type
 		IsActive        bool   `json:"is_active"`
 	}
 
@@ -218,29 +251,41 @@ func CreateDocument(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse issue date
-	issueDate := time.Now()
-	if input.IssueDate != "" {
-		parsedDate, err := time.Parse("2006-01-02", input.IssueDate)
-		if err == nil {
-			issueDate = parsedDate
-		}
+	documentType, err := utils.GetActiveDocumentType(database.DB, input.DocumentType)
+	if err != nil {
+		return c.Status(documentTypeErrorStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid document type",
+			"error":   err.Error(),
+		})
 	}
 
+	expiryDate, err := utils.ParseExpiryDate(input.ExpiryDate)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+			"data":    nil,
+		})
+	}
+
+	issueDate := parseIssueDate(input.IssueDate)
+
 	document := models.Documents{
 		UUID:            utils.GenerateUUID(),
 		NationalID:      input.NationalID,
 		UserUUID:        input.UserUUID,
-		DocumentType:    input.DocumentType,
+		DocumentType:    documentType.Code,
 		DocumentDataUrl: input.DocumentDataUrl,
 		IssueDate:       issueDate,
+		ExpiryDate:      expiryDate,
 		IsActive:        input.IsActive,
 		CreatedAt:       time.Now(),
 		UpdatedAt:       time.Now(),
 	}
 
-	if err := database.DB.Create(&document).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
+	if err := createVersionedDocument(c, &document); err != nil {
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to create document",
 			"error":   err.Error(),
@@ -248,7 +293,7 @@ func CreateDocument(c *fiber.Ctx) error {
 	}
 
 	// Log document creation
-	utils.LogCreateWithDB(database.DB, c, "document", input.DocumentType, document.UUID)
+	utils.LogCreateWithDB(database.DB, c, "document", document.DocumentType, document.UUID)
 
 	return c.JSON(fiber.Map{
 		"status":  "success",
@@ -257,6 +302,179 @@ func CreateDocument(c *fiber.Ctx) error {
 	})
 }
 
+// parseIssueDate reads a YYYY-MM-DD issue date, today when missing or invalid
+func parseIssueDate(value string) time.Time {
+	if value != "" {
+		if parsedDate, err := time.Parse("2006-01-02", value); err == nil {
+			return parsedDate
+		}
+	}
+	return time.Now()
+}
+
+// createVersionedDocument stores a new document together with its first version
+func createVersionedDocument(c *fiber.Ctx, document *models.Documents) error {
+	issuer, _ := utils.GetUserUUIDFromToken(c)
+
+	version := utils.NewDocumentVersion(document, issuer, "")
+	if err := utils.PinDocumentVersion(c.UserContext(), &version); err != nil {
+		return err
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(document).Error; err != nil {
+			return err
+		}
+		return utils.AddDocumentVersion(tx, document, &version)
+	})
+}
+
+// UploadDocument - Upload a scanned document file and register it
+func UploadDocument(c *fiber.Ctx) error {
+	file, err := c.FormFile("document")
+	if err != nil {
+		file, err = c.FormFile("file")
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A file is required in the 'document' field",
+			"data":    nil,
+		})
+	}
+
+	nationalID, _ := strconv.ParseInt(c.FormValue("national_id"), 10, 64)
+	documentTypeCode := c.FormValue("document_type")
+
+	if documentTypeCode == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type is required",
+			"data":    nil,
+		})
+	}
+
+	if nationalID == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "National ID is required",
+			"data":    nil,
+		})
+	}
+
+	if file.Size > utils.GetDocumentMaxUploadSize() {
+		return c.Status(413).JSON(fiber.Map{
+			"status":  "error",
+			"message": fmt.Sprintf("Document is too large, the limit is %d MB", utils.GetDocumentMaxUploadSize()>>20),
+			"data":    nil,
+		})
+	}
+
+	documentType, err := utils.GetActiveDocumentType(database.DB, documentTypeCode)
+	if err != nil {
+		return c.Status(documentTypeErrorStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid document type",
+			"error":   err.Error(),
+		})
+	}
+
+	expiryDate, err := utils.ParseExpiryDate(c.FormValue("expiry_date"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+			"data":    nil,
+		})
+	}
+
+	issueDate := parseIssueDate(c.FormValue("issue_date"))
+
+	fileHandle, err := file.Open()
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to read uploaded file",
+			"error":   err.Error(),
+		})
+	}
+	defer fileHandle.Close()
+
+	documentUUID := utils.GenerateUUID()
+
+	stored, err := utils.StoreDocumentUpload(c.UserContext(), fileHandle, file.Size, documentUUID, documentType)
+	if err != nil {
+		utils.LogErrorWithDB(database.DB, c, "document_upload", err.Error(), map[string]interface{}{
+			"file_name": file.Filename,
+			"size":      file.Size,
+		})
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to upload document",
+			"error":   err.Error(),
+		})
+	}
+
+	document := models.Documents{
+		UUID:           documentUUID,
+		NationalID:     nationalID,
+		UserUUID:       c.FormValue("user_uuid"),
+		DocumentType:   documentType.Code,
+		StorageBackend: stored.Backend,
+		StorageKey:     stored.Key,
+		ContentType:    stored.ContentType,
+		FileSize:       stored.Size,
+		FileHash:       stored.SHA256,
+		IssueDate:      issueDate,
+		ExpiryDate:     expiryDate,
+		IsActive:       c.FormValue("is_active", "true") == "true",
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	if err := createVersionedDocument(c, &document); err != nil {
+		// Do not leave an orphan file behind
+		if store, openErr := utils.OpenStorage(stored.Backend); openErr == nil {
+			store.Delete(c.UserContext(), stored.Key)
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create document",
+			"error":   err.Error(),
+		})
+	}
+
+	// Log document upload
+	utils.LogCreateWithDB(database.DB, c, "document", document.DocumentType, document.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document uploaded successfully",
+		"data":    document,
+	})
+}
+
+// uploadErrorStatus maps a rejected upload to its HTTP status
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, utils.ErrDocumentTooLarge):
+		return 413
+	case errors.Is(err, utils.ErrUnsupportedDocumentType), errors.Is(err, utils.ErrDocumentFormatNotAllowed):
+		return 415
+	case errors.Is(err, utils.ErrInvalidDocument), errors.Is(err, utils.ErrDocumentUnreadable):
+		return 422
+	}
+	return 500
+}
+
+// documentTypeErrorStatus maps a rejected document type to its HTTP status
+func documentTypeErrorStatus(err error) int {
+	if errors.Is(err, utils.ErrUnknownDocumentType) || errors.Is(err, utils.ErrInactiveDocumentType) {
+		return 400
+	}
+	return 500
+}
+
 // FetchDocumentFromExternalSource - Retrieve document from Google Drive or AWS
 func FetchDocumentFromExternalSource(c *fiber.Ctx) error {
 	type FetchDocumentInput struct {
@@ -277,10 +495,10 @@ func FetchDocumentFromExternalSource(c *fiber.Ctx) error {
 		})
 	}
 
-	if input.Source == "" || input.DocumentID == "" {
+	if input.Source == "" || input.DocumentID == "" || input.DocumentType == "" {
 		return c.Status(400).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Source and document ID are required",
+			"message": "Source, document ID and document type are required",
 			"data":    nil,
 		})
 	}
@@ -293,46 +511,86 @@ func FetchDocumentFromExternalSource(c *fiber.Ctx) error {
 		})
 	}
 
-	// TODO: Implement actual external source retrieval
-	// For now, this is a placeholder structure
-	var documentUrl string
+	documentType, err := utils.GetActiveDocumentType(database.DB, input.DocumentType)
+	if err != nil {
+		return c.Status(documentTypeErrorStatus(err)).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid document type",
+			"error":   err.Error(),
+		})
+	}
 
-	switch input.Source {
-	case "google_drive":
-		// Call Google Drive API utility function
-		documentUrl = "https://drive.google.com/file/d/" + input.DocumentID
-	case "aws_s3":
-		// Call AWS S3 utility function
-		documentUrl = "https://s3.amazonaws.com/bucket/" + input.DocumentID
-	default:
+	// External sources are storage backends, the document keeps a reference to its file
+	backends := map[string]string{
+		"google_drive": utils.StorageDrive,
+		"aws_s3":       utils.StorageS3,
+		"local":        utils.StorageLocal,
+	}
+	backend, ok := backends[input.Source]
+	if !ok {
 		return c.Status(400).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Invalid source. Use 'google_drive' or 'aws_s3'",
+			"message": "Invalid source. Use 'google_drive', 'aws_s3' or 'local'",
 			"data":    nil,
 		})
 	}
 
+	store, err := utils.OpenStorage(backend)
+	if err != nil {
+		return c.Status(503).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Storage source is not configured",
+			"error":   err.Error(),
+		})
+	}
+
+	// Only register files that actually exist
+	info, err := store.Stat(c.UserContext(), input.DocumentID)
+	if err == utils.ErrObjectNotFound {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document not found in " + input.Source,
+			"data":    nil,
+		})
+	}
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to reach external source",
+			"error":   err.Error(),
+		})
+	}
+
+	documentUrl := ""
+	if backend == utils.StorageDrive {
+		documentUrl = utils.GetDriveViewURL(info.Key)
+	}
+
 	// Create document record
 	document := models.Documents{
 		UUID:            utils.GenerateUUID(),
 		NationalID:      input.NationalID,
 		UserUUID:        input.UserUUID,
-		DocumentType:    input.DocumentType,
+		DocumentType:    documentType.Code,
 		DocumentDataUrl: documentUrl,
+		StorageBackend:  backend,
+		StorageKey:      info.Key,
 		IssueDate:       time.Now(),
 		IsActive:        true,
 		CreatedAt:       time.Now(),
 		UpdatedAt:       time.Now(),
 	}
 
-	if err := database.DB.Create(&document).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
+	if err := createVersionedDocument(c, &document); err != nil {
+		return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to save document",
 			"error":   err.Error(),
 		})
 	}
 
+	utils.LogCreateWithDB(database.DB, c, "document", document.DocumentType, document.UUID)
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Document fetched and saved successfully",
@@ -346,11 +604,14 @@ func UpdateDocument(c *fiber.Ctx) error {
 	db := database.DB
 
 	type UpdateDocumentInput struct {
-		NationalID      int64  `json:"national_id"`
-		UserUUID        string `json:"user_uuid"`
-		DocumentType    string `json:"document_type"`
-		DocumentDataUrl string `json:"document_data"`
-		IsActive        *bool  `json:"is_active"`
+		NationalID      int64   `json:"national_id"`
+		UserUUID        string  `json:"user_uuid"`
+		DocumentType    string  `json:"document_type"`
+		DocumentDataUrl string  `json:"document_data"` // A new URL re-issues the document as a new version
+		IssueDate       string  `json:"issue_date"`
+		ExpiryDate      *string `json:"expiry_date"` // "" goes back to the validity of the document type, a re-issue resets it
+		Reason          string  `json:"reason"`
+		IsActive        *bool   `json:"is_active"`
 	}
 
 	var updateData UpdateDocumentInput
@@ -380,18 +641,87 @@ func UpdateDocument(c *fiber.Ctx) error {
 		document.UserUUID = updateData.UserUUID
 	}
 	if updateData.DocumentType != "" {
-		document.DocumentType = updateData.DocumentType
+		documentType, err := utils.GetActiveDocumentType(db, updateData.DocumentType)
+		if err != nil {
+			return c.Status(documentTypeErrorStatus(err)).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid document type",
+				"error":   err.Error(),
+			})
+		}
+		document.DocumentType = documentType.Code
 	}
-	if updateData.DocumentDataUrl != "" {
-		document.DocumentDataUrl = updateData.DocumentDataUrl
+	if updateData.ExpiryDate != nil {
+		expiryDate, err := utils.ParseExpiryDate(*updateData.ExpiryDate)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": err.Error(),
+				"data":    nil,
+			})
+		}
+		document.ExpiryDate = expiryDate
 	}
 	if updateData.IsActive != nil {
 		document.IsActive = *updateData.IsActive
 	}
+	// A re-issue brings a new validity period, checked once the version is added
+	if document.IsActive && updateData.DocumentDataUrl == "" {
+		documentType, _ := utils.GetDocumentType(db, document.DocumentType)
+		if expiry := utils.GetDocumentExpiry(&document, documentType, time.Now()); expiry.Status == utils.DocumentExpired {
+			return c.Status(409).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Document has expired, update its expiry date or re-issue it before activating it",
+				"data":    expiry,
+			})
+		}
+		document.ExpiredAt = nil
+	}
 
 	document.UpdatedAt = time.Now()
 
-	if err := db.Save(&document).Error; err != nil {
+	// The previous file is kept as an older version instead of being overwritten
+	reissued := updateData.DocumentDataUrl != "" && (updateData.DocumentDataUrl != document.DocumentDataUrl || document.StorageKey != "")
+
+	var version models.DocumentVersion
+	if reissued {
+		issuer, _ := utils.GetUserUUIDFromToken(c)
+		version = models.DocumentVersion{
+			DocumentDataUrl: updateData.DocumentDataUrl,
+			IssueDate:       parseIssueDate(updateData.IssueDate),
+			IssuedBy:        issuer,
+			Reason:          updateData.Reason,
+		}
+		if err := utils.PinDocumentVersion(c.UserContext(), &version); err != nil {
+			return c.Status(uploadErrorStatus(err)).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to read the new document file",
+				"error":   err.Error(),
+			})
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&document).Error; err != nil {
+			return err
+		}
+		if !reissued {
+			return nil
+		}
+
+		if err := utils.AddDocumentVersion(tx, &document, &version); err != nil {
+			return err
+		}
+
+		// The previous expiry date does not carry over to the new issue, which
+		// reactivates an expired document unless is_active=false was sent
+		var expiryDate *time.Time
+		if updateData.ExpiryDate != nil {
+			expiryDate = document.ExpiryDate
+		}
+		return utils.RenewDocumentExpiry(tx, &document, expiryDate, updateData.IsActive == nil || *updateData.IsActive, time.Now())
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to update document",
@@ -399,6 +729,13 @@ func UpdateDocument(c *fiber.Ctx) error {
 		})
 	}
 
+	if reissued {
+		utils.LogUpdateWithDB(db, c, "document", document.DocumentType, document.UUID, map[string]interface{}{
+			"version": document.CurrentVersion,
+			"reason":  updateData.Reason,
+		})
+	}
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Document updated successfully",
@@ -449,6 +786,19 @@ func ToggleDocumentStatus(c *fiber.Ctx) error {
 		})
 	}
 
+	// An expired document stays inactive until its expiry date is moved or it is re-issued
+	if !document.IsActive {
+		documentType, _ := utils.GetDocumentType(db, document.DocumentType)
+		if expiry := utils.GetDocumentExpiry(&document, documentType, time.Now()); expiry.Status == utils.DocumentExpired {
+			return c.Status(409).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Document has expired, update its expiry date or re-issue it before activating it",
+				"data":    expiry,
+			})
+		}
+		document.ExpiredAt = nil
+	}
+
 	document.IsActive = !document.IsActive
 	document.UpdatedAt = time.Now()
 
@@ -478,6 +828,7 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 		Email             string `json:"email"`
 		DocumentUUID      string `json:"document_uuid"`
 		DocumentType      string `json:"document_type"`
+		Token             string `json:"token"`                // Download token of a Google Drive document
 		FileID            string `json:"file_id"`              // Google Drive file ID
 		GoogleDriveFileID string `json:"google_drive_file_id"` // Alternative parameter name
 		FileId            string `json:"fileId"`               // CamelCase variant
@@ -491,6 +842,7 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 		input.Email = c.FormValue("email")
 		input.DocumentUUID = c.FormValue("document_uuid")
 		input.DocumentType = c.FormValue("document_type")
+		input.Token = c.FormValue("token")
 		input.FileID = c.FormValue("file_id")
 		input.GoogleDriveFileID = c.FormValue("google_drive_file_id")
 		input.FileId = c.FormValue("fileId")
@@ -499,6 +851,9 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 		if input.Email == "" {
 			input.Email = c.Query("email")
 		}
+		if input.Token == "" {
+			input.Token = c.Query("token")
+		}
 		if input.FileID == "" {
 			input.FileID = c.Query("file_id")
 		}
@@ -584,10 +939,19 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 				"error":   err.Error(),
 			})
 		}
-	} else if googleDriveFileID != "" {
-		// FALLBACK: Only download from Google Drive if NO file was uploaded
+	} else if googleDriveFileID != "" || input.Token != "" {
+		// FALLBACK: Only download from Google Drive if NO file was uploaded,
+		// and only files of registered documents
+		document, fileID, err := resolveDriveDocument(c, input.Token, googleDriveFileID)
+		if err != nil {
+			return driveAccessDenied(c, err)
+		}
+		googleDriveFileID = fileID
+		if input.DocumentType == "" {
+			input.DocumentType = document.DocumentType
+		}
 
-		pdfData, err = utils.DownloadFileFromDrive(googleDriveFileID)
+		pdfData, err = utils.ReadObject(c.UserContext(), utils.GetDriveStorage(), googleDriveFileID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"status":  "error",
@@ -604,10 +968,6 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 			})
 		}
 
-		// Set document type if not provided
-		if input.DocumentType == "" {
-			input.DocumentType = "Document"
-		}
 	} else if input.DocumentUUID != "" {
 		// Fetch document from database if UUID provided
 		db := database.DB
@@ -621,42 +981,25 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 			})
 		}
 
-		input.DocumentType = document.DocumentType
-
-		// Try to download from Google Drive if DocumentDataUrl contains a Google Drive link
-		if document.DocumentDataUrl != "" {
-			// Extract file ID from Google Drive URL if present
-			// Example: https://drive.google.com/file/d/FILE_ID/view
-			// Or: https://drive.google.com/uc?export=download&id=FILE_ID
-			var extractedFileID string
-
-			// Try to extract file ID from URL
-			if len(document.DocumentDataUrl) > 0 && (contains(document.DocumentDataUrl, "drive.google.com") ||
-				contains(document.DocumentDataUrl, "docs.google.com")) {
-
-				// Simple extraction - you may want to use regex for better accuracy
-				if contains(document.DocumentDataUrl, "/file/d/") {
-					parts := splitString(document.DocumentDataUrl, "/file/d/")
-					if len(parts) > 1 {
-						idParts := splitString(parts[1], "/")
-						if len(idParts) > 0 {
-							extractedFileID = idParts[0]
-						}
-					}
-				} else if contains(document.DocumentDataUrl, "id=") {
-					parts := splitString(document.DocumentDataUrl, "id=")
-					if len(parts) > 1 {
-						idParts := splitString(parts[1], "&")
-						extractedFileID = idParts[0]
-					}
-				}
+		// Kiosks only send the documents of the citizen identified by
+		// fingerprint, without a session they need a download token
+		if device := utils.CurrentDevice(c); device != nil {
+			citizen, err := kioskDocumentAccess(c, device, &document)
+			if err == nil && citizen == nil {
+				err = utils.ErrDownloadTokenRequired
 			}
-
-			if extractedFileID != "" {
-				pdfData, err = utils.DownloadFileFromDrive(extractedFileID)
+			if err != nil {
+				return driveAccessDenied(c, err)
 			}
 		}
 
+		input.DocumentType = document.DocumentType
+
+		// Read the document from its storage, or from its Google Drive link
+		if document.StorageKey != "" || utils.ExtractDriveFileID(document.DocumentDataUrl) != "" {
+			pdfData, _ = utils.FetchDocumentContent(c.UserContext(), &document)
+		}
+
 		// If we still don't have data, return error
 		if len(pdfData) == 0 {
 			return c.Status(400).JSON(fiber.Map{
@@ -676,10 +1019,8 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 		})
 	}
 
-	// Set default document type if not provided
-	if input.DocumentType == "" {
-		input.DocumentType = "Document"
-	}
+	// Show the catalogue name of the document type, "Document" if not provided
+	input.DocumentType = utils.DocumentTypeLabel(database.DB, input.DocumentType, c.Query("lang"))
 
 	// Determine the document identifier for logging
 	docIdentifier := input.DocumentUUID
@@ -740,6 +1081,7 @@ func SendDocumentEmail(c *fiber.Ctx) error {
 func SendDocumentEmailFromGDrive(c *fiber.Ctx) error {
 	type EmailGDriveInput struct {
 		Email        string `json:"email"`
+		Token        string `json:"token"` // Download token of the document
 		FileID       string `json:"file_id"`
 		DocumentType string `json:"document_type"`
 		DocumentName string `json:"document_name"`
@@ -751,6 +1093,7 @@ func SendDocumentEmailFromGDrive(c *fiber.Ctx) error {
 	if err := c.BodyParser(&input); err != nil {
 		// Try parsing as form data
 		input.Email = c.FormValue("email")
+		input.Token = c.FormValue("token")
 		input.FileID = c.FormValue("file_id")
 		input.DocumentType = c.FormValue("document_type")
 		input.DocumentName = c.FormValue("document_name")
@@ -773,24 +1116,24 @@ func SendDocumentEmailFromGDrive(c *fiber.Ctx) error {
 		})
 	}
 
-	if input.FileID == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Google Drive file ID is required",
-			"data":    nil,
-		})
+	// Only files of registered documents can be sent
+	document, fileID, err := resolveDriveDocument(c, input.Token, input.FileID)
+	if err != nil {
+		return driveAccessDenied(c, err)
 	}
+	input.FileID = fileID
 
 	// Set defaults
 	if input.DocumentType == "" {
-		input.DocumentType = "Document"
+		input.DocumentType = document.DocumentType
 	}
+	input.DocumentType = utils.DocumentTypeLabel(database.DB, input.DocumentType, c.Query("lang"))
 	if input.DocumentName == "" {
 		input.DocumentName = "document"
 	}
 
 	// Download file from Google Drive
-	pdfData, err := utils.DownloadPublicDriveFile(input.FileID)
+	pdfData, err := utils.ReadObject(c.UserContext(), utils.GetDriveStorage(), input.FileID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
@@ -827,6 +1170,7 @@ func SendDocumentEmailFromGDrive(c *fiber.Ctx) error {
 // GenerateStampedPDF - Generate a stamped/certified PDF for printing
 func GenerateStampedPDF(c *fiber.Ctx) error {
 	type StampedPDFInput struct {
+		Token         string `json:"token"` // Download token of the document
 		FileID        string `json:"file_id"`
 		DocumentType  string `json:"document_type"`
 		CitizenName   string `json:"citizen_name"`
@@ -842,6 +1186,7 @@ func GenerateStampedPDF(c *fiber.Ctx) error {
 	// Parse JSON or query parameters
 	if err := c.BodyParser(&input); err != nil {
 		// Try parsing from query params
+		input.Token = c.Query("token")
 		input.FileID = c.Query("file_id")
 		input.DocumentType = c.Query("document_type")
 		input.CitizenName = c.Query("citizen_name")
@@ -852,19 +1197,21 @@ func GenerateStampedPDF(c *fiber.Ctx) error {
 		input.DocumentName = c.Query("document_name", "document")
 	}
 
-	// Validate required fields
-	if input.FileID == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Google Drive file ID is required",
-			"data":    nil,
-		})
+	// Only documents registered in the database can be stamped
+	document, fileID, err := resolveDriveDocument(c, input.Token, input.FileID)
+	if err != nil {
+		return driveAccessDenied(c, err)
 	}
+	input.FileID = fileID
 
-	// Set defaults
+	// Set defaults, from the document when not provided
 	if input.DocumentType == "" {
-		input.DocumentType = "Document"
+		input.DocumentType = document.DocumentType
+	}
+	if input.NationalID == "" {
+		input.NationalID = strconv.FormatInt(document.NationalID, 10)
 	}
+	input.DocumentType = utils.DocumentTypeLabel(database.DB, input.DocumentType, c.Query("lang"))
 	if input.CertifierName == "" {
 		input.CertifierName = "CertiKiosk System"
 	}
@@ -873,7 +1220,7 @@ func GenerateStampedPDF(c *fiber.Ctx) error {
 	}
 
 	// Download original file from Google Drive
-	pdfData, err := utils.DownloadPublicDriveFile(input.FileID)
+	pdfData, err := utils.ReadObject(c.UserContext(), utils.GetDriveStorage(), input.FileID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
@@ -914,19 +1261,21 @@ func GenerateStampedPDF(c *fiber.Ctx) error {
 
 // GenerateStampedPDFMetadata - Get metadata for stamped PDF without downloading
 func GenerateStampedPDFMetadata(c *fiber.Ctx) error {
-	fileID := c.Query("file_id")
-	documentType := c.Query("document_type", "Document")
-	citizenName := c.Query("citizen_name")
-	nationalID := c.Query("national_id")
+	token := c.Query("token")
+	document, fileID, err := resolveDriveDocument(c, token, c.Query("file_id"))
+	if err != nil {
+		return driveAccessDenied(c, err)
+	}
 
-	if fileID == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Google Drive file ID is required",
-			"data":    nil,
-		})
+	token, err = documentDownloadToken(c, document, token)
+	if err != nil {
+		return driveAccessDenied(c, err)
 	}
 
+	documentType := utils.DocumentTypeLabel(database.DB, c.Query("document_type", document.DocumentType), c.Query("lang"))
+	citizenName := c.Query("citizen_name")
+	nationalID := c.Query("national_id", strconv.FormatInt(document.NationalID, 10))
+
 	// Get file info from Google Drive
 	fileInfo := utils.GetDriveFileInfo(fileID)
 
@@ -947,7 +1296,8 @@ func GenerateStampedPDFMetadata(c *fiber.Ctx) error {
 		"certification":   metadata,
 		"download_url":    fileInfo["download_url"],
 		"view_url":        fileInfo["view_url"],
-		"stamped_pdf_url": "/api/documents/generate-stamped-pdf?file_id=" + fileID,
+		"stamped_pdf_url": downloadLinks(c, token)["stamped_pdf_url"],
+		"document_uuid":   document.UUID,
 	}
 
 	return c.JSON(fiber.Map{
@@ -968,59 +1318,32 @@ func DownloadGoogleDriveFile(c *fiber.Ctx) error {
 		fileID = c.Params("file_id")
 	}
 
-	if fileID == "" {
-		return c.Status(400).JSON(fiber.Map{
+	// Only files of registered documents are served, kiosks need a download token
+	_, fileID, err := resolveDriveDocument(c, c.Query("token"), fileID)
+	if err != nil {
+		return driveAccessDenied(c, err)
+	}
+
+	// Stream the file from Google Drive (served from the disk cache when possible)
+	body, info, err := utils.GetDriveStorage().Get(c.UserContext(), fileID)
+	if err == utils.ErrObjectNotFound {
+		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Google Drive file ID is required (use ?fileId=YOUR_FILE_ID or ?file_id=YOUR_FILE_ID)",
+			"message": "File not found on Google Drive",
 			"data":    nil,
 		})
 	}
-
-	// Download file from Google Drive using backend (bypasses CORS)
-	fileData, err := utils.DownloadFileFromDrive(fileID)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
+		return c.Status(502).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to download file from Google Drive",
 			"error":   err.Error(),
 		})
 	}
 
-	if len(fileData) == 0 {
-		return c.Status(500).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Downloaded file is empty (0 bytes). The file may be private or the link is incorrect.",
-			"data":    nil,
-		})
-	}
-
-	// Set CORS headers
-	c.Set("Access-Control-Allow-Origin", "*")
-	c.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	c.Set("Access-Control-Allow-Headers", "Content-Type")
-
-	// Detect content type from file data
-	contentType := "application/octet-stream"
-	if len(fileData) > 0 {
-		// Check for common file types
-		if len(fileData) >= 4 && string(fileData[0:4]) == "%PDF" {
-			contentType = "application/pdf"
-		} else if len(fileData) >= 2 && fileData[0] == 0xFF && fileData[1] == 0xD8 {
-			contentType = "image/jpeg"
-		} else if len(fileData) >= 8 && string(fileData[0:8]) == "\x89PNG\r\n\x1a\n" {
-			contentType = "image/png"
-		} else if len(fileData) >= 6 && string(fileData[0:6]) == "GIF87a" || string(fileData[0:6]) == "GIF89a" {
-			contentType = "image/gif"
-		}
-	}
-
-	// Set content type
-	c.Set("Content-Type", contentType)
-	c.Set("Content-Disposition", "inline; filename=\"document\"")
-	c.Set("Content-Length", fmt.Sprintf("%d", len(fileData)))
-
-	// Return the file data
-	return c.Send(fileData)
+	return utils.ServeObject(c, body, info, utils.ServeOptions{
+		MaxSize: utils.GetDocumentProxyMaxSize(),
+	})
 }
 
 // GetGoogleDriveFileMetadata - Get metadata for a Google Drive file
@@ -1030,14 +1353,19 @@ func GetGoogleDriveFileMetadata(c *fiber.Ctx) error {
 		fileID = c.Params("file_id")
 	}
 
-	if fileID == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Google Drive file ID is required",
-			"data":    nil,
-		})
+	token := c.Query("token")
+	document, fileID, err := resolveDriveDocument(c, token, fileID)
+	if err != nil {
+		return driveAccessDenied(c, err)
 	}
 
+	// The proxy only accepts download tokens, hand one out with the metadata
+	token, err = documentDownloadToken(c, document, token)
+	if err != nil {
+		return driveAccessDenied(c, err)
+	}
+	proxyURL := downloadLinks(c, token)["download_url"]
+
 	// Get file metadata from Google Drive
 	metadata, err := utils.GetFileMetadata(fileID)
 	if err != nil {
@@ -1046,13 +1374,14 @@ func GetGoogleDriveFileMetadata(c *fiber.Ctx) error {
 			"file_id":      fileID,
 			"view_url":     utils.GetDriveViewURL(fileID),
 			"download_url": utils.GetPublicFileURL(fileID),
-			"proxy_url":    "/api/public/documents/gdrive/download/" + fileID,
+			"proxy_url":    proxyURL,
 			"error":        err.Error(),
 		}
 	} else {
 		// Add proxy URL to metadata
-		metadata["proxy_url"] = "/api/public/documents/gdrive/download/" + fileID
+		metadata["proxy_url"] = proxyURL
 	}
+	metadata["document_uuid"] = document.UUID
 
 	return c.JSON(fiber.Map{
 		"status":  "success",
@@ -1060,3 +1389,12 @@ func GetGoogleDriveFileMetadata(c *fiber.Ctx) error {
 		"data":    metadata,
 	})
 }
+
+// GetDriveCacheStats - Hit/miss counters and size of the Google Drive download cache
+func GetDriveCacheStats(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Google Drive cache statistics",
+		"data":    utils.GetDriveCacheStats(),
+	})
+}
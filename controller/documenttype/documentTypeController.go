@@ -0,0 +1,342 @@
+package documenttype
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAllDocumentTypes - List the document type catalogue, ?active=true for the usable types only
+func GetAllDocumentTypes(c *fiber.Ctx) error {
+	query := database.DB.Order("code ASC")
+	if c.Query("active") == "true" {
+		query = query.Where("is_active = ?", true)
+	}
+
+	var documentTypes []models.DocumentType
+	if err := query.Find(&documentTypes).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch document types",
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "All document types",
+		"data":    documentTypes,
+	})
+}
+
+// GetDocumentType - Get one document type by UUID
+func GetDocumentType(c *fiber.Ctx) error {
+	var documentType models.DocumentType
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&documentType).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type not found",
+			"data":    nil,
+		})
+	}
+
+	var documents int64
+	database.DB.Model(&models.Documents{}).Where("document_type = ?", documentType.Code).Count(&documents)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document type found",
+		"data": fiber.Map{
+			"document_type": documentType,
+			"documents":     documents,
+		},
+	})
+}
+
+type documentTypeInput struct {
+	Code                string            `json:"code"`
+	Names               map[string]string `json:"names"`
+	IssuingAuthority    string            `json:"issuing_authority"`
+	ValidityDays        int               `json:"validity_days"`
+	RequiresFingerprint *bool             `json:"requires_fingerprint"`
+	AllowedFormats      []string          `json:"allowed_formats"`
+	StampTemplate       string            `json:"stamp_template"`
+	IsActive            *bool             `json:"is_active"`
+}
+
+// normalizeFormats validates the file formats and returns them comma separated
+func normalizeFormats(formats []string) (string, string) {
+	var list []string
+	for _, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "jpeg" {
+			format = "jpg"
+		}
+		if format == "" || containsString(list, format) {
+			continue
+		}
+		if !containsString(models.DocumentFormats, format) {
+			return "", format
+		}
+		list = append(list, format)
+	}
+	return strings.Join(list, ","), ""
+}
+
+// normalizeNames drops empty names and lowercases the language codes
+func normalizeNames(names map[string]string) models.LocalizedText {
+	localized := models.LocalizedText{}
+	for lang, name := range names {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if name = strings.TrimSpace(name); lang != "" && name != "" {
+			localized[lang] = name
+		}
+	}
+	return localized
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateDocumentType - Add a document type to the catalogue
+func CreateDocumentType(c *fiber.Ctx) error {
+	var input documentTypeInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	input.Code = strings.ToLower(strings.TrimSpace(input.Code))
+	if !utils.ValidDocumentTypeCode(input.Code) {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Code is required, use lowercase letters, digits and underscores (e.g. birth_certificate)",
+			"data":    nil,
+		})
+	}
+
+	names := normalizeNames(input.Names)
+	if len(names) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "At least one name is required",
+			"data":    nil,
+		})
+	}
+
+	if input.ValidityDays < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Validity period cannot be negative",
+			"data":    nil,
+		})
+	}
+
+	formats, invalid := normalizeFormats(input.AllowedFormats)
+	if invalid != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown file format: " + invalid,
+			"data":    nil,
+		})
+	}
+
+	var count int64
+	database.DB.Model(&models.DocumentType{}).Where("code = ?", input.Code).Count(&count)
+	if count > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A document type with this code already exists",
+			"data":    nil,
+		})
+	}
+
+	documentType := models.DocumentType{
+		UUID:                utils.GenerateUUID(),
+		Code:                input.Code,
+		Names:               names,
+		IssuingAuthority:    strings.TrimSpace(input.IssuingAuthority),
+		ValidityDays:        input.ValidityDays,
+		RequiresFingerprint: input.RequiresFingerprint == nil || *input.RequiresFingerprint,
+		AllowedFormats:      formats,
+		StampTemplate:       input.StampTemplate,
+		IsActive:            input.IsActive == nil || *input.IsActive,
+		CreatedAt:           time.Now(),
+		UpdatedAt:           time.Now(),
+	}
+
+	if err := database.DB.Create(&documentType).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create document type",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogCreateWithDB(database.DB, c, "document_type", documentType.Code, documentType.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document type created successfully",
+		"data":    documentType,
+	})
+}
+
+// UpdateDocumentType - Update a document type. Renaming the code also
+// updates the documents of this type.
+func UpdateDocumentType(c *fiber.Ctx) error {
+	var documentType models.DocumentType
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&documentType).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type not found",
+			"data":    nil,
+		})
+	}
+
+	var input documentTypeInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	names := normalizeNames(input.Names)
+	if len(names) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "At least one name is required",
+			"data":    nil,
+		})
+	}
+
+	if input.ValidityDays < 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Validity period cannot be negative",
+			"data":    nil,
+		})
+	}
+
+	formats, invalid := normalizeFormats(input.AllowedFormats)
+	if invalid != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown file format: " + invalid,
+			"data":    nil,
+		})
+	}
+
+	previousCode := documentType.Code
+	if code := strings.ToLower(strings.TrimSpace(input.Code)); code != "" && code != documentType.Code {
+		if !utils.ValidDocumentTypeCode(code) {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid code, use lowercase letters, digits and underscores (e.g. birth_certificate)",
+				"data":    nil,
+			})
+		}
+
+		var count int64
+		database.DB.Model(&models.DocumentType{}).Where("code = ?", code).Count(&count)
+		if count > 0 {
+			return c.Status(409).JSON(fiber.Map{
+				"status":  "error",
+				"message": "A document type with this code already exists",
+				"data":    nil,
+			})
+		}
+
+		database.DB.Model(&models.Documents{}).Where("document_type = ?", documentType.Code).Update("document_type", code)
+		documentType.Code = code
+	}
+
+	documentType.Names = names
+	documentType.IssuingAuthority = strings.TrimSpace(input.IssuingAuthority)
+	documentType.ValidityDays = input.ValidityDays
+	documentType.AllowedFormats = formats
+	documentType.StampTemplate = input.StampTemplate
+	if input.RequiresFingerprint != nil {
+		documentType.RequiresFingerprint = *input.RequiresFingerprint
+	}
+	if input.IsActive != nil {
+		documentType.IsActive = *input.IsActive
+	}
+	documentType.UpdatedAt = time.Now()
+
+	if err := database.DB.Save(&documentType).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update document type",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "document_type", documentType.Code, documentType.UUID, map[string]interface{}{
+		"previous_code":        previousCode,
+		"validity_days":        documentType.ValidityDays,
+		"requires_fingerprint": documentType.RequiresFingerprint,
+		"allowed_formats":      documentType.AllowedFormats,
+		"is_active":            documentType.IsActive,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document type updated successfully",
+		"data":    documentType,
+	})
+}
+
+// DeleteDocumentType - Delete a document type that no document uses,
+// deactivate it instead to retire a type still in use
+func DeleteDocumentType(c *fiber.Ctx) error {
+	var documentType models.DocumentType
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&documentType).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type not found",
+			"data":    nil,
+		})
+	}
+
+	var documents int64
+	database.DB.Model(&models.Documents{}).Where("document_type = ?", documentType.Code).Count(&documents)
+	if documents > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Document type is still used by documents, deactivate it instead",
+			"data":    fiber.Map{"documents": documents},
+		})
+	}
+
+	if err := database.DB.Delete(&documentType).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to delete document type",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogDeleteWithDB(database.DB, c, "document_type", documentType.Code, documentType.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Document type deleted successfully",
+		"data":    nil,
+	})
+}
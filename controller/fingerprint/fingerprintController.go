@@ -1,6 +1,7 @@
 package fingerprint
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
@@ -10,11 +11,14 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-// EnrollFingerprint - Register a fingerprint for a citizen
+// EnrollFingerprint - Register a fingerprint for a citizen (one template per finger)
 func EnrollFingerprint(c *fiber.Ctx) error {
 	type FingerprintInput struct {
 		CitizensUUID    string `json:"citizens_uuid"`
 		FingerprintData string `json:"fingerprint_data"`
+		FingerPosition  int    `json:"finger_position"` // 1-10, read from the template when omitted
+		Quality         int    `json:"quality"`
+		DeviceID        string `json:"device_id"`
 	}
 
 	var input FingerprintInput
@@ -36,7 +40,12 @@ func EnrollFingerprint(c *fiber.Ctx) error {
 		})
 	}
 
-	// Verify citizen exists and update their fingerprint
+	// Captures from a kiosk are attributed to the authenticated device
+	if device := utils.CurrentDevice(c); device != nil {
+		input.DeviceID = device.DeviceID
+	}
+
+	// Verify citizen exists
 	var citizen models.Citizens
 	if err := database.DB.Where("uuid = ?", input.CitizensUUID).First(&citizen).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
@@ -46,20 +55,44 @@ func EnrollFingerprint(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if fingerprint already enrolled
-	if citizen.Fingerprint != "" {
+	enrollment, err := utils.NewFingerprintEnrollment(citizen.UUID.String(), input.FingerprintData, input.FingerPosition, input.Quality, input.DeviceID)
+	if err != nil {
+		if errors.Is(err, utils.ErrFingerprintEncryption) {
+			return c.Status(500).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to encrypt fingerprint",
+				"error":   err.Error(),
+			})
+		}
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid fingerprint data",
+			"error":   err.Error(),
+		})
+	}
+
+	// Position 0 is kept for migrated legacy templates, one per citizen: new
+	// captures must name their finger or they would collide on it
+	if enrollment.FingerPosition == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Finger position is required",
+			"error":   "finger_position must be between 1 and 10 when the template does not carry it",
+		})
+	}
+
+	// Check if this finger is already enrolled
+	var count int64
+	database.DB.Model(&models.Fingerprint{}).Where("citizens_uuid = ? AND finger_position = ?", enrollment.CitizensUUID, enrollment.FingerPosition).Count(&count)
+	if count > 0 {
 		return c.Status(409).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Fingerprint already enrolled for this citizen",
+			"message": "Fingerprint already enrolled for this finger",
 			"data":    nil,
 		})
 	}
 
-	// Update citizen with fingerprint data
-	citizen.Fingerprint = input.FingerprintData
-	citizen.UpdatedAt = time.Now()
-
-	if err := database.DB.Save(&citizen).Error; err != nil {
+	if err := database.DB.Create(&enrollment).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to enroll fingerprint",
@@ -68,18 +101,24 @@ func EnrollFingerprint(c *fiber.Ctx) error {
 	}
 
 	// Log fingerprint enrollment
-	utils.LogCreateWithDB(database.DB, c, "fingerprint", "Fingerprint enrolled for "+citizen.FirstName+" "+citizen.LastName, citizen.UUID.String())
+	utils.LogCreateWithDB(database.DB, c, "fingerprint", "Fingerprint enrolled for "+citizen.FirstName+" "+citizen.LastName, enrollment.UUID)
 
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Fingerprint enrolled successfully",
-		"data":    citizen,
+		"data": fiber.Map{
+			"citizen":     citizen,
+			"fingerprint": enrollment,
+		},
 	})
 }
 
-// VerifyFingerprint - Verify a fingerprint and return citizen information
+// VerifyFingerprint - Verify a fingerprint and return citizen information.
+// With citizens_uuid the capture is verified 1:1 against that citizen,
+// otherwise it is identified 1:N against every enrolled template.
 func VerifyFingerprint(c *fiber.Ctx) error {
 	type FingerprintVerifyInput struct {
+		CitizensUUID    string `json:"citizens_uuid"`
 		FingerprintData string `json:"fingerprint_data"`
 	}
 
@@ -101,24 +140,115 @@ func VerifyFingerprint(c *fiber.Ctx) error {
 		})
 	}
 
-	// Find citizen by fingerprint
-	var citizen models.Citizens
-	if err := database.DB.Where("fingerprint = ?", input.FingerprintData).First(&citizen).Error; err != nil {
+	if err := validateTemplate(input.FingerprintData); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid fingerprint data",
+			"error":   err.Error(),
+		})
+	}
+
+	// Collect candidate templates per citizen
+	var fingerprints []models.Fingerprint
+	query := database.DB.Model(&models.Fingerprint{})
+	if input.CitizensUUID != "" {
+		query = query.Where("citizens_uuid = ?", input.CitizensUUID)
+	}
+	query.Find(&fingerprints)
+
+	candidates := map[string][]string{}
+	for _, fingerprint := range fingerprints {
+		template, err := utils.OpenFingerprint(fingerprint)
+		if err != nil {
+			continue
+		}
+		candidates[fingerprint.CitizensUUID] = append(candidates[fingerprint.CitizensUUID], template)
+	}
+
+	mode := "identification"
+	if input.CitizensUUID != "" {
+		mode = "verification"
+	}
+
+	best := utils.FingerprintMatchResult{Threshold: utils.GetFingerprintMatchThreshold()}
+	bestCitizen := ""
+	for citizenUUID, templates := range candidates {
+		for _, template := range templates {
+			result, err := utils.MatchFingerprintTemplates(input.FingerprintData, template)
+			if err != nil {
+				continue // skip unreadable stored templates
+			}
+			if result.Score > best.Score {
+				best = result
+				bestCitizen = citizenUUID
+			}
+		}
+	}
+
+	if !best.Matched {
+		utils.LogErrorWithDB(database.DB, c, "fingerprint_verification", "Fingerprint not recognized", map[string]interface{}{
+			"mode":          mode,
+			"citizens_uuid": input.CitizensUUID,
+			"score":         best.Score,
+		})
 		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Fingerprint not recognized",
+			"data": fiber.Map{
+				"mode":  mode,
+				"match": best,
+			},
+		})
+	}
+
+	var citizen models.Citizens
+	if err := database.DB.Where("uuid = ?", bestCitizen).First(&citizen).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Citizen not found",
 			"data":    nil,
 		})
 	}
 
+	data := fiber.Map{
+		"citizen": citizen,
+		"mode":    mode,
+		"match":   best,
+	}
+
+	// On a kiosk the match opens a citizen session, sent back in the
+	// X-Kiosk-Session header to download the citizen's documents
+	if device := utils.CurrentDevice(c); device != nil {
+		token, expiresAt, err := utils.IssueKioskSession(&citizen, device)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to open kiosk session",
+				"error":   err.Error(),
+			})
+		}
+		data["session_token"] = token
+		data["session_expires_at"] = expiresAt
+	}
+
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Fingerprint verified successfully",
-		"data":    citizen,
+		"data":    data,
 	})
 }
 
-// GetFingerprintByCitizen - Get fingerprint data for a specific citizen
+// validateTemplate makes sure the data is a minutiae template the matcher can read
+func validateTemplate(data string) error {
+	template, err := utils.DecodeFingerprintTemplate(data)
+	if err != nil {
+		return err
+	}
+	_, err = utils.ParseFingerprintTemplate(template)
+	return err
+}
+
+// GetFingerprintByCitizen - Get the enrolled fingers of a specific citizen
 func GetFingerprintByCitizen(c *fiber.Ctx) error {
 	citizenUUID := c.Params("citizen_uuid")
 
@@ -131,7 +261,10 @@ func GetFingerprintByCitizen(c *fiber.Ctx) error {
 		})
 	}
 
-	if citizen.Fingerprint == "" {
+	var fingerprints []models.Fingerprint
+	database.DB.Where("citizens_uuid = ?", citizenUUID).Order("finger_position ASC").Find(&fingerprints)
+
+	if len(fingerprints) == 0 {
 		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
 			"message": "No fingerprint found for this citizen",
@@ -143,8 +276,8 @@ func GetFingerprintByCitizen(c *fiber.Ctx) error {
 		"status":  "success",
 		"message": "Fingerprint retrieved successfully",
 		"data": fiber.Map{
-			"citizen_uuid":     citizen.UUID,
-			"fingerprint_data": citizen.Fingerprint,
+			"citizen_uuid": citizen.UUID,
+			"fingerprints": fingerprints,
 		},
 	})
 }
@@ -163,14 +296,16 @@ func GetPaginatedFingerprints(c *fiber.Ctx) error {
 	}
 	offset := (page - 1) * limit
 
-	var citizens []models.Citizens
+	var fingerprints []models.Fingerprint
 	var totalRecords int64
 
-	// Only get citizens with fingerprints
-	query := db.Model(&models.Citizens{}).Where("fingerprint != ''")
+	query := db.Model(&models.Fingerprint{})
+	if citizenUUID := c.Query("citizen_uuid", ""); citizenUUID != "" {
+		query = query.Where("citizens_uuid = ?", citizenUUID)
+	}
 	query.Count(&totalRecords)
 
-	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&citizens).Error; err != nil {
+	if err := query.Offset(offset).Limit(limit).Order("created_at DESC").Find(&fingerprints).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to fetch fingerprints",
@@ -190,17 +325,20 @@ func GetPaginatedFingerprints(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status":     "success",
 		"message":    "Fingerprints retrieved successfully",
-		"data":       citizens,
+		"data":       fingerprints,
 		"pagination": pagination,
 	})
 }
 
-// UpdateFingerprint - Update fingerprint data for a citizen
+// UpdateFingerprint - Replace the template of one enrolled finger
 func UpdateFingerprint(c *fiber.Ctx) error {
 	citizenUUID := c.Params("citizen_uuid")
 
 	type UpdateFingerprintInput struct {
 		FingerprintData string `json:"fingerprint_data"`
+		FingerPosition  int    `json:"finger_position"`
+		Quality         int    `json:"quality"`
+		DeviceID        string `json:"device_id"`
 	}
 
 	var input UpdateFingerprintInput
@@ -221,19 +359,46 @@ func UpdateFingerprint(c *fiber.Ctx) error {
 		})
 	}
 
-	var citizen models.Citizens
-	if err := database.DB.Where("uuid = ?", citizenUUID).First(&citizen).Error; err != nil {
+	replacement, err := utils.NewFingerprintEnrollment(citizenUUID, input.FingerprintData, input.FingerPosition, input.Quality, input.DeviceID)
+	if err != nil {
+		if errors.Is(err, utils.ErrFingerprintEncryption) {
+			return c.Status(500).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Failed to encrypt fingerprint",
+				"error":   err.Error(),
+			})
+		}
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid fingerprint data",
+			"error":   err.Error(),
+		})
+	}
+
+	var fingerprint models.Fingerprint
+	if err := database.DB.Where("citizens_uuid = ? AND finger_position = ?", citizenUUID, replacement.FingerPosition).First(&fingerprint).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Citizen not found",
+			"message": "No fingerprint enrolled for this finger",
 			"data":    nil,
 		})
 	}
 
-	citizen.Fingerprint = input.FingerprintData
-	citizen.UpdatedAt = time.Now()
+	fingerprint.TemplateFormat = replacement.TemplateFormat
+	fingerprint.Quality = replacement.Quality
+	fingerprint.DeviceID = replacement.DeviceID
+	fingerprint.UpdatedAt = time.Now()
+
+	// Re-seal under this record's identity, the ciphertext is bound to its UUID
+	if err := utils.SealFingerprint(&fingerprint, input.FingerprintData); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to encrypt fingerprint",
+			"error":   err.Error(),
+		})
+	}
 
-	if err := database.DB.Save(&citizen).Error; err != nil {
+	if err := database.DB.Save(&fingerprint).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
 			"message": "Failed to update fingerprint",
@@ -244,24 +409,37 @@ func UpdateFingerprint(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Fingerprint updated successfully",
-		"data":    citizen,
+		"data":    fingerprint,
 	})
 }
 
-// DeleteFingerprint - Delete a fingerprint record
+// DeleteFingerprint - Delete one finger (?finger_position=) or every fingerprint of a citizen
 func DeleteFingerprint(c *fiber.Ctx) error {
 	citizenUUID := c.Params("citizen_uuid")
 
-	var citizen models.Citizens
-	if err := database.DB.Where("uuid = ?", citizenUUID).First(&citizen).Error; err != nil {
-		return c.Status(404).JSON(fiber.Map{
+	query := database.DB.Where("citizens_uuid = ?", citizenUUID)
+	if position := c.Query("finger_position", ""); position != "" {
+		fingerPosition, err := strconv.Atoi(position)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Invalid finger position",
+				"data":    nil,
+			})
+		}
+		query = query.Where("finger_position = ?", fingerPosition)
+	}
+
+	result := query.Delete(&models.Fingerprint{})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Citizen not found",
-			"data":    nil,
+			"message": "Failed to delete fingerprint",
+			"error":   result.Error.Error(),
 		})
 	}
 
-	if citizen.Fingerprint == "" {
+	if result.RowsAffected == 0 {
 		return c.Status(404).JSON(fiber.Map{
 			"status":  "error",
 			"message": "No fingerprint found for this citizen",
@@ -269,18 +447,6 @@ func DeleteFingerprint(c *fiber.Ctx) error {
 		})
 	}
 
-	// Clear the fingerprint field
-	citizen.Fingerprint = ""
-	citizen.UpdatedAt = time.Now()
-
-	if err := database.DB.Save(&citizen).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to delete fingerprint",
-			"error":   err.Error(),
-		})
-	}
-
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"message": "Fingerprint deleted successfully",
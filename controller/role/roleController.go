@@ -0,0 +1,347 @@
+package role
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAllRoles - List every role with its permissions
+func GetAllRoles(c *fiber.Ctx) error {
+	var roles []models.Role
+	if err := database.DB.Order("name ASC").Find(&roles).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to fetch roles",
+			"error":   err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "All roles",
+		"data":    roles,
+	})
+}
+
+// GetPermissions - List the permissions that can be granted to a role
+func GetPermissions(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "All permissions",
+		"data":    models.AllPermissions,
+	})
+}
+
+// GetRole - Get one role by UUID
+func GetRole(c *fiber.Ctx) error {
+	var role models.Role
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&role).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role not found",
+			"data":    nil,
+		})
+	}
+
+	var users int64
+	database.DB.Model(&models.User{}).Where("LOWER(role) = LOWER(?)", role.Name).Count(&users)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role found",
+		"data": fiber.Map{
+			"role":        role,
+			"permissions": role.PermissionList(),
+			"users":       users,
+		},
+	})
+}
+
+type roleInput struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// normalizePermissions validates the permissions and returns them comma separated
+func normalizePermissions(permissions []string) (string, string) {
+	var list []string
+	for _, permission := range permissions {
+		permission = strings.TrimSpace(permission)
+		if permission == "" {
+			continue
+		}
+		if !models.ValidPermission(permission) {
+			return "", permission
+		}
+		list = append(list, permission)
+	}
+	return strings.Join(list, ","), ""
+}
+
+// CreateRole - Create a custom role
+func CreateRole(c *fiber.Ctx) error {
+	var input roleInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	input.Name = strings.ToLower(strings.TrimSpace(input.Name))
+	if input.Name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role name is required",
+			"data":    nil,
+		})
+	}
+
+	permissions, invalid := normalizePermissions(input.Permissions)
+	if invalid != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown permission: " + invalid,
+			"data":    nil,
+		})
+	}
+
+	var count int64
+	database.DB.Model(&models.Role{}).Where("LOWER(name) = ?", input.Name).Count(&count)
+	if count > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "A role with this name already exists",
+			"data":    nil,
+		})
+	}
+
+	role := models.Role{
+		UUID:        utils.GenerateUUID(),
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: permissions,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	if err := database.DB.Create(&role).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to create role",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogCreateWithDB(database.DB, c, "role", role.Name, role.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role created successfully",
+		"data":    role,
+	})
+}
+
+// UpdateRole - Update the description and permissions of a role
+func UpdateRole(c *fiber.Ctx) error {
+	var role models.Role
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&role).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role not found",
+			"data":    nil,
+		})
+	}
+
+	var input roleInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	permissions, invalid := normalizePermissions(input.Permissions)
+	if invalid != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown permission: " + invalid,
+			"data":    nil,
+		})
+	}
+
+	// Keep at least one way to manage roles
+	if role.Name == "admin" && permissions != "*" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "The admin role must keep all permissions",
+			"data":    nil,
+		})
+	}
+
+	// Built-in roles keep their name, users reference roles by name
+	if name := strings.ToLower(strings.TrimSpace(input.Name)); name != "" && name != role.Name {
+		if role.IsSystem {
+			return c.Status(400).JSON(fiber.Map{
+				"status":  "error",
+				"message": "Built-in roles cannot be renamed",
+				"data":    nil,
+			})
+		}
+
+		var count int64
+		database.DB.Model(&models.Role{}).Where("LOWER(name) = ?", name).Count(&count)
+		if count > 0 {
+			return c.Status(409).JSON(fiber.Map{
+				"status":  "error",
+				"message": "A role with this name already exists",
+				"data":    nil,
+			})
+		}
+
+		database.DB.Model(&models.User{}).Where("LOWER(role) = LOWER(?)", role.Name).Update("role", name)
+		role.Name = name
+	}
+
+	role.Description = input.Description
+	role.Permissions = permissions
+	role.UpdatedAt = time.Now()
+
+	if err := database.DB.Save(&role).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to update role",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "role", role.Name, role.UUID, map[string]interface{}{
+		"permissions": role.Permissions,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role updated successfully",
+		"data":    role,
+	})
+}
+
+// DeleteRole - Delete a custom role that is not assigned to any user
+func DeleteRole(c *fiber.Ctx) error {
+	var role models.Role
+	if err := database.DB.Where("uuid = ?", c.Params("uuid")).First(&role).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role not found",
+			"data":    nil,
+		})
+	}
+
+	if role.IsSystem {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Built-in roles cannot be deleted",
+			"data":    nil,
+		})
+	}
+
+	var users int64
+	database.DB.Model(&models.User{}).Where("LOWER(role) = LOWER(?)", role.Name).Count(&users)
+	if users > 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role is still assigned to users",
+			"data":    fiber.Map{"users": users},
+		})
+	}
+
+	if err := database.DB.Delete(&role).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to delete role",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogDeleteWithDB(database.DB, c, "role", role.Name, role.UUID)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role deleted successfully",
+		"data":    nil,
+	})
+}
+
+// AssignRole - Assign a role (and optional extra permissions) to a user
+func AssignRole(c *fiber.Ctx) error {
+	type AssignRoleInput struct {
+		Role       string `json:"role"`
+		Permission string `json:"permission"` // Extra comma separated permissions
+	}
+
+	var input AssignRoleInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Invalid input data",
+			"error":   err.Error(),
+		})
+	}
+
+	if !utils.RoleExists(database.DB, input.Role) {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Role not found",
+			"data":    nil,
+		})
+	}
+	if invalid := utils.InvalidPermission(input.Permission); invalid != "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Unknown permission: " + invalid,
+			"data":    nil,
+		})
+	}
+
+	var user models.User
+	if err := database.DB.Where("uuid = ?", c.Params("user_uuid")).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status":  "error",
+			"message": "User not found",
+			"data":    nil,
+		})
+	}
+
+	previousRole := user.Role
+	user.Role = strings.ToLower(input.Role)
+	user.Permission = input.Permission
+	user.UpdatedAt = time.Now()
+
+	if err := database.DB.Save(&user).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to assign role",
+			"error":   err.Error(),
+		})
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "user_role", user.Fullname, user.UUID, map[string]interface{}{
+		"previous_role": previousRole,
+		"role":          user.Role,
+		"permission":    user.Permission,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Role assigned successfully",
+		"data":    user.ToUserResponse(),
+	})
+}
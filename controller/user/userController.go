@@ -2,6 +2,7 @@ package user
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/Danny19977/certikiosk.git/database"
 	"github.com/Danny19977/certikiosk.git/models"
@@ -201,11 +202,26 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	if violations := utils.ValidatePassword(p.Password); violations != nil {
+		return c.Status(400).JSON(utils.PasswordPolicyError(violations))
+	}
+
+	if p.Role == "" {
+		p.Role = "clerk"
+	}
+	if errMessage := checkRoleAssignment(c, p.Role, p.Permission, ""); errMessage != "" {
+		return c.Status(403).JSON(fiber.Map{
+			"status":  "error",
+			"message": errMessage,
+			"data":    nil,
+		})
+	}
+
 	user := &models.User{
 		Fullname:   p.FullName,
 		Email:      p.Email,
 		Phone:      p.Phone,
-		Role:       p.Role,
+		Role:       strings.ToLower(p.Role),
 		Permission: p.Permission,
 		Status:     p.Status,
 		Signature:  p.Signature,
@@ -236,6 +252,46 @@ func CreateUser(c *fiber.Ctx) error {
 	)
 }
 
+// checkRoleAssignment makes sure the role exists and the caller may grant it.
+// It returns an error message, empty when the assignment is allowed.
+func checkRoleAssignment(c *fiber.Ctx, role, permission, targetUUID string) string {
+	if !utils.RoleExists(database.DB, role) {
+		return "Role not found: " + role
+	}
+	if invalid := utils.InvalidPermission(permission); invalid != "" {
+		return "Unknown permission: " + invalid
+	}
+
+	caller := utils.CurrentUser(c)
+	if caller == nil {
+		return "Authentication required"
+	}
+	if caller.UUID == targetUUID {
+		return "You cannot change your own role or permissions"
+	}
+
+	// Granting anything above a clerk requires the right to manage roles
+	if (strings.ToLower(role) != "clerk" || permission != "") && !utils.UserHasPermission(database.DB, caller, models.PermissionRolesManage) {
+		return "You do not have permission to assign this role"
+	}
+	return ""
+}
+
+// checkUserTarget makes sure the caller may modify the target account. Accounts
+// above a clerk, or with extra permissions, can only be modified with the
+// right to manage roles, so users:write alone cannot take them over.
+func checkUserTarget(c *fiber.Ctx, target *models.User) string {
+	caller := utils.CurrentUser(c)
+	if caller == nil {
+		return "Authentication required"
+	}
+
+	if (strings.ToLower(target.Role) != "clerk" || target.Permission != "") && !utils.UserHasPermission(database.DB, caller, models.PermissionRolesManage) {
+		return "You do not have permission to modify this user"
+	}
+	return ""
+}
+
 // Helper function to convert string to *string (handles empty strings as nil)
 func stringToPointer(s string) *string {
 	if s == "" {
@@ -276,18 +332,52 @@ func UpdateUser(c *fiber.Ctx) error {
 
 	user := new(models.User)
 
-	db.Where("uuid = ?", uuid).First(&user)
+	if err := db.Where("uuid = ?", uuid).First(&user).Error; err != nil {
+		return c.Status(404).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "No User found",
+				"data":    nil,
+			},
+		)
+	}
+
+	if errMessage := checkUserTarget(c, user); errMessage != "" {
+		return c.Status(403).JSON(fiber.Map{
+			"status":  "error",
+			"message": errMessage,
+			"data":    nil,
+		})
+	}
+
+	if !strings.EqualFold(updateData.Role, user.Role) || updateData.Permission != user.Permission {
+		if errMessage := checkRoleAssignment(c, updateData.Role, updateData.Permission, user.UUID); errMessage != "" {
+			return c.Status(403).JSON(fiber.Map{
+				"status":  "error",
+				"message": errMessage,
+				"data":    nil,
+			})
+		}
+	}
+
+	wasActive := user.Status
+
 	user.Fullname = updateData.FullName
 	user.Email = updateData.Email
 	user.Phone = updateData.Phone
 	user.Title = updateData.Title
-	user.Role = updateData.Role
+	user.Role = strings.ToLower(updateData.Role)
 	user.Permission = updateData.Permission
 	user.Status = updateData.Status
 	user.Signature = updateData.Signature
 
 	db.Save(&user)
 
+	// Disabling an account logs it out everywhere
+	if wasActive && !user.Status {
+		utils.RevokeUserSessions(db, user.UUID)
+	}
+
 	return c.JSON(
 		fiber.Map{
 			"status":  "success",
@@ -297,6 +387,134 @@ func UpdateUser(c *fiber.Ctx) error {
 	)
 }
 
+// RevokeUserSessions - Log a user out of every session
+func RevokeUserSessions(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+
+	var user models.User
+	if err := database.DB.Where("uuid = ?", uuid).First(&user).Error; err != nil {
+		return c.Status(404).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "No User found",
+				"data":    nil,
+			},
+		)
+	}
+
+	if err := utils.RevokeUserSessions(database.DB, user.UUID); err != nil {
+		return c.Status(500).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "Failed to revoke sessions",
+				"error":   err.Error(),
+			},
+		)
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "user_sessions", user.Fullname, user.UUID, map[string]interface{}{
+		"sessions": "revoked",
+	})
+
+	return c.JSON(
+		fiber.Map{
+			"status":  "success",
+			"message": "All sessions of the user have been revoked",
+			"data":    nil,
+		},
+	)
+}
+
+// ResetUserTwoFactor - Disable 2FA of a user who lost their authenticator
+func ResetUserTwoFactor(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+
+	var user models.User
+	if err := database.DB.Where("uuid = ?", uuid).First(&user).Error; err != nil {
+		return c.Status(404).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "No User found",
+				"data":    nil,
+			},
+		)
+	}
+
+	if errMessage := checkUserTarget(c, &user); errMessage != "" {
+		return c.Status(403).JSON(fiber.Map{
+			"status":  "error",
+			"message": errMessage,
+			"data":    nil,
+		})
+	}
+
+	if err := utils.ResetTwoFactor(database.DB, user.UUID); err != nil {
+		return c.Status(500).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "Failed to reset two-factor authentication",
+				"error":   err.Error(),
+			},
+		)
+	}
+
+	// Sessions opened with the old factor must not survive the reset
+	utils.RevokeUserSessions(database.DB, user.UUID)
+
+	utils.LogTwoFactorWithDB(database.DB, c, user.UUID, "reset", map[string]interface{}{
+		"reset_by": utils.CurrentUser(c).UUID,
+	})
+	utils.LogUpdateWithDB(database.DB, c, "user_two_factor", user.Fullname, user.UUID, map[string]interface{}{
+		"two_factor": "reset",
+	})
+
+	return c.JSON(
+		fiber.Map{
+			"status":  "success",
+			"message": "Two-factor authentication of the user has been reset",
+			"data":    nil,
+		},
+	)
+}
+
+// UnlockUser - Clear the failed login counter of a locked account
+func UnlockUser(c *fiber.Ctx) error {
+	uuid := c.Params("uuid")
+
+	var user models.User
+	if err := database.DB.Where("uuid = ?", uuid).First(&user).Error; err != nil {
+		return c.Status(404).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "No User found",
+				"data":    nil,
+			},
+		)
+	}
+
+	if err := utils.ClearLoginThrottle(database.DB, utils.LoginThrottleUserKey(user.UUID)); err != nil {
+		return c.Status(500).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "Failed to unlock the user",
+				"error":   err.Error(),
+			},
+		)
+	}
+
+	utils.LogUpdateWithDB(database.DB, c, "user_lockout", user.Fullname, user.UUID, map[string]interface{}{
+		"lockout": "cleared",
+	})
+
+	return c.JSON(
+		fiber.Map{
+			"status":  "success",
+			"message": "User unlocked successfully",
+			"data":    nil,
+		},
+	)
+}
+
 // Delete data
 func DeleteUser(c *fiber.Ctx) error {
 	uuid := c.Params("uuid")
@@ -1,80 +1,80 @@
 package userlog
 
 import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Danny19977/certikiosk.git/database"
 	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
-// Paginate
-func GetPaginatedUserLogs(c *fiber.Ctx) error {
-	db := database.DB
-
-	// Parse query parameters for pagination
-	page, err := strconv.Atoi(c.Query("page", "1"))
-	if err != nil || page <= 0 {
-		page = 1
-	}
-	limit, err := strconv.Atoi(c.Query("limit", "15"))
-	if err != nil || limit <= 0 {
-		limit = 15
+// applyLogFilters narrows a user_logs query with the optional filters:
+// entity_type, entity_id, action, user_uuid, device_id, outcome, request_id,
+// date_from and date_to (YYYY-MM-DD or RFC 3339, date_to inclusive)
+func applyLogFilters(c *fiber.Ctx, query *gorm.DB) (*gorm.DB, error) {
+	for param, column := range map[string]string{
+		"entity_type": "user_logs.entity_type",
+		"entity_id":   "user_logs.entity_id",
+		"user_uuid":   "user_logs.user_uuid",
+		"device_id":   "user_logs.device_id",
+		"outcome":     "user_logs.outcome",
+		"request_id":  "user_logs.request_id",
+	} {
+		if value := c.Query(param); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
 	}
-	offset := (page - 1) * limit
-
-	// Parse search query
-	search := c.Query("search", "")
-
-	var dataList []models.UserLogs
-	var totalRecords int64
 
-	// Count total records matching the search query
-	db.Model(&models.UserLogs{}).Count(&totalRecords)
-
-	err = db.
-		Joins("JOIN users ON user_logs.user_uuid=users.uuid").
-		Where("users.fullname ILIKE ? OR user_logs.name ILIKE ? OR users.title ILIKE ?", "%"+search+"%", "%"+search+"%", "%"+search+"%").
-		Offset(offset).
-		Limit(limit).
-		Order("user_logs.updated_at DESC").
-		Preload("User").
-		Find(&dataList).Error
-
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"status":  "error",
-			"message": "Failed to fetch UsersLogs",
-			"error":   err.Error(),
-		})
+	if action := c.Query("action"); action != "" {
+		query = query.Where("user_logs.action = ?", strings.ToUpper(action))
 	}
 
-	// Calculate total pages
-	totalPages := int((totalRecords + int64(limit) - 1) / int64(limit))
+	if value := c.Query("date_from"); value != "" {
+		from, _, err := parseLogDate(value)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("user_logs.created_at >= ?", from)
+	}
 
-	// Prepare pagination metadata
-	pagination := map[string]interface{}{
-		"total_records": totalRecords,
-		"total_pages":   totalPages,
-		"current_page":  page,
-		"page_size":     limit,
+	if value := c.Query("date_to"); value != "" {
+		to, dateOnly, err := parseLogDate(value)
+		if err != nil {
+			return nil, err
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+			query = query.Where("user_logs.created_at < ?", to)
+		} else {
+			query = query.Where("user_logs.created_at <= ?", to)
+		}
 	}
 
-	// Return response
-	return c.JSON(fiber.Map{
-		"status":     "success",
-		"message":    "Log retrieved successfully",
-		"data":       dataList,
-		"pagination": pagination,
-	})
+	return query, nil
 }
 
-// query data
-func GetUserLogByID(c *fiber.Ctx) error {
-	db := database.DB
-	UserUUID := c.Params("user_uuid")
+func parseLogDate(value string) (time.Time, bool, error) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, true, nil
+	}
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	return date, false, nil
+}
 
+// paginateUserLogs lists the filtered logs, newest first. Entries without a
+// user (kiosk calls, system errors) are kept.
+func paginateUserLogs(c *fiber.Ctx, query *gorm.DB) error {
 	// Parse query parameters for pagination
 	page, err := strconv.Atoi(c.Query("page", "1"))
 	if err != nil || page <= 0 {
@@ -86,26 +86,39 @@ func GetUserLogByID(c *fiber.Ctx) error {
 	}
 	offset := (page - 1) * limit
 
+	query = query.Model(&models.UserLogs{}).Joins("LEFT JOIN users ON user_logs.user_uuid=users.uuid")
+
 	// Parse search query
-	search := c.Query("search", "")
+	if search := c.Query("search", ""); search != "" {
+		query = query.Where("users.fullname ILIKE ? OR user_logs.name ILIKE ? OR users.title ILIKE ? OR user_logs.entity_id ILIKE ?",
+			"%"+search+"%", "%"+search+"%", "%"+search+"%", "%"+search+"%")
+	}
+
+	query, err = applyLogFilters(c, query)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
 
 	var dataList []models.UserLogs
 	var totalRecords int64
 
-	err = db.
-		Joins("JOIN users ON user_logs.user_uuid=users.uuid").
-		Where("user_logs.user_uuid = ?", UserUUID).
-		Where("users.fullname ILIKE ? OR user_logs.name ILIKE ? OR users.title ILIKE ?", "%"+search+"%", "%"+search+"%", "%"+search+"%").
+	// Count total records matching the filters
+	query.Session(&gorm.Session{}).Count(&totalRecords)
+
+	err = query.
 		Offset(offset).
 		Limit(limit).
-		Order("user_logs.updated_at DESC").
+		Order("user_logs.created_at DESC").
 		Preload("User").
 		Find(&dataList).Error
 
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"status":  "error",
-			"message": "Failed to fetch usersLogs",
+			"message": "Failed to fetch UsersLogs",
 			"error":   err.Error(),
 		})
 	}
@@ -124,12 +137,22 @@ func GetUserLogByID(c *fiber.Ctx) error {
 	// Return response
 	return c.JSON(fiber.Map{
 		"status":     "success",
-		"message":    "Countries retrieved successfully",
+		"message":    "Log retrieved successfully",
 		"data":       dataList,
 		"pagination": pagination,
 	})
 }
 
+// Paginate
+func GetPaginatedUserLogs(c *fiber.Ctx) error {
+	return paginateUserLogs(c, database.DB)
+}
+
+// query data
+func GetUserLogByID(c *fiber.Ctx) error {
+	return paginateUserLogs(c, database.DB.Where("user_logs.user_uuid = ?", c.Params("user_uuid")))
+}
+
 // Get All data
 func GetUserLogs(c *fiber.Ctx) error {
 
@@ -143,6 +166,97 @@ func GetUserLogs(c *fiber.Ctx) error {
 	})
 }
 
+// ExportUserLogs - Stream the filtered audit log as CSV or JSON Lines, oldest
+// first. Rows are read in batches so the export never holds the whole log.
+func ExportUserLogs(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format", "csv"))
+	if format != "csv" && format != "jsonl" {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": "format must be csv or jsonl",
+		})
+	}
+
+	query, err := applyLogFilters(c, database.DB.Model(&models.UserLogs{}))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+
+	// Exporting the audit trail is itself audited
+	utils.LogUserActivityWithDB(database.DB, c, "EXPORT", "Audit log export", "Exported the audit log as "+format, map[string]interface{}{
+		"format":  format,
+		"filters": string(c.Request().URI().QueryString()),
+	})
+
+	filename := fmt.Sprintf("audit-log-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		csvWriter := csv.NewWriter(w)
+		if format == "csv" {
+			csvWriter.Write(utils.AuditLogCSVHeader)
+		}
+
+		const batchSize = 1000
+		var lastCreatedAt time.Time
+		var lastUUID string
+
+		for {
+			// Keyset pagination keeps every batch as cheap as the first one
+			batchQuery := query.Session(&gorm.Session{})
+			if lastUUID != "" {
+				batchQuery = batchQuery.Where("(user_logs.created_at, user_logs.uuid) > (?, ?)", lastCreatedAt, lastUUID)
+			}
+
+			var batch []models.UserLogs
+			if err := batchQuery.Order("user_logs.created_at ASC, user_logs.uuid ASC").Limit(batchSize).Find(&batch).Error; err != nil {
+				// Headers are gone already, the truncated file is the only signal left
+				log.Printf("[error] audit log export interrupted: %v", err)
+				break
+			}
+
+			for i := range batch {
+				entry := &batch[i]
+				if format == "csv" {
+					csvWriter.Write(utils.AuditLogCSVRecord(entry))
+					continue
+				}
+				line, err := utils.AuditLogJSON(entry)
+				if err != nil {
+					continue
+				}
+				w.Write(line)
+				w.WriteByte('\n')
+			}
+
+			csvWriter.Flush()
+			if err := w.Flush(); err != nil {
+				// Client went away
+				return
+			}
+
+			if len(batch) < batchSize {
+				break
+			}
+			lastCreatedAt = batch[len(batch)-1].CreatedAt
+			lastUUID = batch[len(batch)-1].UUID
+		}
+
+		csvWriter.Flush()
+		w.Flush()
+	})
+
+	return nil
+}
+
 // Get one data
 func GetUserLog(c *fiber.Ctx) error {
 	uuid := c.Params("uuid")
@@ -167,99 +281,72 @@ func GetUserLog(c *fiber.Ctx) error {
 	)
 }
 
-// Create data
+// Create data - entries are appended to the audit chain for the caller
 func CreateUserLog(c *fiber.Ctx) error {
-	p := &models.UserLogs{}
-
-	if err := c.BodyParser(&p); err != nil {
-		return err
-	}
-
-	p.UUID = uuid.New().String()
-	database.DB.Create(p)
-
-	return c.JSON(
-		fiber.Map{
-			"status":  "success",
-			"message": "UserLog created success",
-			"data":    p,
-		},
-	)
-}
-
-// Update data
-func UpdateUserLog(c *fiber.Ctx) error {
-	uuid := c.Params("uuid")
-	db := database.DB
-
-	type UpdateData struct {
-		UUID string `json:"uuid"`
-
+	type CreateData struct {
 		Name        string `json:"name"`
 		Action      string `json:"action"`
 		Description string `json:"Description"`
-		UserUUID    string `json:"user_uuid"`
-		Signature   string `json:"Signature"`
 	}
 
-	var updateData UpdateData
+	var p CreateData
 
-	if err := c.BodyParser(&updateData); err != nil {
-		return c.Status(500).JSON(
+	if err := c.BodyParser(&p); err != nil {
+		return err
+	}
+
+	if p.Name == "" || p.Action == "" {
+		return c.Status(400).JSON(
 			fiber.Map{
 				"status":  "error",
-				"message": "Review your iunput",
+				"message": "Name and action are required",
 				"data":    nil,
 			},
 		)
 	}
 
-	user_logs := new(models.UserLogs)
-
-	db.Where("uuid = ?", uuid).First(&user_logs)
-	user_logs.Name = updateData.Name
-	user_logs.UserUUID = updateData.UserUUID
-	user_logs.Action = updateData.Action
-	user_logs.Description = updateData.Description
-	user_logs.Signature = updateData.Signature
-
-	db.Save(&user_logs)
+	if err := utils.LogUserActivityWithDB(database.DB, c, p.Action, p.Name, p.Description, nil); err != nil {
+		return c.Status(500).JSON(
+			fiber.Map{
+				"status":  "error",
+				"message": "Failed to append UserLog",
+				"error":   err.Error(),
+			},
+		)
+	}
 
 	return c.JSON(
 		fiber.Map{
 			"status":  "success",
-			"message": "user_logs  updated success",
-			"data":    user_logs,
+			"message": "UserLog created success",
+			"data":    nil,
 		},
 	)
-
 }
 
-// Delete data
-func DeleteUserLog(c *fiber.Ctx) error {
-	uuid := c.Params("uuid")
-
-	db := database.DB
-
-	var user_logs models.UserLogs
-	db.Where("uuid = ?", uuid).First(&user_logs)
-	if user_logs.Name == "" {
-		return c.Status(404).JSON(
+// VerifyUserLogs - Walk the audit chain and report the first broken link
+func VerifyUserLogs(c *fiber.Ctx) error {
+	report, err := utils.VerifyAuditChain(database.DB)
+	if err != nil {
+		return c.Status(500).JSON(
 			fiber.Map{
 				"status":  "error",
-				"message": "No user_logs  name found",
-				"data":    nil,
+				"message": "Failed to verify the audit log",
+				"error":   err.Error(),
 			},
 		)
 	}
 
-	db.Delete(&user_logs)
+	message := "Audit log is intact"
+	if !report.Valid {
+		message = "Audit log has been tampered with"
+	}
 
 	return c.JSON(
 		fiber.Map{
 			"status":  "success",
-			"message": "user_logs  deleted success",
-			"data":    nil,
+			"message": message,
+			"data":    report,
 		},
 	)
 }
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"log"
+
+	"github.com/Danny19977/certikiosk.git/utils"
+	"gorm.io/gorm"
+)
+
+// protectAuditLog chains entries written before the audit chain existed and
+// makes user_logs append-only at the database level. The trigger is a second
+// line of defence, tampering by someone who drops it is caught by the chain.
+func protectAuditLog(db *gorm.DB) {
+	chained, err := utils.ChainUnsignedAuditLogs(db)
+	if err != nil {
+		log.Printf("[error] failed to chain existing audit log entries: %v", err)
+	} else if chained > 0 {
+		log.Printf("[info] chained %d existing audit log entr(ies)", chained)
+	}
+
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION user_logs_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'user_logs is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS user_logs_append_only ON user_logs`,
+		`CREATE TRIGGER user_logs_append_only BEFORE UPDATE OR DELETE ON user_logs
+			FOR EACH ROW EXECUTE FUNCTION user_logs_append_only()`,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[warn] audit log append-only trigger not installed: %v", err)
+	}
+}
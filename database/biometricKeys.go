@@ -0,0 +1,87 @@
+package database
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"gorm.io/gorm"
+)
+
+// encryptPlaintextFingerprints seals templates stored before encryption at rest was introduced
+func encryptPlaintextFingerprints(db *gorm.DB) {
+	var plaintext []models.Fingerprint
+	if err := db.Where("key_id IS NULL OR key_id = ''").Find(&plaintext).Error; err != nil {
+		log.Printf("[error] failed to look up unencrypted fingerprints: %v", err)
+		return
+	}
+	if len(plaintext) == 0 {
+		return
+	}
+
+	keyring, err := utils.GetBiometricKeyring()
+	if err != nil {
+		log.Printf("[warn] %d fingerprint(s) are stored unencrypted: %v", len(plaintext), err)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range plaintext {
+			if err := keyring.SealFingerprint(&plaintext[i], plaintext[i].FingerprintData); err != nil {
+				return err
+			}
+			if err := tx.Save(&plaintext[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[error] failed to encrypt stored fingerprints: %v", err)
+		return
+	}
+
+	log.Printf("[info] encrypted %d stored fingerprint(s)", len(plaintext))
+}
+
+// RotateBiometricMasterKey re-wraps every fingerprint data key with the current
+// master key. Run it after moving the old key to BIOMETRIC_PREVIOUS_MASTER_KEYS
+// (or _FILES); once it succeeds the previous key can be removed.
+func RotateBiometricMasterKey() (int, error) {
+	keyring, err := utils.GetBiometricKeyring()
+	if err != nil {
+		return 0, err
+	}
+
+	var fingerprints []models.Fingerprint
+	if err := DB.Where("key_id != ?", keyring.CurrentKeyID).Find(&fingerprints).Error; err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		for i := range fingerprints {
+			changed, err := keyring.RewrapFingerprint(&fingerprints[i])
+			if err != nil {
+				return fmt.Errorf("fingerprint %s: %v", fingerprints[i].UUID, err)
+			}
+			if !changed {
+				continue
+			}
+			if err := tx.Model(&fingerprints[i]).Updates(map[string]interface{}{
+				"wrapped_data_key": fingerprints[i].WrappedDataKey,
+				"key_id":           fingerprints[i].KeyID,
+			}).Error; err != nil {
+				return err
+			}
+			rotated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return rotated, nil
+}
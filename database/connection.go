@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -49,6 +51,214 @@ func Connect() {
 		&models.Citizens{},
 		&models.Fingerprint{},
 		&models.Documents{},
+		&models.DocumentVersion{},
+		&models.DocumentType{},
 		&models.Certification{},
+		&models.Role{},
+		&models.KioskDevice{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.TwoFactorRecoveryCode{},
+		&models.LoginThrottle{},
+		&models.PasswordHistory{},
+		&models.AuditForwardCursor{},
 	)
+
+	seedDefaultRoles(connection)
+
+	dropPlaintextResetTokens(connection)
+	migratePasswordColumns(connection)
+	protectAuditLog(connection)
+	migrateDocumentVersions(connection)
+	migrateDocumentTypes(connection)
+
+	migrateLegacyFingerprints(connection)
+	encryptPlaintextFingerprints(connection)
+}
+
+// dropPlaintextResetTokens removes reset tokens created before they were
+// hashed: they cannot be checked anymore and must not stay readable.
+func dropPlaintextResetTokens(db *gorm.DB) {
+	if !db.Migrator().HasColumn(&models.PasswordReset{}, "token") {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("token_hash IS NULL OR token_hash = ''").Delete(&models.PasswordReset{}).Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&models.PasswordReset{}, "token")
+	})
+	if err != nil {
+		log.Printf("[error] failed to drop plaintext password reset tokens: %v", err)
+		return
+	}
+
+	log.Printf("[info] dropped plaintext password reset tokens")
+}
+
+// migratePasswordColumns drops the confirmation column that used to be stored
+// with every user and starts the password max age of existing accounts now.
+func migratePasswordColumns(db *gorm.DB) {
+	if db.Migrator().HasColumn(&models.User{}, "conform_password") {
+		if err := db.Migrator().DropColumn(&models.User{}, "conform_password"); err != nil {
+			log.Printf("[error] failed to drop users.conform_password: %v", err)
+		}
+	}
+
+	if err := db.Model(&models.User{}).Where("password_changed_at IS NULL").Update("password_changed_at", time.Now()).Error; err != nil {
+		log.Printf("[error] failed to initialize password_changed_at: %v", err)
+	}
+}
+
+// migrateDocumentVersions records the file of documents created before
+// versioning as their first version.
+func migrateDocumentVersions(db *gorm.DB) {
+	var documents []models.Documents
+	if err := db.Where("current_version_uuid IS NULL OR current_version_uuid = ''").Find(&documents).Error; err != nil {
+		log.Printf("[error] failed to read unversioned documents: %v", err)
+		return
+	}
+	if len(documents) == 0 {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i := range documents {
+			version := utils.NewDocumentVersion(&documents[i], documents[i].UserUUID, "")
+			if err := utils.AddDocumentVersion(tx, &documents[i], &version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[error] failed to create first document versions: %v", err)
+		return
+	}
+
+	log.Printf("[info] created the first version of %d existing document(s)", len(documents))
+}
+
+// migrateDocumentTypes registers the free text types of existing documents in
+// the document type catalogue and points the documents at the new codes.
+// Registered types keep the previous behaviour: fingerprint required, any format.
+func migrateDocumentTypes(db *gorm.DB) {
+	var legacy []string
+	err := db.Model(&models.Documents{}).
+		Where("document_type IS NULL OR document_type NOT IN (?)", db.Model(&models.DocumentType{}).Select("code")).
+		Distinct().
+		Pluck("COALESCE(document_type, '')", &legacy).Error
+	if err != nil {
+		log.Printf("[error] failed to read unregistered document types: %v", err)
+		return
+	}
+	if len(legacy) == 0 {
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, name := range legacy {
+			code := utils.DocumentTypeCode(name)
+			if name == "" {
+				name = "Document"
+			}
+
+			var count int64
+			tx.Model(&models.DocumentType{}).Where("code = ?", code).Count(&count)
+			if count == 0 {
+				documentType := models.DocumentType{
+					UUID:                uuid.New().String(),
+					Code:                code,
+					Names:               models.LocalizedText{models.DefaultDocumentLanguage: name},
+					RequiresFingerprint: true,
+					IsActive:            true,
+					CreatedAt:           time.Now(),
+					UpdatedAt:           time.Now(),
+				}
+				if err := tx.Create(&documentType).Error; err != nil {
+					return err
+				}
+			}
+
+			query := tx.Model(&models.Documents{}).Where("document_type = ?", name)
+			if name == "Document" {
+				query = tx.Model(&models.Documents{}).Where("document_type IS NULL OR document_type IN ('', 'Document')")
+			}
+			if err := query.Update("document_type", code).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[error] failed to register existing document types: %v", err)
+		return
+	}
+
+	log.Printf("[info] registered %d existing document type(s) in the catalogue", len(legacy))
+}
+
+// migrateLegacyFingerprints moves templates from the old citizens.fingerprint
+// column into the fingerprints table and drops the column once copied.
+func migrateLegacyFingerprints(db *gorm.DB) {
+	if !db.Migrator().HasColumn(&models.Citizens{}, "fingerprint") {
+		return
+	}
+
+	// Templates are stored encrypted, wait until a master key is configured
+	if _, err := utils.GetBiometricKeyring(); err != nil {
+		log.Printf("[warn] legacy fingerprints not migrated: %v", err)
+		return
+	}
+
+	type legacyFingerprint struct {
+		UUID        string
+		Fingerprint string
+	}
+
+	var legacy []legacyFingerprint
+	if err := db.Table("citizens").Select("uuid, fingerprint").Where("fingerprint IS NOT NULL AND fingerprint != ''").Scan(&legacy).Error; err != nil {
+		log.Printf("[error] failed to read legacy fingerprints: %v", err)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range legacy {
+			enrollment, err := utils.NewFingerprintEnrollment(row.UUID, row.Fingerprint, 0, 0, "legacy")
+			if err != nil {
+				// Keep unreadable templates so they are not lost, they will simply never match
+				log.Printf("[warn] legacy fingerprint of citizen %s is not a valid template: %v", row.UUID, err)
+				enrollment = models.Fingerprint{
+					UUID:         uuid.New().String(),
+					CitizensUUID: row.UUID,
+					DeviceID:     "legacy",
+					CreatedAt:    time.Now(),
+					UpdatedAt:    time.Now(),
+				}
+				if err := utils.SealFingerprint(&enrollment, row.Fingerprint); err != nil {
+					return err
+				}
+			}
+
+			// Skip fingers that already have an enrollment in the new table
+			var count int64
+			tx.Model(&models.Fingerprint{}).Where("citizens_uuid = ? AND finger_position = ?", row.UUID, enrollment.FingerPosition).Count(&count)
+			if count > 0 {
+				continue
+			}
+
+			if err := tx.Create(&enrollment).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Migrator().DropColumn(&models.Citizens{}, "fingerprint")
+	})
+	if err != nil {
+		log.Printf("[error] failed to migrate legacy fingerprints: %v", err)
+		return
+	}
+
+	log.Printf("[info] migrated %d legacy fingerprint(s) to the fingerprints table", len(legacy))
 }
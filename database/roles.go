@@ -0,0 +1,38 @@
+package database
+
+import (
+	"log"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"gorm.io/gorm"
+)
+
+// seedDefaultRoles creates the built-in roles that are missing
+func seedDefaultRoles(db *gorm.DB) {
+	for _, role := range models.DefaultRoles {
+		var count int64
+		db.Model(&models.Role{}).Where("LOWER(name) = LOWER(?)", role.Name).Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		role.UUID = utils.GenerateUUID()
+		role.IsSystem = true
+		role.CreatedAt = time.Now()
+		role.UpdatedAt = time.Now()
+		if err := db.Create(&role).Error; err != nil {
+			log.Printf("[error] failed to create default role %s: %v", role.Name, err)
+		}
+	}
+
+	// Users whose role does not exist get no permission at all
+	var orphans int64
+	db.Model(&models.User{}).
+		Where("LOWER(role) NOT IN (?)", db.Model(&models.Role{}).Select("LOWER(name)")).
+		Count(&orphans)
+	if orphans > 0 {
+		log.Printf("[warn] %d user(s) have a role that does not exist and will be denied on protected routes", orphans)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
 
@@ -11,6 +15,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
 func getPort() string {
@@ -24,11 +30,113 @@ func getPort() string {
 	return port
 }
 
+// newTLSListener listens with TLS. When a client CA is given, clients may present
+// a certificate signed by it; the certificate is optional so browsers still work.
+func newTLSListener(addr, certFile, keyFile, clientCAFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		caPEM, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		log.Printf("[info] kiosk client certificates accepted from %s", clientCAFile)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// runCommand executes an administrative command given on the command line
+func runCommand(name string) {
+	switch name {
+	case "rotate-biometric-key":
+		database.Connect()
+		rotated, err := database.RotateBiometricMasterKey()
+		if err != nil {
+			log.Fatalf("[error] failed to rotate biometric master key: %v", err)
+		}
+		log.Printf("[info] re-wrapped %d fingerprint data key(s) with the current master key", rotated)
+	case "verify-audit-log":
+		database.Connect()
+		report, err := utils.VerifyAuditChain(database.DB)
+		if err != nil {
+			log.Fatalf("[error] failed to verify audit log: %v", err)
+		}
+		if !report.Valid {
+			log.Fatalf("[error] audit log broken at sequence %d (%s): %s, %d entr(ies) verified before it",
+				report.BrokenAt.Sequence, report.BrokenAt.UUID, report.BrokenAt.Reason, report.Checked)
+		}
+		log.Printf("[info] audit log intact: %d entr(ies) verified, last sequence %d, %d unchained", report.Checked, report.LastSeq, report.Unchained)
+	default:
+		log.Fatalf("[error] unknown command %q (available: rotate-biometric-key, verify-audit-log)", name)
+	}
+}
+
 func main() {
 
+	// Administrative commands, e.g. `certikiosk rotate-biometric-key`
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
+
 	database.Connect()
 
-	app := fiber.New()
+	if _, err := utils.GetBiometricKeyring(); err != nil {
+		log.Printf("[warn] fingerprint enrollment is disabled: %v", err)
+	}
+
+	if !utils.AuditLogKeyConfigured() {
+		log.Printf("[warn] AUDIT_LOG_KEY is not set, the audit log is signed with a key derived from SECRET_KEY")
+	}
+
+	if forwarder, err := utils.StartAuditForwarder(database.DB); err != nil {
+		log.Printf("[error] audit log forwarding is disabled: %v", err)
+	} else if forwarder != nil {
+		log.Printf("[info] forwarding the audit log to %s", forwarder.Name())
+	}
+
+	if utils.StartDocumentExpiryJob(database.DB) {
+		log.Printf("[info] document expiry job started")
+	}
+
+	// Load the document signing certificate early so misconfiguration shows at startup
+	if signer, err := utils.GetPDFSigner(); err != nil {
+		log.Printf("[error] failed to load document signing key: %v", err)
+	} else if signer == nil {
+		log.Printf("[warn] no document signing key configured, certified PDFs will not be digitally signed")
+	} else {
+		log.Printf("[info] document signing certificate: %s", signer.Certificate.Subject.CommonName)
+	}
+
+	// Leave room for the multipart envelope around the largest accepted document
+	app := fiber.New(fiber.Config{
+		BodyLimit: int(utils.GetDocumentMaxUploadSize()) + 1<<20,
+	})
+
+	// A panicking handler answers 500 instead of bringing the server down
+	app.Use(recover.New())
+
+	// Every request gets an X-Request-ID, stored with its audit log entries
+	app.Use(requestid.New())
 
 	// Initialize default config
 	app.Use(logger.New())
@@ -43,7 +151,7 @@ func main() {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     allowedOrigins,
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Requested-With",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Requested-With, X-Device-Key, X-Kiosk-Session, Range, If-None-Match, If-Range",
 		AllowCredentials: true,
 		AllowMethods: strings.Join([]string{
 			fiber.MethodGet,
@@ -54,7 +162,7 @@ func main() {
 			fiber.MethodPatch,
 			fiber.MethodOptions,
 		}, ","),
-		ExposeHeaders: "Content-Length, Content-Type",
+		ExposeHeaders: "Content-Length, Content-Type, Content-Disposition, Content-Range, Accept-Ranges, ETag, X-Request-ID",
 		MaxAge:        86400, // 24 hours in seconds
 		AllowOriginsFunc: func(origin string) bool {
 			// Fallback: Allow any origin that matches our allowed origins
@@ -79,6 +187,15 @@ func main() {
 	// routes.Setup(app)
 	routes.Setup(app)
 
+	// Serve TLS directly when configured, kiosks may then authenticate with client certificates
+	if certFile, keyFile := utils.Env("TLS_CERT_FILE"), utils.Env("TLS_KEY_FILE"); certFile != "" && keyFile != "" {
+		ln, err := newTLSListener(getPort(), certFile, keyFile, utils.Env("KIOSK_CLIENT_CA_FILE"))
+		if err != nil {
+			log.Fatalf("[error] failed to start TLS listener: %v", err)
+		}
+		log.Fatal(app.Listener(ln))
+	}
+
 	log.Fatal(app.Listen(getPort()))
 
 }
@@ -3,6 +3,8 @@ package middlewares
 import (
 	"strings"
 
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/Danny19977/certikiosk.git/utils"
 	"github.com/gofiber/fiber/v2"
 )
@@ -29,12 +31,92 @@ func IsAuthenticated(c *fiber.Ctx) error {
 
 	token := tokenParts[1]
 
-	if _, err := utils.VerifyJwt(token); err != nil {
+	claims, err := utils.ParseJwt(token)
+	if err != nil || claims.Issuer == "" {
 		c.Status(fiber.StatusUnauthorized)
 		return c.JSON(fiber.Map{
 			"message": "invalid or expired token",
 		})
 	}
-	c.Next()
-	return nil
+
+	// Load the user on every request so deleted or disabled accounts lose access immediately
+	user := models.User{}
+	if err := database.DB.Where("uuid = ?", claims.Issuer).First(&user).Error; err != nil {
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": "user no longer exists",
+		})
+	}
+
+	if !user.Status {
+		c.Status(fiber.StatusForbidden)
+		return c.JSON(fiber.Map{
+			"message": "user account is disabled",
+		})
+	}
+
+	// Tokens issued before a "log out everywhere" or a logout of this session
+	if claims.TokenVersion != user.TokenVersion || utils.IsAccessTokenRevoked(database.DB, claims.Id) {
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": "token has been revoked",
+		})
+	}
+
+	// An expired password only leaves access to what is needed to change it
+	if utils.PasswordExpired(&user) && !allowedWithExpiredPassword(c.Path()) {
+		c.Status(fiber.StatusForbidden)
+		return c.JSON(fiber.Map{
+			"message":          "password has expired, change it to continue",
+			"password_expired": true,
+		})
+	}
+
+	c.Locals("user", &user)
+	c.Locals("token_claims", claims)
+
+	return c.Next()
+}
+
+func allowedWithExpiredPassword(path string) bool {
+	for _, allowed := range []string{"/auth/user", "/auth/change-password", "/auth/logout", "/auth/logout-all"} {
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rejects the request unless the authenticated user is granted
+// every listed permission. It must run after IsAuthenticated.
+func RequirePermission(permissions ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user := utils.CurrentUser(c)
+		if user == nil {
+			c.Status(fiber.StatusUnauthorized)
+			return c.JSON(fiber.Map{
+				"message": "authentication required",
+			})
+		}
+
+		granted := utils.ResolveUserPermissions(database.DB, user)
+		for _, permission := range permissions {
+			if !models.PermissionGranted(granted, permission) {
+				utils.LogErrorWithDB(database.DB, c, "access_denied", "Missing permission "+permission, map[string]interface{}{
+					"user_uuid":  user.UUID,
+					"role":       user.Role,
+					"permission": permission,
+					"path":       c.Path(),
+				})
+
+				c.Status(fiber.StatusForbidden)
+				return c.JSON(fiber.Map{
+					"message":    "you do not have permission to perform this action",
+					"permission": permission,
+				})
+			}
+		}
+
+		return c.Next()
+	}
 }
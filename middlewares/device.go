@@ -0,0 +1,63 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/database"
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/Danny19977/certikiosk.git/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// deviceSeenInterval limits last-seen updates to one write per device per minute
+const deviceSeenInterval = time.Minute
+
+// IsKioskDevice requires a registered, active kiosk. The device presents either
+// its API key in the X-Device-Key header or a TLS client certificate whose
+// fingerprint is registered on the device.
+func IsKioskDevice(c *fiber.Ctx) error {
+	var device models.KioskDevice
+	found := false
+
+	if key := c.Get("X-Device-Key"); key != "" {
+		found = database.DB.Where("api_key_hash = ?", utils.HashDeviceKey(key)).First(&device).Error == nil
+	} else if state := c.Context().TLSConnectionState(); state != nil && len(state.PeerCertificates) > 0 {
+		fingerprint := utils.CertificateFingerprint(state.PeerCertificates[0])
+		found = database.DB.Where("client_cert_fingerprint = ?", fingerprint).First(&device).Error == nil
+	}
+
+	if !found {
+		if utils.ShouldLogDeviceFailure(database.DB, c.IP()) {
+			utils.LogErrorWithDB(database.DB, c, "device_unauthorized", "Unknown kiosk device", map[string]interface{}{
+				"ip_address": c.IP(),
+				"path":       c.Path(),
+			})
+		}
+
+		c.Status(fiber.StatusUnauthorized)
+		return c.JSON(fiber.Map{
+			"message": "a registered kiosk device is required",
+		})
+	}
+
+	if !device.Status {
+		c.Status(fiber.StatusForbidden)
+		return c.JSON(fiber.Map{
+			"message": "kiosk device is disabled",
+		})
+	}
+
+	if device.LastSeenAt == nil || time.Since(*device.LastSeenAt) > deviceSeenInterval || device.LastSeenIP != c.IP() {
+		now := time.Now()
+		device.LastSeenAt = &now
+		device.LastSeenIP = c.IP()
+		database.DB.Model(&device).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"last_seen_ip": device.LastSeenIP,
+		})
+	}
+
+	c.Locals("device", &device)
+
+	return c.Next()
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// AuditForwardCursor remembers the last audit log sequence shipped to an
+// external collector, so forwarding resumes where it stopped after an outage
+// or a restart.
+type AuditForwardCursor struct {
+	Name string `gorm:"primaryKey;type:varchar(100);not null" json:"name"` // Collector URL without credentials
+
+	Sequence int64 `gorm:"not null;default:0" json:"sequence"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
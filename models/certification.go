@@ -3,13 +3,20 @@ package models
 import "time"
 
 type Certification struct {
-	UUID              string `gorm:"primaryKey;not null;unique" json:"uuid"`
-	CitizensUUID      string `json:"citizens_uuid"`
-	DocumentUUID      string `json:"document_uuid"`
-	Aprovel           bool   `json:"aprovel"`
-	CertifiedDocument string `json:"certified_document"`
-	StampDetails      string `json:"stamp_details"`
-	OutputFormat      string `json:"output_format"`
+	UUID                  string `gorm:"primaryKey;not null;unique" json:"uuid"`
+	CitizensUUID          string `json:"citizens_uuid"`
+	DocumentUUID          string `json:"document_uuid"`
+	DocumentVersionUUID   string `json:"document_version_uuid"` // Exact version that was certified
+	SourceDocumentHash    string `json:"source_document_hash"`  // SHA-256 of the certified source file
+	Aprovel               bool   `json:"aprovel"`
+	CertifiedDocument     string `json:"certified_document"`      // Storage key of the stamped PDF
+	CertifiedStorage      string `json:"certified_storage"`       // Backend holding the stamped PDF: local, s3 or gdrive
+	CertifiedDocumentHash string `json:"certified_document_hash"` // SHA-256 of the stamped PDF
+	CertifiedBy           string `json:"certified_by"`            // UUID of the certifying user
+	SignatureFingerprint  string `json:"signature_fingerprint"`   // SHA-256 of the signing certificate, empty when unsigned
+	StampDetails          string `json:"stamp_details"`
+	StampPage             int    `json:"stamp_page"` // 0 means every page was stamped
+	OutputFormat          string `json:"output_format"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
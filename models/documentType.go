@@ -0,0 +1,99 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DocumentType is an entry of the document type catalogue. Documents
+// reference it by code in Documents.DocumentType.
+type DocumentType struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	Code                string        `gorm:"uniqueIndex;not null" json:"code"` // e.g. "birth_certificate"
+	Names               LocalizedText `gorm:"type:jsonb" json:"names"`          // Name per language, e.g. {"fr": "Acte de naissance", "en": "Birth certificate"}
+	IssuingAuthority    string        `json:"issuing_authority"`
+	ValidityDays        int           `json:"validity_days"` // 0 when documents of this type do not expire
+	RequiresFingerprint bool          `json:"requires_fingerprint"`
+	AllowedFormats      string        `json:"allowed_formats"`                 // Comma separated among pdf, png, jpg. Empty allows all
+	StampTemplate       string        `gorm:"type:text" json:"stamp_template"` // Extra stamp lines, see utils.RenderStampTemplate
+	IsActive            bool          `json:"is_active"`                       // Inactive types cannot be used for new documents or certified
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DocumentFormats lists the file formats a document type can allow
+var DocumentFormats = []string{"pdf", "png", "jpg"}
+
+// DefaultDocumentLanguage is used when a name is missing in the requested language
+const DefaultDocumentLanguage = "fr"
+
+// Name returns the name of the type in a language, falling back to the
+// default language, then to any name, then to the code
+func (t *DocumentType) Name(lang string) string {
+	if name := t.Names[strings.ToLower(lang)]; name != "" {
+		return name
+	}
+	if name := t.Names[DefaultDocumentLanguage]; name != "" {
+		return name
+	}
+	for _, name := range t.Names {
+		if name != "" {
+			return name
+		}
+	}
+	return t.Code
+}
+
+// FormatList splits the comma separated allowed formats
+func (t *DocumentType) FormatList() []string {
+	return SplitPermissions(t.AllowedFormats)
+}
+
+// AllowsFormat reports whether files with the extension (pdf, png, jpg) are accepted
+func (t *DocumentType) AllowsFormat(extension string) bool {
+	formats := t.FormatList()
+	if len(formats) == 0 {
+		return true
+	}
+	if extension == "jpeg" {
+		extension = "jpg"
+	}
+	for _, format := range formats {
+		if format == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalizedText maps a language code to a text, stored as a JSON object
+type LocalizedText map[string]string
+
+func (t LocalizedText) Value() (driver.Value, error) {
+	if t == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(t)
+	return string(data), err
+}
+
+func (t *LocalizedText) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*t = LocalizedText{}
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into LocalizedText", value)
+	}
+	return json.Unmarshal(data, t)
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// DocumentVersion is one issued file of a document. Versions are never
+// changed: a re-issued document gets a new version and the document points
+// to it, certifications keep pointing to the version they certified.
+type DocumentVersion struct {
+	UUID         string `gorm:"primaryKey;not null;unique" json:"uuid"`
+	DocumentUUID string `gorm:"not null;uniqueIndex:idx_document_version" json:"document_uuid"`
+	Version      int    `gorm:"not null;uniqueIndex:idx_document_version" json:"version"`
+
+	DocumentDataUrl string `json:"document_data_url"`
+	StorageBackend  string `json:"storage_backend"`
+	StorageKey      string `json:"storage_key"`
+	ContentType     string `json:"content_type"`
+	FileSize        int64  `json:"file_size"`
+	FileHash        string `json:"file_hash"` // SHA-256 of the file, empty for URL documents
+
+	IssueDate time.Time `json:"issue_date"`
+	IssuedBy  string    `json:"issued_by"` // UUID of the user who registered the version
+	Reason    string    `json:"reason"`    // Why the document was re-issued
+
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -8,10 +8,23 @@ type Documents struct {
 	NationalID      int64     `json:"national_id"`
 	DocumentType    string    `json:"document_type"`
 	DocumentDataUrl string    `json:"document_data_url"`
+	StorageBackend  string    `json:"storage_backend"` // local, s3 or gdrive, the configured backend when empty
+	StorageKey      string    `json:"storage_key"`     // Key of the file in the storage backend, empty for URL documents
+	ContentType     string    `json:"content_type"`
+	FileSize        int64     `json:"file_size"`
+	FileHash        string    `json:"file_hash"` // SHA-256 of the stored file
 	UserUUID        string    `json:"user_uuid"`
 	IssueDate       time.Time `json:"issue_date"`
 	IsActive        bool      `json:"is_active"`
 
+	// Set explicitly, otherwise the expiry follows the validity of the document type
+	ExpiryDate *time.Time `json:"expiry_date"`
+	ExpiredAt  *time.Time `json:"expired_at"` // When the expiry job deactivated the document
+
+	// The file fields above mirror the current version
+	CurrentVersionUUID string `json:"current_version_uuid"`
+	CurrentVersion     int    `json:"current_version"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
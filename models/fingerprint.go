@@ -5,8 +5,14 @@ import "time"
 type Fingerprint struct {
 	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
 
-	CitizensUUID string    `json:"citizens_uuid"`
-	FingerprintData string    `json:"fingerprint_data"`
+	CitizensUUID    string    `gorm:"not null;uniqueIndex:idx_fingerprint_citizen_finger" json:"citizens_uuid"`
+	FingerPosition  int       `gorm:"not null;default:0;uniqueIndex:idx_fingerprint_citizen_finger" json:"finger_position"` // ISO/IEC 19794-2 finger code 1-10, 0 = unknown (legacy templates)
+	TemplateFormat  string    `json:"template_format"`                                                                      // "iso-19794-2" or "ansi-378"
+	Quality         int       `json:"quality"`                                                                              // Capture quality 0-100
+	DeviceID        string    `json:"device_id"`                                                                            // Scanner that captured the template
+	FingerprintData string    `gorm:"type:text;not null" json:"-"`                                                          // AES-GCM sealed template, never serialized
+	WrappedDataKey  string    `gorm:"type:text" json:"-"`                                                                   // Data key wrapped with the master key
+	KeyID           string    `gorm:"index" json:"key_id"`                                                                  // Master key the data key is wrapped with
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
 }
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// KioskDevice is a registered kiosk allowed to call the /api/public endpoints.
+// A device authenticates with its API key (X-Device-Key header) or with a TLS
+// client certificate whose SHA-256 fingerprint is registered here.
+type KioskDevice struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	DeviceID              string     `gorm:"uniqueIndex;not null" json:"device_id"` // Label printed on the kiosk, e.g. "KIN-GOMBE-01"
+	Name                  string     `json:"name"`
+	Location              string     `json:"location"`
+	Status                bool       `json:"status"` // Disabled devices are rejected
+	APIKeyHash            string     `gorm:"index" json:"-"`
+	APIKeyPrefix          string     `json:"api_key_prefix"` // First characters of the key, to recognize it
+	ClientCertFingerprint string     `gorm:"index" json:"client_cert_fingerprint"`
+	LastSeenAt            *time.Time `json:"last_seen_at"`
+	LastSeenIP            string     `json:"last_seen_ip"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
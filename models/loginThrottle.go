@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// LoginThrottle counts recent failed logins for one key, either an account
+// ("user:<uuid>") or a client address ("ip:<address>"). Requests from unknown
+// kiosk devices are counted per address too ("device:<address>").
+type LoginThrottle struct {
+	Key string `gorm:"primaryKey;type:varchar(255);not null" json:"key"`
+
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	BlockedUntil  *time.Time `json:"blocked_until"` // Exponential backoff, or the lockout end
+	LockedAt      *time.Time `json:"locked_at"`     // Set once the failure limit is reached
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
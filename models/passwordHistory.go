@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// PasswordHistory keeps the bcrypt hashes of previous passwords so they
+// cannot be reused, see PASSWORD_HISTORY_COUNT
+type PasswordHistory struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	UserUUID     string `gorm:"type:varchar(255);not null;index" json:"user_uuid"`
+	PasswordHash string `gorm:"not null" json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -2,12 +2,17 @@ package models
 
 import "time"
 
+// PasswordReset is a single-use reset token. Only the SHA-256 of the token is
+// stored, the token itself only travels in the emailed link.
 type PasswordReset struct {
-	UUID           string    `gorm:"primaryKey" json:"uuid"`
-	Email          string    `json:"email" validate:"required,email"`
-	Token          string    `json:"-"`
-	ExpirationTime time.Time `json:"-"`
-	CreatedAt      time.Time `json:"-"`
+	UUID           string     `gorm:"primaryKey" json:"uuid"`
+	UserUUID       string     `gorm:"type:varchar(255);index" json:"user_uuid"`
+	Email          string     `json:"email" validate:"required,email"`
+	TokenHash      string     `gorm:"index" json:"-"`
+	ExpirationTime time.Time  `json:"-"`
+	UsedAt         *time.Time `json:"-"` // Set when the token is used or superseded by a newer request
+	RequestIP      string     `json:"-"`
+	CreatedAt      time.Time  `json:"-"`
 }
 
 type Reset struct {
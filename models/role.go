@@ -0,0 +1,128 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Role groups permissions that are granted to every user holding it.
+// Users reference a role by name in User.Role.
+type Role struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	Name        string `gorm:"uniqueIndex;not null" json:"name"`
+	Description string `json:"description"`
+	Permissions string `gorm:"type:text" json:"permissions"` // Comma separated, e.g. "users:read,certification:*"
+	IsSystem    bool   `json:"is_system"`                    // Built-in roles cannot be deleted
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Permissions checked by the protected route groups
+const (
+	PermissionUsersRead           = "users:read"
+	PermissionUsersWrite          = "users:write"
+	PermissionUsersDelete         = "users:delete"
+	PermissionRolesManage         = "roles:manage"
+	PermissionDevicesManage       = "devices:manage"
+	PermissionLogsRead            = "logs:read"
+	PermissionLogsWrite           = "logs:write"
+	PermissionNotificationsRead   = "notifications:read"
+	PermissionNotificationsWrite  = "notifications:write"
+	PermissionNotificationsDelete = "notifications:delete"
+	PermissionCitizensRead        = "citizens:read"
+	PermissionCitizensWrite       = "citizens:write"
+	PermissionCitizensDelete      = "citizens:delete"
+	PermissionFingerprintRead     = "fingerprint:read"
+	PermissionFingerprintWrite    = "fingerprint:write"
+	PermissionFingerprintDelete   = "fingerprint:delete"
+	PermissionDocumentsRead       = "documents:read"
+	PermissionDocumentsWrite      = "documents:write"
+	PermissionDocumentsDelete     = "documents:delete"
+	PermissionDocumentsSend       = "documents:send"
+	PermissionDocumentTypesManage = "document_types:manage"
+	PermissionCertificationRead   = "certification:read"
+	PermissionCertificationCreate = "certification:create"
+	PermissionCertificationRevoke = "certification:revoke"
+	PermissionCertificationDelete = "certification:delete"
+)
+
+// AllPermissions lists every permission known to the API
+var AllPermissions = []string{
+	PermissionUsersRead, PermissionUsersWrite, PermissionUsersDelete,
+	PermissionRolesManage,
+	PermissionDevicesManage,
+	PermissionLogsRead, PermissionLogsWrite,
+	PermissionNotificationsRead, PermissionNotificationsWrite, PermissionNotificationsDelete,
+	PermissionCitizensRead, PermissionCitizensWrite, PermissionCitizensDelete,
+	PermissionFingerprintRead, PermissionFingerprintWrite, PermissionFingerprintDelete,
+	PermissionDocumentsRead, PermissionDocumentsWrite, PermissionDocumentsDelete, PermissionDocumentsSend,
+	PermissionDocumentTypesManage,
+	PermissionCertificationRead, PermissionCertificationCreate, PermissionCertificationRevoke, PermissionCertificationDelete,
+}
+
+// DefaultRoles are created at startup when missing
+var DefaultRoles = []Role{
+	{
+		Name:        "admin",
+		Description: "Full access including user and role management",
+		Permissions: "*",
+	},
+	{
+		Name:        "supervisor",
+		Description: "Manages citizens, documents and certifications, reads users and logs",
+		Permissions: "users:read,logs:read,notifications:*,citizens:*,fingerprint:*,documents:*,certification:*",
+	},
+	{
+		Name:        "clerk",
+		Description: "Registers citizens and certifies documents at the counter",
+		Permissions: "notifications:read,citizens:read,citizens:write,fingerprint:read,fingerprint:write,documents:read,documents:send,certification:read,certification:create",
+	},
+	{
+		Name:        "auditor",
+		Description: "Read-only access to records and activity logs",
+		Permissions: "users:read,logs:read,notifications:read,citizens:read,documents:read,certification:read",
+	},
+}
+
+// PermissionList splits the comma separated permissions
+func (r *Role) PermissionList() []string {
+	return SplitPermissions(r.Permissions)
+}
+
+// SplitPermissions parses a comma separated permission string
+func SplitPermissions(permissions string) []string {
+	var list []string
+	for _, permission := range strings.Split(permissions, ",") {
+		if permission = strings.TrimSpace(permission); permission != "" {
+			list = append(list, permission)
+		}
+	}
+	return list
+}
+
+// PermissionGranted reports whether the granted list covers the required permission.
+// "*" grants everything and "resource:*" grants every action on a resource.
+func PermissionGranted(granted []string, required string) bool {
+	resource := strings.SplitN(required, ":", 2)[0]
+	for _, permission := range granted {
+		if permission == "*" || permission == required || permission == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPermission reports whether a permission (or wildcard) is known
+func ValidPermission(permission string) bool {
+	if permission == "*" {
+		return true
+	}
+	for _, known := range AllPermissions {
+		if known == permission || strings.SplitN(known, ":", 2)[0]+":*" == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// RefreshToken is a long-lived, single-use token exchanged for a new access token.
+// Every refresh rotates it; tokens issued from the same login share a FamilyID so
+// the whole chain can be revoked when a used token is presented again.
+type RefreshToken struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	UserUUID   string     `gorm:"index;not null" json:"user_uuid"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the token, the token itself is never stored
+	FamilyID   string     `gorm:"index;not null" json:"family_id"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	ReplacedBy string     `json:"replaced_by"` // UUID of the token issued when this one was used
+	IPAddress  string     `json:"ip_address"`
+	UserAgent  string     `json:"user_agent"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevokedToken lists access tokens (by JWT ID) revoked before their expiry, e.g. on logout
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;not null;unique" json:"jti"`
+	UserUUID  string    `gorm:"index" json:"user_uuid"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// TwoFactorRecoveryCode is a single-use code that replaces a TOTP code when
+// the authenticator is lost. Only the SHA-256 of the code is stored.
+type TwoFactorRecoveryCode struct {
+	UUID string `gorm:"primaryKey;not null;unique" json:"uuid"`
+
+	UserUUID string     `gorm:"type:varchar(255);not null;index" json:"user_uuid"`
+	CodeHash string     `gorm:"not null;index" json:"-"`
+	UsedAt   *time.Time `json:"used_at"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -17,10 +17,17 @@ type User struct {
 	Phone           string `json:"phone"`
 	Title           string `json:"title"`
 	Password        string `json:"password"`
-	ConformPassword string `json:"confirm_password"`
+	ConformPassword string `gorm:"-" json:"confirm_password"` // Input only, never stored
 	Role            string `json:"role"`
 	Permission      string `json:"permission"`
 	Status          bool   `json:"status"`
+	TokenVersion    int    `gorm:"not null;default:0" json:"-"` // Bumped to invalidate every issued token
+
+	PasswordChangedAt *time.Time `json:"password_changed_at"` // Drives the password max age
+
+	TwoFactorEnabled  bool   `gorm:"not null;default:false" json:"two_factor_enabled"`
+	TwoFactorSecret   string `json:"-"`                           // Sealed TOTP secret, set once setup starts
+	TwoFactorLastStep int64  `gorm:"not null;default:0" json:"-"` // Last accepted TOTP step, prevents replay
 
 	Signature string `json:"signature"`
 }
@@ -34,6 +41,7 @@ type UserResponse struct {
 	Role       string    `json:"role"`
 	Permission string    `json:"permission"`
 	Status     bool      `json:"status"`
+	TwoFactor  bool      `json:"two_factor_enabled"`
 	Signature  string    `json:"signature"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
@@ -50,6 +58,7 @@ func (u *User) ToUserResponse() UserResponse {
 		Role:       u.Role,
 		Permission: u.Permission,
 		Status:     u.Status,
+		TwoFactor:  u.TwoFactorEnabled,
 		Signature:  u.Signature,
 		CreatedAt:  u.CreatedAt,
 		UpdatedAt:  u.UpdatedAt,
@@ -81,6 +90,9 @@ type Login struct {
 func (u *User) SetPassword(p string) {
 	hp, _ := bcrypt.GenerateFromPassword([]byte(p), 14)
 	u.Password = string(hp)
+
+	now := time.Now()
+	u.PasswordChangedAt = &now
 }
 
 func (u *User) ComparePassword(p string) error {
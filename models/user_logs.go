@@ -1,19 +1,84 @@
 package models
 
 import (
+	"database/sql/driver"
+	"errors"
 	"time"
 )
 
+// UserLogs is the append-only audit trail. Entries are chained: Signature is
+// an HMAC over the entry content and PrevSignature, the Signature of the entry
+// before it, so any edited, removed or reordered entry breaks the chain.
 type UserLogs struct {
-	CreatedAt time.Time `json:"created_at"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
 	UpdatedAt time.Time `json:"updated_at"`
 
 	UUID string `json:"uuid" gorm:"primaryKey;type:varchar(255);not null;unique"`
 
-	Name        string `json:"name"`
-	Action      string `json:"action"`
-	Description string `json:"Description"`
-	UserUUID    string `json:"user_uuid" gorm:"type:varchar(255);not null"`
-	User        User   `json:"user" gorm:"foreignKey:UserUUID;references:UUID"`
-	Signature   string `json:"Signature"`
+	Sequence      *int64 `json:"sequence" gorm:"uniqueIndex"` // Position in the chain, nil until chained
+	Name          string `json:"name"`
+	Action        string `json:"action" gorm:"index"`
+	Description   string `json:"Description"`
+	UserUUID      string `json:"user_uuid" gorm:"type:varchar(255);not null;index"`
+	User          User   `json:"user" gorm:"foreignKey:UserUUID;references:UUID"`
+	DeviceUUID    string `json:"device_uuid" gorm:"type:varchar(255);index"` // Set for kiosk calls without a user
+	PrevSignature string `json:"prev_signature"`
+	Signature     string `json:"Signature"`
+
+	// Structured context, filled by utils.ActivityLogger
+	EntityType string      `json:"entity_type" gorm:"type:varchar(100);index:idx_user_logs_entity"`
+	EntityID   string      `json:"entity_id" gorm:"type:varchar(255);index:idx_user_logs_entity"`
+	Outcome    string      `json:"outcome" gorm:"type:varchar(20);index"` // success, failure
+	IPAddress  string      `json:"ip_address" gorm:"type:varchar(64)"`
+	UserAgent  string      `json:"user_agent"`
+	ClientInfo string      `json:"client_info"`
+	DeviceID   string      `json:"device_id" gorm:"type:varchar(255);index"` // Kiosk device_id, readable form of DeviceUUID
+	RequestID  string      `json:"request_id" gorm:"type:varchar(64);index"`
+	Payload    JSONPayload `json:"payload" gorm:"type:jsonb"`
+}
+
+// Outcomes of an audited action
+const (
+	LogOutcomeSuccess = "success"
+	LogOutcomeFailure = "failure"
+)
+
+// JSONPayload is raw JSON stored in a jsonb column
+type JSONPayload []byte
+
+// Value stores the payload as JSON text, NULL when empty
+func (p JSONPayload) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	return string(p), nil
+}
+
+// Scan reads a jsonb column
+func (p *JSONPayload) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*p = nil
+	case []byte:
+		*p = append((*p)[:0], v...)
+	case string:
+		*p = JSONPayload(v)
+	default:
+		return errors.New("unsupported type for JSONPayload")
+	}
+	return nil
+}
+
+// MarshalJSON returns the payload as is, null when empty
+func (p JSONPayload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON keeps the raw JSON
+func (p *JSONPayload) UnmarshalJSON(data []byte) error {
+	*p = append((*p)[:0], data...)
+	return nil
 }
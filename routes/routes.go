@@ -5,11 +5,15 @@ import (
 	"github.com/Danny19977/certikiosk.git/controller/auth"
 	certificationController "github.com/Danny19977/certikiosk.git/controller/certification"
 	citizensController "github.com/Danny19977/certikiosk.git/controller/citizens"
+	deviceController "github.com/Danny19977/certikiosk.git/controller/device"
 	documentsController "github.com/Danny19977/certikiosk.git/controller/documents"
+	documentTypeController "github.com/Danny19977/certikiosk.git/controller/documenttype"
 	fingerprintController "github.com/Danny19977/certikiosk.git/controller/fingerprint"
+	roleController "github.com/Danny19977/certikiosk.git/controller/role"
 	"github.com/Danny19977/certikiosk.git/controller/user"
 	"github.com/Danny19977/certikiosk.git/controller/userlog"
 	"github.com/Danny19977/certikiosk.git/middlewares"
+	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -22,6 +26,18 @@ func Setup(app *fiber.App) {
 	// ============================================
 	public := api.Group("/public")
 
+	// Public verification of certified documents (QR code target).
+	// Registered before the device middleware: anyone scanning a certified
+	// document must be able to reach them.
+	public.Get("/verify/:uuid", certificationController.VerifyCertification)
+	public.Post("/verify/:uuid", certificationController.VerifyCertification)
+	public.Post("/verify-signature", certificationController.ValidateCertifiedSignature)
+
+	// ============================================
+	// KIOSK ROUTES (Registered Device Required)
+	// ============================================
+	public.Use(middlewares.IsKioskDevice)
+
 	// Public citizen registration
 	public.Post("/citizens/register", citizensController.CreateCitizen)
 
@@ -33,7 +49,9 @@ func Setup(app *fiber.App) {
 	public.Get("/documents/national-id/:national_id", documentsController.GetDocumentsByNationalID)
 	public.Get("/documents/active", documentsController.GetActiveDocuments)
 	public.Get("/documents/:uuid", documentsController.GetDocument)
+	public.Post("/documents/:uuid/download-token", documentsController.CreateDocumentDownloadToken)
 	public.Post("/documents/send-email", documentsController.SendDocumentEmail)
+	public.Get("/document-types", documentTypeController.GetAllDocumentTypes)
 
 	// Public Google Drive document operations for kiosk
 	public.Post("/documents/send-email-gdrive", documentsController.SendDocumentEmailFromGDrive)
@@ -41,7 +59,8 @@ func Setup(app *fiber.App) {
 	public.Post("/documents/generate-stamped-pdf", documentsController.GenerateStampedPDF)
 	public.Get("/documents/stamped-pdf-metadata", documentsController.GenerateStampedPDFMetadata)
 
-	// Google Drive proxy endpoints (bypass CORS)
+	// Google Drive proxy endpoints (bypass CORS), files of registered documents
+	// only, through the download token issued above
 	public.Get("/documents/gdrive/download/:file_id", documentsController.DownloadGoogleDriveFile)
 	public.Get("/documents/gdrive/download", documentsController.DownloadGoogleDriveFile)
 	public.Get("/documents/gdrive/metadata/:file_id", documentsController.GetGoogleDriveFileMetadata)
@@ -55,109 +74,162 @@ func Setup(app *fiber.App) {
 	a := api.Group("/auth")
 	a.Post("/register", auth.Register)
 	a.Post("/login", auth.Login)
+	a.Post("/login/2fa", auth.LoginTwoFactor)
+	a.Post("/refresh", auth.Refresh)
 	a.Post("/forgot-password", auth.Forgot)
 	a.Post("/reset/:token", auth.ResetPassword)
 
 	// Protected routes (authentication required)
+	// can() additionally checks a permission of the user's role, see models/role.go
+	can := middlewares.RequirePermission
+
 	protected := api.Group("/auth")
 	protected.Use(middlewares.IsAuthenticated)
 	protected.Get("/user", auth.AuthUser)
 	protected.Put("/profil/info", auth.UpdateInfo)
 	protected.Put("/change-password", auth.ChangePassword)
 	protected.Post("/logout", auth.Logout)
+	protected.Post("/logout-all", auth.LogoutAll)
+
+	// Two-factor authentication (TOTP) of the current user
+	protected.Get("/2fa", auth.GetTwoFactorStatus)
+	protected.Post("/2fa/setup", auth.SetupTwoFactor)
+	protected.Post("/2fa/enable", auth.EnableTwoFactor)
+	protected.Post("/2fa/disable", auth.DisableTwoFactor)
+	protected.Post("/2fa/recovery-codes", auth.RegenerateRecoveryCodes)
 
 	// Users controller - Protected routes
 	u := api.Group("/users")
 	u.Use(middlewares.IsAuthenticated)
-	u.Get("/all", user.GetAllUsers)
-	u.Get("/all/paginate", user.GetPaginatedUsers)
-	u.Get("/all/paginate/nosearch", user.GetPaginatedNoSerach)
-
-	u.Get("/get/:uuid", user.GetUser)
-	u.Post("/create", user.CreateUser)
-	u.Put("/update/:uuid", user.UpdateUser)
-	u.Delete("/delete/:uuid", user.DeleteUser)
+	u.Get("/all", can(models.PermissionUsersRead), user.GetAllUsers)
+	u.Get("/all/paginate", can(models.PermissionUsersRead), user.GetPaginatedUsers)
+	u.Get("/all/paginate/nosearch", can(models.PermissionUsersRead), user.GetPaginatedNoSerach)
+
+	u.Get("/get/:uuid", can(models.PermissionUsersRead), user.GetUser)
+	u.Post("/create", can(models.PermissionUsersWrite), user.CreateUser)
+	u.Put("/update/:uuid", can(models.PermissionUsersWrite), user.UpdateUser)
+	u.Post("/revoke-sessions/:uuid", can(models.PermissionUsersWrite), user.RevokeUserSessions)
+	u.Post("/reset-2fa/:uuid", can(models.PermissionUsersWrite), user.ResetUserTwoFactor)
+	u.Post("/unlock/:uuid", can(models.PermissionUsersWrite), user.UnlockUser)
+	u.Delete("/delete/:uuid", can(models.PermissionUsersDelete), user.DeleteUser)
 
 	// UserLogs controller - Protected routes
 	log := api.Group("/users-logs")
 	log.Use(middlewares.IsAuthenticated)
-	log.Get("/all", userlog.GetUserLogs)
-	log.Get("/all/paginate", userlog.GetPaginatedUserLogs)
-	log.Get("/all/paginate/:user_uuid", userlog.GetUserLogByID)
-	log.Get("/get/:uuid", userlog.GetUserLog)
-	log.Post("/create", userlog.CreateUserLog)
-	log.Put("/update/:uuid", userlog.UpdateUserLog)
-	log.Delete("/delete/:uuid", userlog.DeleteUserLog)
+	log.Get("/all", can(models.PermissionLogsRead), userlog.GetUserLogs)
+	log.Get("/all/paginate", can(models.PermissionLogsRead), userlog.GetPaginatedUserLogs)
+	log.Get("/all/paginate/:user_uuid", can(models.PermissionLogsRead), userlog.GetUserLogByID)
+	log.Get("/get/:uuid", can(models.PermissionLogsRead), userlog.GetUserLog)
+	log.Get("/verify", can(models.PermissionLogsRead), userlog.VerifyUserLogs)
+	log.Get("/export", can(models.PermissionLogsRead), userlog.ExportUserLogs)
+	log.Post("/create", can(models.PermissionLogsWrite), userlog.CreateUserLog)
 
 	// Notification controller - Protected routes
 	notificationGroup := api.Group("/notifications")
 	notificationGroup.Use(middlewares.IsAuthenticated)
-	notificationGroup.Get("/all", notificationController.GetAllNotifications)
-	notificationGroup.Get("/all/paginate", notificationController.GetPaginatedNotification)
-	notificationGroup.Get("/get/:uuid", notificationController.GetNotification)
-	notificationGroup.Get("/get/title/:title", notificationController.GetNotificationByTitleString)
-	notificationGroup.Post("/create", notificationController.CreateNotification)
-	notificationGroup.Put("/update/:uuid", notificationController.UpdateNotification)
-	notificationGroup.Delete("/delete/:uuid", notificationController.DeleteNotification)
+	notificationGroup.Get("/all", can(models.PermissionNotificationsRead), notificationController.GetAllNotifications)
+	notificationGroup.Get("/all/paginate", can(models.PermissionNotificationsRead), notificationController.GetPaginatedNotification)
+	notificationGroup.Get("/get/:uuid", can(models.PermissionNotificationsRead), notificationController.GetNotification)
+	notificationGroup.Get("/get/title/:title", can(models.PermissionNotificationsRead), notificationController.GetNotificationByTitleString)
+	notificationGroup.Post("/create", can(models.PermissionNotificationsWrite), notificationController.CreateNotification)
+	notificationGroup.Put("/update/:uuid", can(models.PermissionNotificationsWrite), notificationController.UpdateNotification)
+	notificationGroup.Delete("/delete/:uuid", can(models.PermissionNotificationsDelete), notificationController.DeleteNotification)
 
 	// Citizens controller - Protected routes (admin operations only)
 	// Note: Public citizen registration is available at /api/public/citizens/register
 	citizens := api.Group("/citizens")
 	citizens.Use(middlewares.IsAuthenticated)
-	citizens.Get("/all", citizensController.GetAllCitizens)
-	citizens.Get("/all/paginate", citizensController.GetPaginatedCitizens)
-	citizens.Get("/get/:uuid", citizensController.GetCitizen)
-	citizens.Get("/national-id/:national_id", citizensController.GetCitizenByNationalID)
-	citizens.Put("/update/:uuid", citizensController.UpdateCitizen)
-	citizens.Delete("/delete/:uuid", citizensController.DeleteCitizen)
+	citizens.Get("/all", can(models.PermissionCitizensRead), citizensController.GetAllCitizens)
+	citizens.Get("/all/paginate", can(models.PermissionCitizensRead), citizensController.GetPaginatedCitizens)
+	citizens.Get("/get/:uuid", can(models.PermissionCitizensRead), citizensController.GetCitizen)
+	citizens.Get("/national-id/:national_id", can(models.PermissionCitizensRead), citizensController.GetCitizenByNationalID)
+	citizens.Put("/update/:uuid", can(models.PermissionCitizensWrite), citizensController.UpdateCitizen)
+	citizens.Delete("/delete/:uuid", can(models.PermissionCitizensDelete), citizensController.DeleteCitizen)
 
 	// Fingerprint controller - Protected routes
 	// Note: Public fingerprint enrollment and verification are available at /api/public/fingerprint/*
 	fingerprint := api.Group("/fingerprint")
 	fingerprint.Use(middlewares.IsAuthenticated)
-	fingerprint.Get("/all/paginate", fingerprintController.GetPaginatedFingerprints)
-	fingerprint.Get("/citizen/:citizen_uuid", fingerprintController.GetFingerprintByCitizen)
-	fingerprint.Put("/update/:citizen_uuid", fingerprintController.UpdateFingerprint)
-	fingerprint.Delete("/delete/:citizen_uuid", fingerprintController.DeleteFingerprint)
+	fingerprint.Get("/all/paginate", can(models.PermissionFingerprintRead), fingerprintController.GetPaginatedFingerprints)
+	fingerprint.Get("/citizen/:citizen_uuid", can(models.PermissionFingerprintRead), fingerprintController.GetFingerprintByCitizen)
+	fingerprint.Put("/update/:citizen_uuid", can(models.PermissionFingerprintWrite), fingerprintController.UpdateFingerprint)
+	fingerprint.Delete("/delete/:citizen_uuid", can(models.PermissionFingerprintDelete), fingerprintController.DeleteFingerprint)
 
 	// Documents controller - Protected routes (admin operations)
 	// Note: Public read-only document access and email sending are available at /api/public/documents/*
 	documents := api.Group("/documents")
 	documents.Use(middlewares.IsAuthenticated)
-	documents.Get("/all", documentsController.GetAllDocuments)
-	documents.Get("/all/paginate", documentsController.GetPaginatedDocuments)
-	documents.Get("/user/:user_uuid", documentsController.GetDocumentsByUserUUID)
-	documents.Post("/create", documentsController.CreateDocument)
-	documents.Post("/fetch-external", documentsController.FetchDocumentFromExternalSource)
-	documents.Put("/update/:uuid", documentsController.UpdateDocument)
-	documents.Put("/toggle-status/:uuid", documentsController.ToggleDocumentStatus)
-	documents.Delete("/delete/:uuid", documentsController.DeleteDocument)
-	documents.Post("/send-email", documentsController.SendDocumentEmail)
-	documents.Post("/send-email-gdrive", documentsController.SendDocumentEmailFromGDrive)
-	documents.Get("/generate-stamped-pdf", documentsController.GenerateStampedPDF)
-	documents.Post("/generate-stamped-pdf", documentsController.GenerateStampedPDF)
-	documents.Get("/stamped-pdf-metadata", documentsController.GenerateStampedPDFMetadata)
+	documents.Get("/all", can(models.PermissionDocumentsRead), documentsController.GetAllDocuments)
+	documents.Get("/all/paginate", can(models.PermissionDocumentsRead), documentsController.GetPaginatedDocuments)
+	documents.Get("/user/:user_uuid", can(models.PermissionDocumentsRead), documentsController.GetDocumentsByUserUUID)
+	documents.Post("/create", can(models.PermissionDocumentsWrite), documentsController.CreateDocument)
+	documents.Post("/upload", can(models.PermissionDocumentsWrite), documentsController.UploadDocument)
+	documents.Post("/fetch-external", can(models.PermissionDocumentsWrite), documentsController.FetchDocumentFromExternalSource)
+	documents.Put("/update/:uuid", can(models.PermissionDocumentsWrite), documentsController.UpdateDocument)
+	documents.Get("/versions/:uuid", can(models.PermissionDocumentsRead), documentsController.GetDocumentVersions)
+	documents.Post("/versions/:uuid", can(models.PermissionDocumentsWrite), documentsController.CreateDocumentVersion)
+	documents.Get("/versions/:uuid/:version/download", can(models.PermissionDocumentsRead), documentsController.DownloadDocumentVersion)
+	documents.Post("/download-token/:uuid", can(models.PermissionDocumentsRead), documentsController.CreateDocumentDownloadToken)
+	documents.Put("/toggle-status/:uuid", can(models.PermissionDocumentsWrite), documentsController.ToggleDocumentStatus)
+	documents.Delete("/delete/:uuid", can(models.PermissionDocumentsDelete), documentsController.DeleteDocument)
+	documents.Post("/send-email", can(models.PermissionDocumentsSend), documentsController.SendDocumentEmail)
+	documents.Post("/send-email-gdrive", can(models.PermissionDocumentsSend), documentsController.SendDocumentEmailFromGDrive)
+	documents.Get("/generate-stamped-pdf", can(models.PermissionDocumentsRead), documentsController.GenerateStampedPDF)
+	documents.Post("/generate-stamped-pdf", can(models.PermissionDocumentsRead), documentsController.GenerateStampedPDF)
+	documents.Get("/stamped-pdf-metadata", can(models.PermissionDocumentsRead), documentsController.GenerateStampedPDFMetadata)
 
 	// Google Drive proxy endpoints (also available here for authenticated access)
-	documents.Get("/download-google-drive", documentsController.DownloadGoogleDriveFile)
-	documents.Get("/google-drive-metadata", documentsController.GetGoogleDriveFileMetadata)
-	documents.Get("/gdrive/download/:file_id", documentsController.DownloadGoogleDriveFile)
-	documents.Get("/gdrive/download", documentsController.DownloadGoogleDriveFile)
-	documents.Get("/gdrive/metadata/:file_id", documentsController.GetGoogleDriveFileMetadata)
-	documents.Get("/gdrive/metadata", documentsController.GetGoogleDriveFileMetadata)
+	documents.Get("/download-google-drive", can(models.PermissionDocumentsRead), documentsController.DownloadGoogleDriveFile)
+	documents.Get("/google-drive-metadata", can(models.PermissionDocumentsRead), documentsController.GetGoogleDriveFileMetadata)
+	documents.Get("/gdrive/download/:file_id", can(models.PermissionDocumentsRead), documentsController.DownloadGoogleDriveFile)
+	documents.Get("/gdrive/download", can(models.PermissionDocumentsRead), documentsController.DownloadGoogleDriveFile)
+	documents.Get("/gdrive/metadata/:file_id", can(models.PermissionDocumentsRead), documentsController.GetGoogleDriveFileMetadata)
+	documents.Get("/gdrive/metadata", can(models.PermissionDocumentsRead), documentsController.GetGoogleDriveFileMetadata)
+	documents.Get("/gdrive/cache-stats", can(models.PermissionDocumentsRead), documentsController.GetDriveCacheStats)
+
+	// Document types controller - Protected routes (document type catalogue)
+	documentTypes := api.Group("/document-types")
+	documentTypes.Use(middlewares.IsAuthenticated)
+	documentTypes.Get("/all", can(models.PermissionDocumentsRead), documentTypeController.GetAllDocumentTypes)
+	documentTypes.Get("/get/:uuid", can(models.PermissionDocumentsRead), documentTypeController.GetDocumentType)
+	documentTypes.Post("/create", can(models.PermissionDocumentTypesManage), documentTypeController.CreateDocumentType)
+	documentTypes.Put("/update/:uuid", can(models.PermissionDocumentTypesManage), documentTypeController.UpdateDocumentType)
+	documentTypes.Delete("/delete/:uuid", can(models.PermissionDocumentTypesManage), documentTypeController.DeleteDocumentType)
 
 	// Certification controller - Protected routes
 	certification := api.Group("/certification")
 	certification.Use(middlewares.IsAuthenticated)
-	certification.Get("/all", certificationController.GetAllCertifications)
-	certification.Get("/all/paginate", certificationController.GetPaginatedCertifications)
-	certification.Get("/get/:uuid", certificationController.GetCertification)
-	certification.Get("/citizen/:citizen_uuid", certificationController.GetCertificationsByCitizen)
-	certification.Get("/document/:document_uuid", certificationController.GetCertificationsByDocument)
-	certification.Get("/download/:uuid", certificationController.DownloadCertifiedDocument)
-	certification.Get("/print/:uuid", certificationController.PrintCertifiedDocument)
-	certification.Post("/certify", certificationController.CertifyDocument)
-	certification.Put("/revoke/:uuid", certificationController.RevokeCertification)
-	certification.Delete("/delete/:uuid", certificationController.DeleteCertification)
+	certification.Get("/all", can(models.PermissionCertificationRead), certificationController.GetAllCertifications)
+	certification.Get("/all/paginate", can(models.PermissionCertificationRead), certificationController.GetPaginatedCertifications)
+	certification.Get("/get/:uuid", can(models.PermissionCertificationRead), certificationController.GetCertification)
+	certification.Get("/citizen/:citizen_uuid", can(models.PermissionCertificationRead), certificationController.GetCertificationsByCitizen)
+	certification.Get("/document/:document_uuid", can(models.PermissionCertificationRead), certificationController.GetCertificationsByDocument)
+	certification.Get("/download/:uuid", can(models.PermissionCertificationRead), certificationController.DownloadCertifiedDocument)
+	certification.Get("/print/:uuid", can(models.PermissionCertificationRead), certificationController.PrintCertifiedDocument)
+	certification.Post("/certify", can(models.PermissionCertificationCreate), certificationController.CertifyDocument)
+	certification.Post("/validate-signature", can(models.PermissionCertificationRead), certificationController.ValidateCertifiedSignature)
+	certification.Put("/revoke/:uuid", can(models.PermissionCertificationRevoke), certificationController.RevokeCertification)
+	certification.Delete("/delete/:uuid", can(models.PermissionCertificationDelete), certificationController.DeleteCertification)
+
+	// Roles controller - Protected routes (role and permission management)
+	roles := api.Group("/roles")
+	roles.Use(middlewares.IsAuthenticated, can(models.PermissionRolesManage))
+	roles.Get("/all", roleController.GetAllRoles)
+	roles.Get("/permissions", roleController.GetPermissions)
+	roles.Get("/get/:uuid", roleController.GetRole)
+	roles.Post("/create", roleController.CreateRole)
+	roles.Put("/update/:uuid", roleController.UpdateRole)
+	roles.Put("/assign/:user_uuid", roleController.AssignRole)
+	roles.Delete("/delete/:uuid", roleController.DeleteRole)
+
+	// Kiosk devices controller - Protected routes (device registry)
+	devices := api.Group("/devices")
+	devices.Use(middlewares.IsAuthenticated, can(models.PermissionDevicesManage))
+	devices.Get("/all/paginate", deviceController.GetPaginatedDevices)
+	devices.Get("/get/:uuid", deviceController.GetDevice)
+	devices.Post("/register", deviceController.RegisterDevice)
+	devices.Put("/update/:uuid", deviceController.UpdateDevice)
+	devices.Post("/rotate-key/:uuid", deviceController.RotateDeviceKey)
+	devices.Delete("/delete/:uuid", deviceController.DeleteDevice)
 
 }
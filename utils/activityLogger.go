@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/Danny19977/certikiosk.git/models"
 	"github.com/gofiber/fiber/v2"
@@ -24,154 +23,236 @@ func NewActivityLogger(db *gorm.DB) *ActivityLogger {
 	}
 }
 
-// LogUserActivity logs a user activity to the database
-func (al *ActivityLogger) LogUserActivity(c *fiber.Ctx, action, name, description string, additionalData map[string]interface{}) error {
-	// Get user UUID from token
-	userUUID, err := GetUserUUIDFromToken(c)
-	if err != nil {
-		// Don't fail the main operation if logging fails
-		return nil
+// LogEntry describes one audited action. Request context (IP, user agent,
+// device, request ID) is added by Record.
+type LogEntry struct {
+	Action      string
+	Name        string
+	Description string
+	UserUUID    string // Taken from the token when empty
+	EntityType  string
+	EntityID    string
+	Outcome     string // models.LogOutcomeSuccess when empty
+	Payload     map[string]interface{}
+}
+
+// Record appends an entry to the audit log with the request context
+func (al *ActivityLogger) Record(c *fiber.Ctx, entry LogEntry) error {
+	if entry.UserUUID == "" {
+		entry.UserUUID, _ = GetUserUUIDFromToken(c)
+	}
+	if entry.Outcome == "" {
+		entry.Outcome = models.LogOutcomeSuccess
 	}
 
-	// Create log entry
+	// The signature is set when the entry is chained
 	logEntry := &models.UserLogs{
 		UUID:        uuid.New().String(),
-		Name:        name,
-		Action:      strings.ToUpper(action),
-		Description: description,
-		UserUUID:    userUUID,
-		Signature:   al.generateSignature(action, name, userUUID),
+		Name:        entry.Name,
+		Action:      strings.ToUpper(entry.Action),
+		Description: entry.Description,
+		UserUUID:    entry.UserUUID,
+		EntityType:  entry.EntityType,
+		EntityID:    entry.EntityID,
+		Outcome:     entry.Outcome,
+		IPAddress:   c.IP(),
+		UserAgent:   c.Get(fiber.HeaderUserAgent),
+		ClientInfo:  al.getClientInfo(c),
+		RequestID:   al.getRequestID(c),
 	}
 
-	// Add additional data to description if provided
-	if len(additionalData) > 0 {
-		if additionalDataJSON, err := json.Marshal(additionalData); err == nil {
-			logEntry.Description = fmt.Sprintf("%s | Additional Data: %s", description, string(additionalDataJSON))
-		}
+	if device := CurrentDevice(c); device != nil {
+		logEntry.DeviceUUID = device.UUID
+		logEntry.DeviceID = device.DeviceID
 	}
 
-	// Save to database
-	if err := al.DB.Create(logEntry).Error; err != nil {
-		return err
+	if len(entry.Payload) > 0 {
+		if payload, err := json.Marshal(entry.Payload); err == nil {
+			logEntry.Payload = payload
+		}
 	}
 
-	return nil
+	// Append to the audit chain
+	return AppendAuditLog(al.DB, logEntry)
+}
+
+// LogUserActivity logs a user activity to the database
+func (al *ActivityLogger) LogUserActivity(c *fiber.Ctx, action, name, description string, additionalData map[string]interface{}) error {
+	// Get user UUID from token, kiosk calls are attributed to the device instead
+	userUUID, _ := GetUserUUIDFromToken(c)
+	return al.logActivityAs(c, LogEntry{
+		Action:      action,
+		Name:        name,
+		Description: description,
+		UserUUID:    userUUID,
+		Payload:     additionalData,
+	})
+}
+
+// logActivityAs records an activity of a known user or device, used during
+// login when the request does not carry a token yet
+func (al *ActivityLogger) logActivityAs(c *fiber.Ctx, entry LogEntry) error {
+	if entry.UserUUID == "" && CurrentDevice(c) == nil {
+		// Don't fail the main operation if logging fails
+		return nil
+	}
+	return al.Record(c, entry)
 }
 
 // LogLogin logs user login activity
 func (al *ActivityLogger) LogLogin(c *fiber.Ctx, userUUID string, userInfo map[string]interface{}) error {
-	return al.LogUserActivity(c, "LOGIN", "user_login",
-		fmt.Sprintf("User logged into the system from %s", al.getClientInfo(c)),
-		map[string]interface{}{
-			"client_info": al.getClientInfo(c),
-			"ip_address":  c.IP(),
-			"user_agent":  c.Get("User-Agent"),
-			"user_info":   userInfo,
-		})
+	return al.logActivityAs(c, LogEntry{
+		Action:      "LOGIN",
+		Name:        "user_login",
+		Description: fmt.Sprintf("User logged into the system from %s", al.getClientInfo(c)),
+		UserUUID:    userUUID,
+		EntityType:  "user",
+		EntityID:    userUUID,
+		Payload: map[string]interface{}{
+			"user_info": userInfo,
+		},
+	})
 }
 
 // LogLogout logs user logout activity
 func (al *ActivityLogger) LogLogout(c *fiber.Ctx, userUUID string) error {
-	return al.LogUserActivity(c, "LOGOUT", "user_logout",
-		"User logged out of the system",
-		map[string]interface{}{
-			"ip_address": c.IP(),
-			"user_agent": c.Get("User-Agent"),
-		})
+	return al.logActivityAs(c, LogEntry{
+		Action:      "LOGOUT",
+		Name:        "user_logout",
+		Description: "User logged out of the system",
+		UserUUID:    userUUID,
+		EntityType:  "user",
+		EntityID:    userUUID,
+	})
+}
+
+// LogTwoFactor logs a two-factor authentication event (challenge, enabled, failed, reset...)
+func (al *ActivityLogger) LogTwoFactor(c *fiber.Ctx, userUUID, event string, details map[string]interface{}) error {
+	outcome := models.LogOutcomeSuccess
+	if event == "failed" {
+		outcome = models.LogOutcomeFailure
+	}
+
+	return al.logActivityAs(c, LogEntry{
+		Action:      "TWO_FACTOR",
+		Name:        fmt.Sprintf("two_factor_%s", event),
+		Description: fmt.Sprintf("Two-factor authentication: %s", strings.ReplaceAll(event, "_", " ")),
+		UserUUID:    userUUID,
+		EntityType:  "user",
+		EntityID:    userUUID,
+		Outcome:     outcome,
+		Payload:     details,
+	})
+}
+
+// LogPasswordReset logs a password reset event (requested, completed, invalid_token...)
+func (al *ActivityLogger) LogPasswordReset(c *fiber.Ctx, userUUID, event string, details map[string]interface{}) error {
+	return al.logActivityAs(c, LogEntry{
+		Action:      "PASSWORD_RESET",
+		Name:        fmt.Sprintf("password_reset_%s", event),
+		Description: fmt.Sprintf("Password reset: %s", strings.ReplaceAll(event, "_", " ")),
+		UserUUID:    userUUID,
+		EntityType:  "user",
+		EntityID:    userUUID,
+		Payload:     details,
+	})
 }
 
 // LogCreate logs entity creation
 func (al *ActivityLogger) LogCreate(c *fiber.Ctx, entityType, entityName, entityID string) error {
-	return al.LogUserActivity(c, "CREATE", fmt.Sprintf("create_%s", entityType),
-		fmt.Sprintf("Created new %s: %s", entityType, entityName),
-		map[string]interface{}{
-			"entity_type": entityType,
-			"entity_name": entityName,
-			"entity_id":   entityID,
-		})
+	return al.logEntityActivity(c, "CREATE", "create", "Created new", entityType, entityName, entityID, nil)
 }
 
 // LogUpdate logs entity update
 func (al *ActivityLogger) LogUpdate(c *fiber.Ctx, entityType, entityName, entityID string, changes map[string]interface{}) error {
-	var changesList []string
-	for key := range changes {
-		changesList = append(changesList, key)
-	}
-
-	return al.LogUserActivity(c, "UPDATE", fmt.Sprintf("update_%s", entityType),
-		fmt.Sprintf("Updated %s: %s", entityType, entityName),
-		map[string]interface{}{
-			"entity_type": entityType,
-			"entity_name": entityName,
-			"entity_id":   entityID,
-			"changes":     changesList,
-		})
+	return al.logEntityActivity(c, "UPDATE", "update", "Updated", entityType, entityName, entityID, map[string]interface{}{
+		"changes": changes,
+	})
 }
 
 // LogDelete logs entity deletion
 func (al *ActivityLogger) LogDelete(c *fiber.Ctx, entityType, entityName, entityID string) error {
-	return al.LogUserActivity(c, "DELETE", fmt.Sprintf("delete_%s", entityType),
-		fmt.Sprintf("Deleted %s: %s", entityType, entityName),
-		map[string]interface{}{
-			"entity_type": entityType,
-			"entity_name": entityName,
-			"entity_id":   entityID,
-		})
+	return al.logEntityActivity(c, "DELETE", "delete", "Deleted", entityType, entityName, entityID, nil)
 }
 
 // LogView logs entity view/access
 func (al *ActivityLogger) LogView(c *fiber.Ctx, entityType, entityName, entityID string) error {
-	return al.LogUserActivity(c, "VIEW", fmt.Sprintf("view_%s", entityType),
-		fmt.Sprintf("Viewed %s: %s", entityType, entityName),
-		map[string]interface{}{
-			"entity_type": entityType,
-			"entity_name": entityName,
-			"entity_id":   entityID,
-		})
+	return al.logEntityActivity(c, "VIEW", "view", "Viewed", entityType, entityName, entityID, nil)
+}
+
+func (al *ActivityLogger) logEntityActivity(c *fiber.Ctx, action, verb, description, entityType, entityName, entityID string, payload map[string]interface{}) error {
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	payload["entity_name"] = entityName
+
+	userUUID, _ := GetUserUUIDFromToken(c)
+	return al.logActivityAs(c, LogEntry{
+		Action:      action,
+		Name:        fmt.Sprintf("%s_%s", verb, entityType),
+		Description: fmt.Sprintf("%s %s: %s", description, entityType, entityName),
+		UserUUID:    userUUID,
+		EntityType:  entityType,
+		EntityID:    entityID,
+		Payload:     payload,
+	})
 }
 
 // LogAPICall logs API endpoint access
 func (al *ActivityLogger) LogAPICall(c *fiber.Ctx, endpoint, method string, responseStatus int) error {
-	return al.LogUserActivity(c, "API_CALL", fmt.Sprintf("api_%s", strings.ToLower(method)),
-		fmt.Sprintf("Called API endpoint: %s %s (Status: %d)", method, endpoint, responseStatus),
-		map[string]interface{}{
+	outcome := models.LogOutcomeSuccess
+	if responseStatus >= 400 {
+		outcome = models.LogOutcomeFailure
+	}
+
+	userUUID, _ := GetUserUUIDFromToken(c)
+	return al.logActivityAs(c, LogEntry{
+		Action:      "API_CALL",
+		Name:        fmt.Sprintf("api_%s", strings.ToLower(method)),
+		Description: fmt.Sprintf("Called API endpoint: %s %s (Status: %d)", method, endpoint, responseStatus),
+		UserUUID:    userUUID,
+		Outcome:     outcome,
+		Payload: map[string]interface{}{
 			"endpoint":        endpoint,
 			"method":          method,
 			"response_status": responseStatus,
-			"ip_address":      c.IP(),
-			"user_agent":      c.Get("User-Agent"),
-		})
+		},
+	})
 }
 
-// LogError logs system errors
+// LogError logs system errors. A "user_uuid" in the context links the entry
+// to that account, e.g. failed logins.
 func (al *ActivityLogger) LogError(c *fiber.Ctx, errorType, errorMessage string, context map[string]interface{}) error {
-	userUUID, _ := GetUserUUIDFromToken(c) // Get if available, but don't fail if not
-
-	logEntry := &models.UserLogs{
-		UUID:        uuid.New().String(),
-		Name:        fmt.Sprintf("error_%s", errorType),
+	entry := LogEntry{
 		Action:      "ERROR",
+		Name:        fmt.Sprintf("error_%s", errorType),
 		Description: fmt.Sprintf("System error: %s", errorMessage),
-		UserUUID:    userUUID, // May be empty for system errors
-		Signature:   al.generateSignature("ERROR", errorType, userUUID),
+		Outcome:     models.LogOutcomeFailure,
+		Payload:     map[string]interface{}{},
 	}
 
-	// Add context to description
-	if len(context) > 0 {
-		if contextJSON, err := json.Marshal(context); err == nil {
-			logEntry.Description = fmt.Sprintf("%s | Context: %s", logEntry.Description, string(contextJSON))
+	// Request details are stored in their own columns
+	for key, value := range context {
+		if key != "ip_address" && key != "user_agent" {
+			entry.Payload[key] = value
 		}
 	}
 
-	return al.DB.Create(logEntry).Error
+	if userUUID, ok := context["user_uuid"].(string); ok && userUUID != "" {
+		entry.EntityType = "user"
+		entry.EntityID = userUUID
+	}
+
+	// May have no user for system errors
+	return al.Record(c, entry)
 }
 
 // Helper methods
-func (al *ActivityLogger) generateSignature(action, name, userUUID string) string {
-	timestamp := time.Now().Format(time.RFC3339)
-	data := fmt.Sprintf("%s:%s:%s:%s", action, name, userUUID, timestamp)
-	// Simple base64 encoding for signature
-	return fmt.Sprintf("%x", []byte(data))
+func (al *ActivityLogger) getRequestID(c *fiber.Ctx) string {
+	if requestID, ok := c.Locals("requestid").(string); ok && requestID != "" {
+		return requestID
+	}
+	return c.Get(fiber.HeaderXRequestID)
 }
 
 func (al *ActivityLogger) getClientInfo(c *fiber.Ctx) string {
@@ -211,6 +292,16 @@ func LogLogoutWithDB(db *gorm.DB, c *fiber.Ctx, userUUID string) error {
 	return logger.LogLogout(c, userUUID)
 }
 
+func LogTwoFactorWithDB(db *gorm.DB, c *fiber.Ctx, userUUID, event string, details map[string]interface{}) error {
+	logger := NewActivityLogger(db)
+	return logger.LogTwoFactor(c, userUUID, event, details)
+}
+
+func LogPasswordResetWithDB(db *gorm.DB, c *fiber.Ctx, userUUID, event string, details map[string]interface{}) error {
+	logger := NewActivityLogger(db)
+	return logger.LogPasswordReset(c, userUUID, event, details)
+}
+
 func LogCreateWithDB(db *gorm.DB, c *fiber.Ctx, entityType, entityName, entityID string) error {
 	logger := NewActivityLogger(db)
 	return logger.LogCreate(c, entityType, entityName, entityID)
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+)
+
+// Every audit entry is signed with HMAC-SHA256 over its content and the
+// signature of the previous entry. The key comes from AUDIT_LOG_KEY, or is
+// derived from SECRET_KEY when it is not set. Entries are appended under a
+// Postgres advisory lock so concurrent requests cannot fork the chain.
+const auditChainLockID = 7310152
+
+// ErrAuditKeyMissing is returned when no key is available to sign the audit log
+var ErrAuditKeyMissing = errors.New("neither AUDIT_LOG_KEY nor SECRET_KEY is configured")
+
+// AuditChainReport is the result of walking the audit chain
+type AuditChainReport struct {
+	Valid     bool                 `json:"valid"`
+	Checked   int64                `json:"checked"`   // Chained entries verified
+	Unchained int64                `json:"unchained"` // Entries without a sequence, never signed
+	LastSeq   int64                `json:"last_sequence"`
+	BrokenAt  *AuditChainBreakInfo `json:"broken_at,omitempty"`
+}
+
+// AuditChainBreakInfo describes the first broken link of the chain
+type AuditChainBreakInfo struct {
+	Sequence int64  `json:"sequence"`
+	UUID     string `json:"uuid"`
+	Reason   string `json:"reason"`
+}
+
+// AuditLogKeyConfigured reports whether a dedicated audit key is set
+func AuditLogKeyConfigured() bool {
+	return Env("AUDIT_LOG_KEY") != ""
+}
+
+func auditLogKey() ([]byte, error) {
+	if key := Env("AUDIT_LOG_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	if SECRET_KEY == "" {
+		return nil, ErrAuditKeyMissing
+	}
+	key := sha256.Sum256([]byte("certikiosk-audit:" + SECRET_KEY))
+	return key[:], nil
+}
+
+// signAuditEntry computes the chained HMAC of an entry. The payload is a JSON
+// object with fixed field order so the signature does not depend on the driver.
+func signAuditEntry(key []byte, entry *models.UserLogs) string {
+	payload, _ := json.Marshal(struct {
+		Sequence    int64  `json:"seq"`
+		UUID        string `json:"uuid"`
+		CreatedAt   string `json:"created_at"`
+		UserUUID    string `json:"user_uuid"`
+		DeviceUUID  string `json:"device_uuid"`
+		Action      string `json:"action"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Prev        string `json:"prev"`
+
+		// Structured fields, omitted when empty so older entries keep their signature
+		EntityType string `json:"entity_type,omitempty"`
+		EntityID   string `json:"entity_id,omitempty"`
+		Outcome    string `json:"outcome,omitempty"`
+		IPAddress  string `json:"ip_address,omitempty"`
+		UserAgent  string `json:"user_agent,omitempty"`
+		ClientInfo string `json:"client_info,omitempty"`
+		DeviceID   string `json:"device_id,omitempty"`
+		RequestID  string `json:"request_id,omitempty"`
+		Payload    string `json:"payload,omitempty"`
+	}{
+		Sequence:    *entry.Sequence,
+		UUID:        entry.UUID,
+		CreatedAt:   entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		UserUUID:    entry.UserUUID,
+		DeviceUUID:  entry.DeviceUUID,
+		Action:      entry.Action,
+		Name:        entry.Name,
+		Description: entry.Description,
+		Prev:        entry.PrevSignature,
+		EntityType:  entry.EntityType,
+		EntityID:    entry.EntityID,
+		Outcome:     entry.Outcome,
+		IPAddress:   entry.IPAddress,
+		UserAgent:   entry.UserAgent,
+		ClientInfo:  entry.ClientInfo,
+		DeviceID:    entry.DeviceID,
+		RequestID:   entry.RequestID,
+		Payload:     canonicalPayload(entry.Payload),
+	})
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalPayload re-encodes the payload so it signs the same before and
+// after Postgres normalizes it in the jsonb column (key order, spacing)
+func canonicalPayload(payload models.JSONPayload) string {
+	if len(payload) == 0 {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return string(payload)
+	}
+	canonical, _ := json.Marshal(value)
+	return string(canonical)
+}
+
+// chainHead returns the last chained entry, nil when the chain is empty
+func chainHead(tx *gorm.DB) (*models.UserLogs, error) {
+	var head models.UserLogs
+	result := tx.Where("sequence IS NOT NULL").Order("sequence DESC").Limit(1).Find(&head)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &head, nil
+}
+
+// linkAuditEntry places an entry after the head of the chain and signs it
+func linkAuditEntry(key []byte, head, entry *models.UserLogs) {
+	sequence := int64(1)
+	entry.PrevSignature = ""
+	if head != nil {
+		sequence = *head.Sequence + 1
+		entry.PrevSignature = head.Signature
+	}
+	entry.Sequence = &sequence
+
+	// Postgres keeps microseconds, sign what will be read back
+	entry.CreatedAt = entry.CreatedAt.UTC().Truncate(time.Microsecond)
+	entry.Signature = signAuditEntry(key, entry)
+}
+
+// AppendAuditLog chains and stores a new audit entry
+func AppendAuditLog(db *gorm.DB, entry *models.UserLogs) error {
+	key, err := auditLogKey()
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLockID).Error; err != nil {
+			return err
+		}
+
+		head, err := chainHead(tx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		entry.CreatedAt = now
+		entry.UpdatedAt = now
+		linkAuditEntry(key, head, entry)
+
+		return tx.Create(entry).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	notifyAuditForwarder()
+	return nil
+}
+
+// ChainUnsignedAuditLogs appends entries written before the chain existed, in
+// creation order. It proves they have not changed since, not before.
+func ChainUnsignedAuditLogs(db *gorm.DB) (int, error) {
+	key, err := auditLogKey()
+	if err != nil {
+		return 0, err
+	}
+
+	chained := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLockID).Error; err != nil {
+			return err
+		}
+
+		var pending []models.UserLogs
+		if err := tx.Where("sequence IS NULL").Order("created_at ASC, uuid ASC").Find(&pending).Error; err != nil {
+			return err
+		}
+
+		head, err := chainHead(tx)
+		if err != nil {
+			return err
+		}
+
+		for i := range pending {
+			entry := &pending[i]
+			linkAuditEntry(key, head, entry)
+
+			if err := tx.Model(&models.UserLogs{}).Where("uuid = ?", entry.UUID).Updates(map[string]interface{}{
+				"sequence":       entry.Sequence,
+				"prev_signature": entry.PrevSignature,
+				"signature":      entry.Signature,
+				"created_at":     entry.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+
+			head = entry
+			chained++
+		}
+		return nil
+	})
+
+	return chained, err
+}
+
+// VerifyAuditChain walks the whole chain and reports the first broken link:
+// a missing sequence (deleted entry), a previous signature that does not match
+// (reordered or inserted entry) or a wrong HMAC (altered entry).
+func VerifyAuditChain(db *gorm.DB) (*AuditChainReport, error) {
+	key, err := auditLogKey()
+	if err != nil {
+		return nil, err
+	}
+
+	verifier := newAuditChainVerifier(key)
+	db.Model(&models.UserLogs{}).Where("sequence IS NULL").Count(&verifier.report.Unchained)
+
+	const batchSize = 1000
+	for {
+		var batch []models.UserLogs
+		if err := db.Where("sequence >= ?", verifier.expected).Order("sequence ASC").Limit(batchSize).Find(&batch).Error; err != nil {
+			return nil, err
+		}
+
+		for i := range batch {
+			if !verifier.check(&batch[i]) {
+				return verifier.report, nil
+			}
+		}
+
+		if len(batch) < batchSize {
+			return verifier.report, nil
+		}
+	}
+}
+
+// auditChainVerifier checks chained entries handed to it in sequence order
+type auditChainVerifier struct {
+	key           []byte
+	report        *AuditChainReport
+	prevSignature string
+	expected      int64
+}
+
+func newAuditChainVerifier(key []byte) *auditChainVerifier {
+	return &auditChainVerifier{key: key, report: &AuditChainReport{Valid: true}, expected: 1}
+}
+
+// check verifies the next entry of the chain, it returns false and records
+// the break in the report when the entry does not follow the previous one
+func (v *auditChainVerifier) check(entry *models.UserLogs) bool {
+	var reason string
+	switch {
+	case *entry.Sequence != v.expected:
+		reason = fmt.Sprintf("entries %d to %d are missing", v.expected, *entry.Sequence-1)
+	case entry.PrevSignature != v.prevSignature:
+		reason = "previous signature does not match the preceding entry"
+	case !hmac.Equal([]byte(signAuditEntry(v.key, entry)), []byte(entry.Signature)):
+		reason = "signature does not match the entry content"
+	}
+
+	if reason != "" {
+		v.report.Valid = false
+		v.report.BrokenAt = &AuditChainBreakInfo{
+			Sequence: *entry.Sequence,
+			UUID:     entry.UUID,
+			Reason:   reason,
+		}
+		return false
+	}
+
+	v.report.Checked++
+	v.report.LastSeq = *entry.Sequence
+	v.prevSignature = entry.Signature
+	v.expected++
+	return true
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+)
+
+var testAuditKey = []byte("audit-test-key")
+
+// buildAuditChain signs n entries one after the other, as AppendAuditLog does
+func buildAuditChain(n int) []models.UserLogs {
+	entries := make([]models.UserLogs, n)
+	start := time.Date(2024, 1, 1, 8, 0, 0, 123456789, time.UTC)
+
+	var head *models.UserLogs
+	for i := range entries {
+		entries[i] = models.UserLogs{
+			UUID:        fmt.Sprintf("entry-%d", i+1),
+			Name:        "Document certified",
+			Action:      "certify",
+			Description: fmt.Sprintf("Certification %d", i+1),
+			UserUUID:    "clerk",
+			Payload:     models.JSONPayload(`{"document_uuid":"doc","count":1}`),
+			CreatedAt:   start.Add(time.Duration(i) * time.Minute),
+		}
+		linkAuditEntry(testAuditKey, head, &entries[i])
+		head = &entries[i]
+	}
+	return entries
+}
+
+func verifyAuditEntries(entries []models.UserLogs) *AuditChainReport {
+	verifier := newAuditChainVerifier(testAuditKey)
+	for i := range entries {
+		if !verifier.check(&entries[i]) {
+			break
+		}
+	}
+	return verifier.report
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(entries []models.UserLogs) []models.UserLogs
+		broken int64 // Sequence reported as broken, 0 for a valid chain
+		uuid   string
+		reason string
+		valid  int64 // Entries verified before the break
+	}{
+		{
+			name:   "intact",
+			tamper: func(entries []models.UserLogs) []models.UserLogs { return entries },
+		},
+		{
+			name: "payload normalized by the database",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				entries[2].Payload = models.JSONPayload(`{"count": 1, "document_uuid": "doc"}`)
+				return entries
+			},
+		},
+		{
+			name: "altered description",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				entries[2].Description = "Nothing happened"
+				return entries
+			},
+			broken: 3,
+			uuid:   "entry-3",
+			reason: "signature does not match the entry content",
+			valid:  2,
+		},
+		{
+			name: "altered payload",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				entries[3].Payload = models.JSONPayload(`{"document_uuid":"other","count":1}`)
+				return entries
+			},
+			broken: 4,
+			uuid:   "entry-4",
+			reason: "signature does not match the entry content",
+			valid:  3,
+		},
+		{
+			name: "altered date",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				entries[1].CreatedAt = entries[1].CreatedAt.Add(time.Hour)
+				return entries
+			},
+			broken: 2,
+			uuid:   "entry-2",
+			reason: "signature does not match the entry content",
+			valid:  1,
+		},
+		{
+			name: "deleted entry",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				return append(entries[:2], entries[4:]...)
+			},
+			broken: 5,
+			uuid:   "entry-5",
+			reason: "entries 3 to 4 are missing",
+			valid:  2,
+		},
+		{
+			name: "entry re-signed without re-chaining the next one",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				entries[2].Description = "Nothing happened"
+				entries[2].Signature = signAuditEntry(testAuditKey, &entries[2])
+				return entries
+			},
+			broken: 4,
+			uuid:   "entry-4",
+			reason: "previous signature does not match the preceding entry",
+			valid:  3,
+		},
+		{
+			name: "swapped entries",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				second, third := *entries[1].Sequence, *entries[2].Sequence
+				entries[1].Sequence, entries[2].Sequence = &third, &second
+				entries[1], entries[2] = entries[2], entries[1]
+				return entries
+			},
+			broken: 2,
+			uuid:   "entry-3",
+			reason: "previous signature does not match the preceding entry",
+			valid:  1,
+		},
+		{
+			name: "entry forged with another key",
+			tamper: func(entries []models.UserLogs) []models.UserLogs {
+				linkAuditEntry([]byte("forged"), &entries[3], &entries[4])
+				return entries
+			},
+			broken: 5,
+			uuid:   "entry-5",
+			reason: "signature does not match the entry content",
+			valid:  4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := tt.tamper(buildAuditChain(6))
+			report := verifyAuditEntries(entries)
+
+			if tt.broken == 0 {
+				if !report.Valid || report.BrokenAt != nil || report.Checked != int64(len(entries)) || report.LastSeq != 6 {
+					t.Errorf("report = %+v, want a valid chain of %d entries", report, len(entries))
+				}
+				return
+			}
+
+			if report.Valid || report.BrokenAt == nil {
+				t.Fatalf("report = %+v, want a break at %d", report, tt.broken)
+			}
+			want := AuditChainBreakInfo{Sequence: tt.broken, UUID: tt.uuid, Reason: tt.reason}
+			if *report.BrokenAt != want {
+				t.Errorf("BrokenAt = %+v, want %+v", *report.BrokenAt, want)
+			}
+			if report.Checked != tt.valid {
+				t.Errorf("checked %d entries before the break, want %d", report.Checked, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+)
+
+// AuditLogCSVHeader lists the columns of the CSV export
+var AuditLogCSVHeader = []string{
+	"sequence", "created_at", "uuid", "action", "name", "outcome",
+	"user_uuid", "device_uuid", "device_id", "entity_type", "entity_id",
+	"ip_address", "user_agent", "request_id", "description", "payload",
+	"prev_signature", "signature",
+}
+
+// AuditLogCSVRecord formats an entry in the AuditLogCSVHeader column order
+func AuditLogCSVRecord(entry *models.UserLogs) []string {
+	sequence := ""
+	if entry.Sequence != nil {
+		sequence = strconv.FormatInt(*entry.Sequence, 10)
+	}
+
+	return []string{
+		sequence,
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		entry.UUID,
+		entry.Action,
+		entry.Name,
+		entry.Outcome,
+		entry.UserUUID,
+		entry.DeviceUUID,
+		entry.DeviceID,
+		entry.EntityType,
+		entry.EntityID,
+		entry.IPAddress,
+		entry.UserAgent,
+		entry.RequestID,
+		entry.Description,
+		string(entry.Payload),
+		entry.PrevSignature,
+		entry.Signature,
+	}
+}
+
+// auditLogRecord is the JSON form of an entry used by the JSONL export and the forwarders
+type auditLogRecord struct {
+	Sequence      *int64             `json:"sequence"`
+	CreatedAt     string             `json:"created_at"`
+	UUID          string             `json:"uuid"`
+	Action        string             `json:"action"`
+	Name          string             `json:"name"`
+	Outcome       string             `json:"outcome"`
+	UserUUID      string             `json:"user_uuid,omitempty"`
+	DeviceUUID    string             `json:"device_uuid,omitempty"`
+	DeviceID      string             `json:"device_id,omitempty"`
+	EntityType    string             `json:"entity_type,omitempty"`
+	EntityID      string             `json:"entity_id,omitempty"`
+	IPAddress     string             `json:"ip_address,omitempty"`
+	UserAgent     string             `json:"user_agent,omitempty"`
+	RequestID     string             `json:"request_id,omitempty"`
+	Description   string             `json:"description"`
+	Payload       models.JSONPayload `json:"payload,omitempty"`
+	PrevSignature string             `json:"prev_signature"`
+	Signature     string             `json:"signature"`
+}
+
+// AuditLogJSON encodes an entry as a single line of JSON
+func AuditLogJSON(entry *models.UserLogs) ([]byte, error) {
+	return json.Marshal(auditLogRecord{
+		Sequence:      entry.Sequence,
+		CreatedAt:     entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		UUID:          entry.UUID,
+		Action:        entry.Action,
+		Name:          entry.Name,
+		Outcome:       entry.Outcome,
+		UserUUID:      entry.UserUUID,
+		DeviceUUID:    entry.DeviceUUID,
+		DeviceID:      entry.DeviceID,
+		EntityType:    entry.EntityType,
+		EntityID:      entry.EntityID,
+		IPAddress:     entry.IPAddress,
+		UserAgent:     entry.UserAgent,
+		RequestID:     entry.RequestID,
+		Description:   entry.Description,
+		Payload:       entry.Payload,
+		PrevSignature: entry.PrevSignature,
+		Signature:     entry.Signature,
+	})
+}
+
+// Syslog facility "log audit" (13) and the severities used for audit entries
+const (
+	syslogFacilityLogAudit = 13
+	syslogSeverityWarning  = 4
+	syslogSeverityInfo     = 6
+
+	// Private enterprise number placeholder used for the structured data ID
+	syslogSDID = "certikiosk@32473"
+
+	// RFC 5424 allows at most six fractional digits
+	syslogTimestamp = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// AuditLogSyslogMessage formats an entry as an RFC 5424 syslog message. The
+// structured data carries the searchable fields, the message the full JSON.
+func AuditLogSyslogMessage(entry *models.UserLogs, appName string) ([]byte, error) {
+	body, err := AuditLogJSON(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	severity := syslogSeverityInfo
+	if entry.Outcome == models.LogOutcomeFailure {
+		severity = syslogSeverityWarning
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	sequence := ""
+	if entry.Sequence != nil {
+		sequence = strconv.FormatInt(*entry.Sequence, 10)
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, param := range [][2]string{
+		{"seq", sequence},
+		{"uuid", entry.UUID},
+		{"outcome", entry.Outcome},
+		{"user", entry.UserUUID},
+		{"device", entry.DeviceID},
+		{"entity_type", entry.EntityType},
+		{"entity_id", entry.EntityID},
+		{"ip", entry.IPAddress},
+		{"request_id", entry.RequestID},
+	} {
+		if param[1] != "" {
+			fmt.Fprintf(&sd, " %s=\"%s\"", param[0], syslogEscape(param[1]))
+		}
+	}
+	sd.WriteString("]")
+
+	msgID := syslogToken(entry.Action, 32)
+
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		syslogFacilityLogAudit*8+severity,
+		entry.CreatedAt.UTC().Format(syslogTimestamp),
+		syslogToken(hostname, 255),
+		syslogToken(appName, 48),
+		os.Getpid(),
+		msgID,
+		sd.String(),
+		body,
+	)), nil
+}
+
+// syslogEscape escapes a structured data parameter value
+func syslogEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// syslogToken makes a header field printable ASCII without spaces, "-" when empty
+func syslogToken(value string, maxLength int) string {
+	token := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(token) > maxLength {
+		token = token[:maxLength]
+	}
+	if token == "" {
+		return "-"
+	}
+	return token
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The audit forwarder ships every chained audit entry to an external collector
+// (SIEM). It tails the audit log by sequence and keeps its position in the
+// database, so the audit table itself is the buffer: when the collector is
+// down entries wait there and are sent, in order, once it is reachable again.
+//
+//	AUDIT_FORWARD_URL         syslog+tcp://host:514, syslog+udp://host:514,
+//	                          syslog+tls://host:6514 or an http(s):// endpoint
+//	AUDIT_FORWARD_TOKEN       bearer token sent to HTTP collectors
+//	AUDIT_FORWARD_APP_NAME    syslog APP-NAME (default certikiosk)
+//	AUDIT_FORWARD_BATCH_SIZE  entries per batch (default 100)
+//	AUDIT_FORWARD_INTERVAL    polling interval when idle (default 5s)
+//	AUDIT_FORWARD_RETRY_MAX   longest wait between retries (default 5m)
+//	AUDIT_FORWARD_BACKFILL    ship the existing log to a new collector (default false)
+
+// AuditSink delivers a batch of audit entries to a collector
+type AuditSink interface {
+	Send(entries []models.UserLogs) error
+}
+
+// AuditForwarder ships the audit log to one collector
+type AuditForwarder struct {
+	db           *gorm.DB
+	sink         AuditSink
+	name         string
+	batchSize    int
+	interval     time.Duration
+	retryMax     time.Duration
+	backfill     bool
+	wake         chan struct{}
+	failingSince *time.Time
+}
+
+var (
+	auditForwarderMu sync.Mutex
+	auditForwarder   *AuditForwarder
+)
+
+const auditSinkTimeout = 10 * time.Second
+
+// StartAuditForwarder starts forwarding when AUDIT_FORWARD_URL is set. It
+// returns nil without error when forwarding is not configured.
+func StartAuditForwarder(db *gorm.DB) (*AuditForwarder, error) {
+	rawURL := Env("AUDIT_FORWARD_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUDIT_FORWARD_URL: %w", err)
+	}
+
+	appName := Env("AUDIT_FORWARD_APP_NAME")
+	if appName == "" {
+		appName = "certikiosk"
+	}
+
+	var sink AuditSink
+	switch target.Scheme {
+	case "syslog+tcp", "syslog+udp", "syslog+tls":
+		if target.Port() == "" {
+			return nil, fmt.Errorf("AUDIT_FORWARD_URL must include the collector port")
+		}
+		sink = &syslogSink{transport: target.Scheme[len("syslog+"):], address: target.Host, appName: appName}
+	case "http", "https":
+		sink = &httpSink{url: rawURL, token: Env("AUDIT_FORWARD_TOKEN"), client: &http.Client{Timeout: auditSinkTimeout}}
+	default:
+		return nil, fmt.Errorf("unsupported AUDIT_FORWARD_URL scheme %q", target.Scheme)
+	}
+
+	// The cursor is named after the collector, credentials left out
+	name := target.Scheme + "://" + target.Host + target.Path
+	if len(name) > 100 {
+		name = name[:100]
+	}
+
+	forwarder := &AuditForwarder{
+		db:        db,
+		sink:      sink,
+		name:      name,
+		batchSize: envInt("AUDIT_FORWARD_BATCH_SIZE", 100),
+		interval:  envDuration("AUDIT_FORWARD_INTERVAL", 5*time.Second),
+		retryMax:  envDuration("AUDIT_FORWARD_RETRY_MAX", 5*time.Minute),
+		backfill:  envBool("AUDIT_FORWARD_BACKFILL", false),
+		wake:      make(chan struct{}, 1),
+	}
+	if forwarder.batchSize <= 0 {
+		forwarder.batchSize = 100
+	}
+
+	auditForwarderMu.Lock()
+	auditForwarder = forwarder
+	auditForwarderMu.Unlock()
+
+	go forwarder.run()
+
+	return forwarder, nil
+}
+
+// Name identifies the collector the forwarder ships to
+func (f *AuditForwarder) Name() string {
+	return f.name
+}
+
+// notifyAuditForwarder wakes the forwarder after a new entry is stored
+func notifyAuditForwarder() {
+	auditForwarderMu.Lock()
+	forwarder := auditForwarder
+	auditForwarderMu.Unlock()
+
+	if forwarder == nil {
+		return
+	}
+	select {
+	case forwarder.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (f *AuditForwarder) run() {
+	retry := time.Second
+
+	for {
+		sent, err := f.forwardBatch()
+		if err != nil {
+			if f.failingSince == nil {
+				now := time.Now()
+				f.failingSince = &now
+				log.Printf("[warn] audit forwarder: %s unreachable, entries are kept until it recovers: %v", f.name, err)
+			}
+
+			time.Sleep(retry)
+			retry *= 2
+			if retry > f.retryMax {
+				retry = f.retryMax
+			}
+			continue
+		}
+
+		if f.failingSince != nil {
+			log.Printf("[info] audit forwarder: %s reachable again after %s", f.name, time.Since(*f.failingSince).Round(time.Second))
+			f.failingSince = nil
+		}
+		retry = time.Second
+
+		// A full batch means more entries are waiting
+		if sent == f.batchSize {
+			continue
+		}
+
+		select {
+		case <-f.wake:
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// forwardBatch sends the next entries after the cursor and moves the cursor
+// once the collector accepted them. The cursor row stays locked while sending
+// so several API instances never ship the same entries twice.
+func (f *AuditForwarder) forwardBatch() (int, error) {
+	sent := 0
+
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		cursor := models.AuditForwardCursor{Name: f.name, UpdatedAt: time.Now()}
+		if !f.backfill {
+			// A new collector starts with the entries written from now on
+			head, err := chainHead(tx)
+			if err != nil {
+				return err
+			}
+			if head != nil {
+				cursor.Sequence = *head.Sequence
+			}
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&cursor).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", f.name).First(&cursor).Error; err != nil {
+			return err
+		}
+
+		var entries []models.UserLogs
+		if err := tx.Where("sequence > ?", cursor.Sequence).Order("sequence ASC").Limit(f.batchSize).Find(&entries).Error; err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		if err := f.sink.Send(entries); err != nil {
+			return err
+		}
+
+		sent = len(entries)
+		return tx.Model(&models.AuditForwardCursor{}).Where("name = ?", f.name).Updates(map[string]interface{}{
+			"sequence":   *entries[len(entries)-1].Sequence,
+			"updated_at": time.Now(),
+		}).Error
+	})
+
+	return sent, err
+}
+
+// syslogSink sends RFC 5424 messages, framed with octet counting (RFC 6587) on
+// TCP and TLS, one message per datagram on UDP
+type syslogSink struct {
+	transport string
+	address   string
+	appName   string
+	conn      net.Conn
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: auditSinkTimeout}
+	switch s.transport {
+	case "tls":
+		return tls.DialWithDialer(dialer, "tcp", s.address, &tls.Config{MinVersion: tls.VersionTLS12})
+	default:
+		return dialer.Dial(s.transport, s.address)
+	}
+}
+
+func (s *syslogSink) Send(entries []models.UserLogs) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	var buf bytes.Buffer
+	for i := range entries {
+		message, err := AuditLogSyslogMessage(&entries[i], s.appName)
+		if err != nil {
+			return err
+		}
+
+		if s.transport == "udp" {
+			if err := s.write(message); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %s", len(message), message)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+	return s.write(buf.Bytes())
+}
+
+// write drops the connection on failure so the next attempt reconnects
+func (s *syslogSink) write(data []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(auditSinkTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// httpSink posts batches as JSON Lines, any 2xx answer acknowledges the batch
+type httpSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *httpSink) Send(entries []models.UserLogs) error {
+	var body bytes.Buffer
+	for i := range entries {
+		line, err := AuditLogJSON(&entries[i])
+		if err != nil {
+			return err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("collector answered " + resp.Status)
+	}
+	return nil
+}
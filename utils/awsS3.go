@@ -1,110 +1,434 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// S3Config holds configuration for AWS S3
+// S3Config holds configuration for AWS S3 and S3-compatible stores (MinIO, Ceph, ...)
 type S3Config struct {
+	Endpoint        string // S3_ENDPOINT, e.g. http://localhost:9000, empty for AWS
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	SessionToken    string
 	BucketName      string
+	PathStyle       bool // S3_FORCE_PATH_STYLE, default true with a custom endpoint
 }
 
 // GetS3Config retrieves S3 configuration from environment variables
 func GetS3Config() *S3Config {
+	endpoint := Env("S3_ENDPOINT")
+
 	return &S3Config{
+		Endpoint:        endpoint,
 		Region:          Env("AWS_REGION"),
 		AccessKeyID:     Env("AWS_ACCESS_KEY_ID"),
 		SecretAccessKey: Env("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    Env("AWS_SESSION_TOKEN"),
 		BucketName:      Env("AWS_S3_BUCKET_NAME"),
+		PathStyle:       envBool("S3_FORCE_PATH_STYLE", endpoint != ""),
+	}
+}
+
+// S3Storage talks to the S3 REST API directly, requests are signed with AWS
+// Signature Version 4
+type S3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+}
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+// NewS3Storage checks the configuration and returns an S3 backend
+func NewS3Storage(config *S3Config) (*S3Storage, error) {
+	if config.BucketName == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 storage needs AWS_S3_BUCKET_NAME, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	rawEndpoint := config.Endpoint
+	if rawEndpoint == "" {
+		rawEndpoint = "https://s3." + region + ".amazonaws.com"
 	}
+	endpoint, err := url.Parse(strings.TrimRight(rawEndpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", config.Endpoint)
+	}
+
+	return &S3Storage{
+		endpoint:     endpoint,
+		bucket:       config.BucketName,
+		region:       region,
+		accessKey:    config.AccessKeyID,
+		secretKey:    config.SecretAccessKey,
+		sessionToken: config.SessionToken,
+		pathStyle:    config.PathStyle,
+		client:       &http.Client{Timeout: 5 * time.Minute},
+	}, nil
 }
 
-// Note: This is a placeholder implementation for AWS S3 integration
-// To use this functionality, you need to:
-// 1. Install AWS SDK: go get github.com/aws/aws-sdk-go
-// 2. Configure AWS credentials (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY)
-// 3. Set AWS_REGION and AWS_S3_BUCKET_NAME in your environment
-// 4. Uncomment the actual implementation below
+// objectURL builds the URL of a key, or of the bucket when key is empty
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	escaped := "/" + s3Escape(key, false)
+	if s.pathStyle {
+		escaped = s.endpoint.Path + "/" + s3Escape(s.bucket, true)
+		if key != "" {
+			escaped += "/" + s3Escape(key, false)
+		}
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		escaped = s.endpoint.Path + escaped
+	}
 
-/*
-// GetS3Session creates a new AWS S3 session
-func GetS3Session() (*session.Session, error) {
-	config := GetS3Config()
+	u.Path, _ = url.PathUnescape(escaped)
+	u.RawPath = escaped
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
 
-	if config.Region == "" {
-		config.Region = "us-east-1" // Default region
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	if size < 0 {
+		// S3 needs the length up front
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+		size = int64(len(data))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(config.Region),
-		Credentials: credentials.NewStaticCredentials(
-			config.AccessKeyID,
-			config.SecretAccessKey,
-			"", // Token (optional)
-		),
-	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key, nil).String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
 
+	resp, err := s.do(req, s3UnsignedPayload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+		return nil, err
 	}
+	resp.Body.Close()
 
-	return sess, nil
+	return &ObjectInfo{
+		Key:         key,
+		Name:        path.Base(key),
+		Size:        size,
+		ContentType: contentType,
+		ModTime:     time.Now(),
+		ETag:        strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
 }
-*/
 
-// DownloadFileFromS3 downloads a file from S3 (placeholder)
-func DownloadFileFromS3(key string) ([]byte, error) {
-	// TODO: Implement actual S3 download
-	return nil, fmt.Errorf("AWS S3 integration not configured. Install aws-sdk-go and set up credentials")
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp.Body, s3ObjectInfo(key, resp.Header), nil
 }
 
-// UploadFileToS3 uploads a file to S3 (placeholder)
-func UploadFileToS3(key string, data []byte, contentType string) (string, error) {
-	// TODO: Implement actual S3 upload
-	return "", fmt.Errorf("AWS S3 integration not configured")
+func (s *S3Storage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return s3ObjectInfo(key, resp.Header), nil
 }
 
-// GetS3FileURL generates a URL for an S3 file
-func GetS3FileURL(key string) string {
-	config := GetS3Config()
-	region := config.Region
-	if region == "" {
-		region = "us-east-1"
+// Delete removes an object, S3 does not report missing keys
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key, nil).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", config.BucketName, region, key)
+	resp.Body.Close()
+	return nil
 }
 
-// GetS3Object retrieves an object from S3 (placeholder)
-func GetS3Object(key string) ([]byte, error) {
-	// TODO: Implement actual S3 object retrieval
-	return nil, fmt.Errorf("AWS S3 integration not configured")
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
 }
 
-// ListS3Objects lists objects in an S3 bucket (placeholder)
-func ListS3Objects(prefix string) ([]string, error) {
-	// TODO: Implement actual S3 listing
-	return nil, fmt.Errorf("AWS S3 integration not configured")
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL("", query).String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req, s3EmptyPayload)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 list response: %v", err)
+		}
+
+		for _, item := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     item.Key,
+				Name:    path.Base(item.Key),
+				Size:    item.Size,
+				ModTime: item.LastModified,
+				ETag:    strings.Trim(item.ETag, `"`),
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET URL valid for ttl (at most 7 days)
+func (s *S3Storage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	if ttl <= 0 || ttl > 7*24*time.Hour {
+		return "", fmt.Errorf("signed URL lifetime must be between 1s and 7 days")
+	}
+	return s.presign(key, ttl, time.Now().UTC()), nil
+}
+
+// presign builds the query-string signed GET URL of a key at a given time
+func (s *S3Storage) presign(key string, ttl time.Duration, now time.Time) string {
+	scope := s.scope(now)
+
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if s.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	u := s.objectURL(key, query)
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, scope, canonical)
+	return u.String()
+}
+
+// do signs and sends a request, non 2xx answers become errors
+func (s *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrObjectNotFound
+	}
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("S3 %s: %s", s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("S3 request failed: %s", resp.Status)
+}
+
+// sign adds the SigV4 headers of a request made at now
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	scope := s.scope(now)
+
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, s.signature(now, scope, canonical)))
 }
 
-// DeleteS3Object deletes an object from S3 (placeholder)
-func DeleteS3Object(key string) error {
-	// TODO: Implement actual S3 deletion
-	return fmt.Errorf("AWS S3 integration not configured")
+func (s *S3Storage) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
 }
 
-// CheckS3ObjectExists checks if an object exists in S3 (placeholder)
-func CheckS3ObjectExists(key string) (bool, error) {
-	// TODO: Implement actual existence check
-	return false, fmt.Errorf("AWS S3 integration not configured")
+// signature derives the day's signing key and signs the canonical request
+func (s *S3Storage) signature(now time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(s3TimeFormat) + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := s3HMAC([]byte("AWS4"+s.secretKey), now.Format("20060102"))
+	key = s3HMAC(key, s.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
 }
 
-// GetS3FileInfo returns basic file information
-func GetS3FileInfo(key string) map[string]string {
-	return map[string]string{
-		"key": key,
-		"url": GetS3FileURL(key),
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as
+// SigV4 requires; slashes are kept in object keys
+func s3Escape(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes a query sorted by name, the form SigV4 signs
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3ObjectInfo(key string, header http.Header) *ObjectInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+
+	return &ObjectInfo{
+		Key:         key,
+		Name:        path.Base(key),
+		Size:        size,
+		ContentType: header.Get("Content-Type"),
+		ModTime:     modTime,
+		ETag:        strings.Trim(header.Get("ETag"), `"`),
 	}
 }
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Danny19977/certikiosk.git/models"
+)
+
+// Biometric templates use envelope encryption: every template is sealed with its
+// own AES-256-GCM data key, and the data key is wrapped with the master key.
+// Rotating the master key only re-wraps the data keys, templates stay untouched.
+//
+// BIOMETRIC_MASTER_KEY / BIOMETRIC_MASTER_KEY_FILE hold the current master key
+// (32 bytes, base64 or hex). BIOMETRIC_PREVIOUS_MASTER_KEYS and
+// BIOMETRIC_PREVIOUS_MASTER_KEY_FILES (comma separated) keep retired keys
+// available for decryption until every record has been re-wrapped.
+
+// SealFingerprint encrypts a template into the record with the current master key
+func SealFingerprint(fingerprint *models.Fingerprint, template string) error {
+	keyring, err := GetBiometricKeyring()
+	if err != nil {
+		return err
+	}
+	return keyring.SealFingerprint(fingerprint, template)
+}
+
+// OpenFingerprint returns the decrypted base64 template of a record
+func OpenFingerprint(fingerprint models.Fingerprint) (string, error) {
+	keyring, err := GetBiometricKeyring()
+	if err != nil {
+		return "", err
+	}
+	return keyring.OpenFingerprint(fingerprint)
+}
+
+// BiometricKeyring holds the current master key and the retired ones by key ID
+type BiometricKeyring struct {
+	CurrentKeyID string
+	keys         map[string][]byte
+}
+
+var (
+	biometricKeyringOnce sync.Once
+	biometricKeyring     *BiometricKeyring
+	biometricKeyringErr  error
+)
+
+// GetBiometricKeyring loads the master keys once from the environment
+func GetBiometricKeyring() (*BiometricKeyring, error) {
+	biometricKeyringOnce.Do(func() {
+		biometricKeyring, biometricKeyringErr = loadBiometricKeyring()
+	})
+	return biometricKeyring, biometricKeyringErr
+}
+
+func loadBiometricKeyring() (*BiometricKeyring, error) {
+	current, err := readMasterKey(Env("BIOMETRIC_MASTER_KEY"), Env("BIOMETRIC_MASTER_KEY_FILE"))
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("biometric master key is not configured")
+	}
+
+	keyring := &BiometricKeyring{
+		CurrentKeyID: masterKeyID(current),
+		keys:         map[string][]byte{},
+	}
+	keyring.keys[keyring.CurrentKeyID] = current
+
+	for _, value := range splitList(Env("BIOMETRIC_PREVIOUS_MASTER_KEYS")) {
+		key, err := readMasterKey(value, "")
+		if err != nil {
+			return nil, fmt.Errorf("previous master key: %v", err)
+		}
+		keyring.keys[masterKeyID(key)] = key
+	}
+	for _, file := range splitList(Env("BIOMETRIC_PREVIOUS_MASTER_KEY_FILES")) {
+		key, err := readMasterKey("", file)
+		if err != nil {
+			return nil, fmt.Errorf("previous master key: %v", err)
+		}
+		keyring.keys[masterKeyID(key)] = key
+	}
+
+	return keyring, nil
+}
+
+// readMasterKey decodes a 32 byte key given inline or in a file, nil when neither is set
+func readMasterKey(value, file string) ([]byte, error) {
+	if value == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %v", err)
+		}
+		value = string(data)
+	}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(value)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes encoded in base64 or hex")
+	}
+	return key, nil
+}
+
+// masterKeyID identifies a master key without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// KeyIDs returns the identifiers of every loaded master key
+func (k *BiometricKeyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SealFingerprint encrypts a base64 template into the enrollment record.
+// The record UUID and citizen are bound as additional data so ciphertexts
+// cannot be moved between records.
+func (k *BiometricKeyring) SealFingerprint(fingerprint *models.Fingerprint, template string) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+
+	ciphertext, err := gcmSeal(dataKey, []byte(template), fingerprintAAD(fingerprint))
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := gcmSeal(k.keys[k.CurrentKeyID], dataKey, []byte(k.CurrentKeyID))
+	if err != nil {
+		return err
+	}
+
+	fingerprint.FingerprintData = base64.StdEncoding.EncodeToString(ciphertext)
+	fingerprint.WrappedDataKey = base64.StdEncoding.EncodeToString(wrappedKey)
+	fingerprint.KeyID = k.CurrentKeyID
+	return nil
+}
+
+// OpenFingerprint decrypts the base64 template of an enrollment record
+func (k *BiometricKeyring) OpenFingerprint(fingerprint models.Fingerprint) (string, error) {
+	dataKey, err := k.unwrapDataKey(fingerprint)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(fingerprint.FingerprintData)
+	if err != nil {
+		return "", fmt.Errorf("fingerprint ciphertext is corrupted")
+	}
+	template, err := gcmOpen(dataKey, ciphertext, fingerprintAAD(&fingerprint))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt fingerprint %s: %v", fingerprint.UUID, err)
+	}
+	return string(template), nil
+}
+
+// RewrapFingerprint re-wraps the data key of a record with the current master key.
+// It returns false when the record is already wrapped with the current key.
+func (k *BiometricKeyring) RewrapFingerprint(fingerprint *models.Fingerprint) (bool, error) {
+	if fingerprint.KeyID == k.CurrentKeyID {
+		return false, nil
+	}
+
+	dataKey, err := k.unwrapDataKey(*fingerprint)
+	if err != nil {
+		return false, err
+	}
+	wrappedKey, err := gcmSeal(k.keys[k.CurrentKeyID], dataKey, []byte(k.CurrentKeyID))
+	if err != nil {
+		return false, err
+	}
+
+	fingerprint.WrappedDataKey = base64.StdEncoding.EncodeToString(wrappedKey)
+	fingerprint.KeyID = k.CurrentKeyID
+	return true, nil
+}
+
+func (k *BiometricKeyring) unwrapDataKey(fingerprint models.Fingerprint) ([]byte, error) {
+	masterKey, ok := k.keys[fingerprint.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not available", fingerprint.KeyID)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(fingerprint.WrappedDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped data key is corrupted")
+	}
+	dataKey, err := gcmOpen(masterKey, wrappedKey, []byte(fingerprint.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	return dataKey, nil
+}
+
+func fingerprintAAD(fingerprint *models.Fingerprint) []byte {
+	return []byte(fingerprint.UUID + "|" + fingerprint.CitizensUUID)
+}
+
+// gcmSeal returns nonce || ciphertext
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(key, sealed, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
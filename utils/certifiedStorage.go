@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+)
+
+// CertifiedStoragePrefix is the key prefix of stamped certified documents in the storage backend
+const CertifiedStoragePrefix = "certified/"
+
+// SaveCertifiedDocument stores a certified document in the configured backend
+// and returns the key the backend gave it (a file ID on Google Drive) with the
+// backend name, both are needed to read it back
+func SaveCertifiedDocument(name string, data []byte) (key, backend string, err error) {
+	backend = StorageBackendName()
+	store, err := OpenStorage(backend)
+	if err != nil {
+		return "", "", err
+	}
+
+	info, err := store.Put(context.Background(), CertifiedStoragePrefix+path.Base(name), bytes.NewReader(data), int64(len(data)), "application/pdf")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store certified document: %v", err)
+	}
+
+	return info.Key, backend, nil
+}
+
+// ReadCertifiedDocument reads a certified document by its storage key from
+// the backend it was saved to, the configured one when backend is empty
+func ReadCertifiedDocument(backend, key string) ([]byte, error) {
+	if key == "" {
+		return nil, fmt.Errorf("certified document key is empty")
+	}
+
+	store, err := OpenStorage(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ReadObject(context.Background(), store, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certified document: %v", err)
+	}
+
+	return data, nil
+}
+
+// HashSHA256 returns the hex encoded SHA-256 digest of data
+func HashSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
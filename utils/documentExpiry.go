@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Expiry statuses reported for documents
+const (
+	DocumentValid        = "valid"
+	DocumentExpiringSoon = "expiring_soon"
+	DocumentExpired      = "expired"
+	DocumentNoExpiry     = "no_expiry"
+)
+
+// DocumentExpiry describes when a document stops being valid
+type DocumentExpiry struct {
+	ExpiryDate *time.Time `json:"expiry_date"`
+	Status     string     `json:"status"`
+	DaysLeft   *int       `json:"days_left"` // Negative once expired, nil without expiry
+}
+
+// GetDocumentExpiryWarningPeriod returns how long before expiry a document is
+// reported as expiring soon, DOCUMENT_EXPIRY_WARNING_DAYS (default 30)
+func GetDocumentExpiryWarningPeriod() time.Duration {
+	return time.Duration(envInt("DOCUMENT_EXPIRY_WARNING_DAYS", 30)) * 24 * time.Hour
+}
+
+// DocumentExpiryDate returns the explicit expiry date of a document, or its
+// issue date plus the validity of its type. Nil when the document does not expire.
+func DocumentExpiryDate(document *models.Documents, documentType *models.DocumentType) *time.Time {
+	if document.ExpiryDate != nil {
+		return document.ExpiryDate
+	}
+	if documentType == nil || documentType.ValidityDays <= 0 || document.IssueDate.IsZero() {
+		return nil
+	}
+	expiry := document.IssueDate.AddDate(0, 0, documentType.ValidityDays)
+	return &expiry
+}
+
+// GetDocumentExpiry reports the expiry status of a document at a given time
+func GetDocumentExpiry(document *models.Documents, documentType *models.DocumentType, now time.Time) DocumentExpiry {
+	expiryDate := DocumentExpiryDate(document, documentType)
+	if expiryDate == nil {
+		return DocumentExpiry{Status: DocumentNoExpiry}
+	}
+
+	daysLeft := int(expiryDate.Sub(now).Hours() / 24)
+	expiry := DocumentExpiry{ExpiryDate: expiryDate, DaysLeft: &daysLeft}
+
+	switch {
+	case !now.Before(*expiryDate):
+		expiry.Status = DocumentExpired
+	case expiryDate.Sub(now) <= GetDocumentExpiryWarningPeriod():
+		expiry.Status = DocumentExpiringSoon
+	default:
+		expiry.Status = DocumentValid
+	}
+	return expiry
+}
+
+// ParseExpiryDate reads a YYYY-MM-DD expiry date, nil when empty
+func ParseExpiryDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	expiry, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expiry date %q, expected YYYY-MM-DD", value)
+	}
+	return &expiry, nil
+}
+
+// RenewDocumentExpiry starts the validity of a re-issued document over, run it
+// after AddDocumentVersion in the same transaction. The explicit expiry date of
+// the previous issue is replaced by expiryDate (nil follows the validity of the
+// document type). A document deactivated by the expiry job is reactivated when
+// the new issue is valid and reactivate is set; a new issue that is already
+// expired leaves the document inactive. Documents deactivated by hand are not
+// reactivated.
+func RenewDocumentExpiry(tx *gorm.DB, document *models.Documents, expiryDate *time.Time, reactivate bool, now time.Time) error {
+	document.ExpiryDate = expiryDate
+
+	documentType, _ := GetDocumentType(tx, document.DocumentType)
+	if GetDocumentExpiry(document, documentType, now).Status == DocumentExpired {
+		document.IsActive = false
+		if document.ExpiredAt == nil {
+			document.ExpiredAt = &now
+		}
+	} else if document.ExpiredAt != nil && reactivate {
+		document.IsActive = true
+		document.ExpiredAt = nil
+	}
+
+	return tx.Model(&models.Documents{}).Where("uuid = ?", document.UUID).Updates(map[string]interface{}{
+		"expiry_date": document.ExpiryDate,
+		"expired_at":  document.ExpiredAt,
+		"is_active":   document.IsActive,
+	}).Error
+}
+
+// StartDocumentExpiryJob deactivates expired documents in the background every
+// DOCUMENT_EXPIRY_INTERVAL (default 1h). Disabled with DOCUMENT_EXPIRY_JOB=false.
+func StartDocumentExpiryJob(db *gorm.DB) bool {
+	if !envBool("DOCUMENT_EXPIRY_JOB", true) {
+		return false
+	}
+
+	interval := envDuration("DOCUMENT_EXPIRY_INTERVAL", time.Hour)
+	go func() {
+		for {
+			if expired, err := ExpireDocuments(db, time.Now()); err != nil {
+				log.Printf("[error] document expiry: %v", err)
+			} else if expired > 0 {
+				log.Printf("[info] deactivated %d expired document(s)", expired)
+			}
+			time.Sleep(interval)
+		}
+	}()
+	return true
+}
+
+// ExpireDocuments deactivates the active documents whose expiry date has
+// passed and notifies the staff member who registered them and the staff
+// managing documents. Citizens have no e-mail on record and cannot be reached,
+// staff are given their phone to contact them. Each document is claimed with
+// SKIP LOCKED so several API instances can run the job.
+func ExpireDocuments(db *gorm.DB, now time.Time) (int, error) {
+	var candidates []string
+	err := db.Model(&models.Documents{}).
+		Joins("LEFT JOIN document_types ON document_types.code = documents.document_type").
+		Where("documents.is_active = ?", true).
+		Where("documents.expiry_date <= ? OR (documents.expiry_date IS NULL AND document_types.validity_days > 0 AND documents.issue_date + document_types.validity_days * INTERVAL '1 day' <= ?)", now, now).
+		Pluck("documents.uuid", &candidates).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired documents: %v", err)
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	staff, err := documentStaff(db)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, documentUUID := range candidates {
+		var document models.Documents
+		var registrar *models.User
+		var citizen models.Citizens
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("uuid = ? AND is_active = ?", documentUUID, true).
+				First(&document).Error
+			if err != nil {
+				return err
+			}
+
+			documentType, _ := GetDocumentType(tx, document.DocumentType)
+			expiry := GetDocumentExpiry(&document, documentType, now)
+			if expiry.Status != DocumentExpired {
+				return gorm.ErrRecordNotFound
+			}
+
+			if err := tx.Model(&document).Updates(map[string]interface{}{
+				"is_active":  false,
+				"expired_at": now,
+				"updated_at": now,
+			}).Error; err != nil {
+				return err
+			}
+
+			label := document.DocumentType
+			if documentType != nil {
+				label = documentType.Name(models.DefaultDocumentLanguage)
+			}
+			message := fmt.Sprintf("The %s document %s of national ID %d expired on %s and has been deactivated.",
+				label, document.UUID, document.NationalID, expiry.ExpiryDate.Format("2006-01-02"))
+			if err := tx.Where("national_id = ?", document.NationalID).First(&citizen).Error; err == nil {
+				message += fmt.Sprintf(" The citizen %s %s was not notified, contact them at %s to have it renewed.",
+					citizen.FirstName, citizen.LastName, citizen.Phone)
+			} else {
+				message += " No citizen is registered with this national ID."
+			}
+
+			recipients := staff
+			if document.UserUUID != "" {
+				var user models.User
+				if err := tx.Where("uuid = ?", document.UserUUID).First(&user).Error; err == nil {
+					registrar = &user
+					recipients = append([]models.User{user}, staff...)
+				}
+			}
+
+			notified := map[string]bool{}
+			for _, recipient := range recipients {
+				if notified[recipient.UUID] {
+					continue
+				}
+				notified[recipient.UUID] = true
+
+				notification := models.Notification{
+					UUID:      GenerateUUID(),
+					Name:      fmt.Sprintf("document_expired_%s_%s_%d", document.UUID, recipient.UUID, now.Unix()),
+					Message:   message,
+					Type:      "warning",
+					Status:    "unread",
+					UserUUID:  recipient.UUID,
+					CreatedAt: now,
+					UpdatedAt: now,
+				}
+				if err := tx.Create(&notification).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == gorm.ErrRecordNotFound {
+			continue // already handled elsewhere, reactivated or no longer expired
+		}
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire document %s: %v", documentUUID, err)
+		}
+		expired++
+		log.Printf("[info] document %s expired, the citizen of national ID %d has no e-mail on record and was not notified",
+			document.UUID, document.NationalID)
+
+		// The staff member who registered the document is also told by mail, to contact the citizen
+		if registrar != nil && registrar.Email != "" && ValidateEmailConfig() == nil {
+			contact := "No citizen is registered with this national ID."
+			if citizen.Phone != "" {
+				contact = fmt.Sprintf("The citizen %s %s could not be notified by CertiKiosk, please contact them at %s to have it renewed.",
+					html.EscapeString(citizen.FirstName), html.EscapeString(citizen.LastName), html.EscapeString(citizen.Phone))
+			}
+			body := fmt.Sprintf("<p>Hello %s,</p><p>The document %s you registered for national ID %d has expired and can no longer be certified.</p><p>%s</p>",
+				html.EscapeString(registrar.Fullname), document.UUID, document.NationalID, contact)
+			if err := SendEmail(registrar.Email, "CertiKiosk - Registered document expired", body, nil, ""); err != nil {
+				log.Printf("[warn] failed to send expiry notice for document %s to %s: %v", document.UUID, registrar.Email, err)
+			}
+		}
+	}
+
+	return expired, nil
+}
+
+// documentStaff returns the active users allowed to manage documents
+func documentStaff(db *gorm.DB) ([]models.User, error) {
+	var users []models.User
+	if err := db.Where("status = ?", true).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to load staff: %v", err)
+	}
+
+	var staff []models.User
+	for i := range users {
+		if UserHasPermission(db, &users[i], models.PermissionDocumentsWrite) {
+			staff = append(staff, users[i])
+		}
+	}
+	return staff, nil
+}
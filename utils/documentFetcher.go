@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+)
+
+// ExtractDriveFileID extracts the file ID from a Google Drive/Docs URL.
+// Returns an empty string when the URL is not a Google Drive link.
+func ExtractDriveFileID(documentURL string) string {
+	if !strings.Contains(documentURL, "drive.google.com") && !strings.Contains(documentURL, "docs.google.com") {
+		return ""
+	}
+
+	// Example: https://drive.google.com/file/d/FILE_ID/view
+	if strings.Contains(documentURL, "/file/d/") {
+		parts := strings.Split(documentURL, "/file/d/")
+		if len(parts) > 1 {
+			return strings.Split(parts[1], "/")[0]
+		}
+	}
+
+	// Example: https://drive.google.com/uc?export=download&id=FILE_ID
+	if strings.Contains(documentURL, "id=") {
+		parts := strings.Split(documentURL, "id=")
+		if len(parts) > 1 {
+			return strings.Split(parts[1], "&")[0]
+		}
+	}
+
+	return ""
+}
+
+// FetchDocumentContent reads the file of a document, from its storage backend
+// when it has a storage key, otherwise from its data URL
+func FetchDocumentContent(ctx context.Context, document *models.Documents) ([]byte, error) {
+	return fetchStoredContent(ctx, document.StorageBackend, document.StorageKey, document.DocumentDataUrl)
+}
+
+func fetchStoredContent(ctx context.Context, backend, key, documentURL string) ([]byte, error) {
+	if key == "" {
+		return FetchDocumentData(documentURL)
+	}
+
+	store, err := OpenStorage(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ReadObject(ctx, store, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document from storage: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("stored document is empty (0 bytes)")
+	}
+
+	return data, nil
+}
+
+// documentFetchClient downloads document URLs supplied by staff. It only
+// connects to public addresses, redirects included, so a URL cannot reach
+// the internal network or the cloud metadata service.
+var documentFetchClient = &http.Client{
+	Timeout: 60 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil, // A proxy would connect on our behalf and bypass the check
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: rejectPrivateAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// rejectPrivateAddress runs on the resolved address of every connection
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("document URL resolves to a non-public address (%s)", host)
+	}
+	return nil
+}
+
+// isPublicIP reports whether an address is routable on the internet
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// Carrier-grade NAT range (RFC 6598), not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// FetchDocumentData downloads the content referenced by a document URL.
+// Google Drive links go through the Drive storage, other http(s) URLs are fetched directly.
+func FetchDocumentData(documentURL string) ([]byte, error) {
+	if documentURL == "" {
+		return nil, fmt.Errorf("document has no data URL")
+	}
+
+	if fileID := ExtractDriveFileID(documentURL); fileID != "" {
+		return ReadObject(context.Background(), GetDriveStorage(), fileID)
+	}
+
+	if !strings.HasPrefix(documentURL, "http://") && !strings.HasPrefix(documentURL, "https://") {
+		return nil, fmt.Errorf("unsupported document location: %s", documentURL)
+	}
+
+	resp, err := documentFetchClient.Get(documentURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download document: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download document: status %d", resp.StatusCode)
+	}
+
+	maxSize := GetDocumentMaxUploadSize()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document content: %v", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: the limit is %d MB", ErrDocumentTooLarge, maxSize>>20)
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("downloaded document is empty (0 bytes)")
+	}
+
+	return data, nil
+}
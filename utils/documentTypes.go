@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUnknownDocumentType is returned for codes missing from the catalogue
+	ErrUnknownDocumentType = errors.New("unknown document type")
+
+	// ErrInactiveDocumentType is returned for types that are no longer issued
+	ErrInactiveDocumentType = errors.New("document type is no longer active")
+)
+
+var (
+	documentTypeCodePattern = regexp.MustCompile(`^[a-z0-9]+(?:_[a-z0-9]+)*$`)
+	documentTypeCodeInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// ValidDocumentTypeCode reports whether a code is lowercase words joined by underscores
+func ValidDocumentTypeCode(code string) bool {
+	return len(code) <= 64 && documentTypeCodePattern.MatchString(code)
+}
+
+// DocumentTypeCode turns a free text type, e.g. "Birth Certificate", into a catalogue code
+func DocumentTypeCode(name string) string {
+	code := documentTypeCodeInvalid.ReplaceAllString(strings.ToLower(strings.TrimSpace(name)), "_")
+	code = strings.Trim(code, "_")
+	if len(code) > 64 {
+		code = strings.TrimRight(code[:64], "_")
+	}
+	if code == "" {
+		code = "document"
+	}
+	return code
+}
+
+// GetDocumentType looks a type up by code
+func GetDocumentType(db *gorm.DB, code string) (*models.DocumentType, error) {
+	var documentType models.DocumentType
+	err := db.Where("code = ?", strings.ToLower(strings.TrimSpace(code))).First(&documentType).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownDocumentType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &documentType, nil
+}
+
+// GetActiveDocumentType looks a type up by code and checks it can still be used
+func GetActiveDocumentType(db *gorm.DB, code string) (*models.DocumentType, error) {
+	documentType, err := GetDocumentType(db, code)
+	if err != nil {
+		return nil, err
+	}
+	if !documentType.IsActive {
+		return nil, ErrInactiveDocumentType
+	}
+	return documentType, nil
+}
+
+// DocumentTypeLabel returns the display name of a type code, or the text
+// itself when it is not in the catalogue ("Document" when empty)
+func DocumentTypeLabel(db *gorm.DB, code, lang string) string {
+	if strings.TrimSpace(code) == "" {
+		return "Document"
+	}
+	if documentType, err := GetDocumentType(db, code); err == nil {
+		return documentType.Name(lang)
+	}
+	return code
+}
+
+// RenderStampTemplate fills the placeholders of a document type stamp
+// template: {citizen_name}, {national_id}, {document_type},
+// {issuing_authority}, {certifier_name} and {certified_date}.
+func RenderStampTemplate(template string, documentType *models.DocumentType, info CertificationInfo) string {
+	if strings.TrimSpace(template) == "" {
+		return ""
+	}
+
+	certifiedDate := info.CertifiedDate
+	if certifiedDate.IsZero() {
+		certifiedDate = time.Now()
+	}
+
+	return strings.NewReplacer(
+		"{citizen_name}", info.CitizenName,
+		"{national_id}", info.NationalID,
+		"{document_type}", info.DocumentType,
+		"{issuing_authority}", documentType.IssuingAuthority,
+		"{certifier_name}", info.CertifierName,
+		"{certified_date}", certifiedDate.Format("2006-01-02"),
+	).Replace(template)
+}
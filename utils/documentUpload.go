@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/Danny19977/certikiosk.git/models"
+)
+
+// StoredDocument describes an uploaded file once it is in the storage backend
+type StoredDocument struct {
+	Backend     string `json:"storage_backend"`
+	Key         string `json:"storage_key"`
+	ContentType string `json:"content_type"`
+	Extension   string `json:"extension"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+var (
+	// ErrDocumentTooLarge is returned when an upload exceeds DOCUMENT_MAX_UPLOAD_SIZE
+	ErrDocumentTooLarge = errors.New("document is too large")
+
+	// ErrUnsupportedDocumentType is returned for anything but PDF, PNG and JPEG
+	ErrUnsupportedDocumentType = errors.New("unsupported document type, only PDF, PNG and JPEG files are accepted")
+
+	// ErrDocumentFormatNotAllowed is returned when the document type does not accept the file format
+	ErrDocumentFormatNotAllowed = errors.New("file format is not accepted for this document type")
+
+	// ErrInvalidDocument is returned when the content does not match its type
+	ErrInvalidDocument = errors.New("document file is damaged or invalid")
+)
+
+// GetDocumentMaxUploadSize returns the largest accepted upload in bytes,
+// DOCUMENT_MAX_UPLOAD_SIZE in megabytes (default 20)
+func GetDocumentMaxUploadSize() int64 {
+	size := envInt("DOCUMENT_MAX_UPLOAD_SIZE", 20)
+	if size <= 0 {
+		size = 20
+	}
+	return int64(size) << 20
+}
+
+// StoreDocumentUpload checks an uploaded file and streams it into the
+// configured storage under documents/<name>.<ext>. The type comes from the
+// content, never from the file name. When documentType is set, the file must
+// also be one of its allowed formats.
+func StoreDocumentUpload(ctx context.Context, file io.ReaderAt, size int64, name string, documentType *models.DocumentType) (*StoredDocument, error) {
+	if size > GetDocumentMaxUploadSize() {
+		return nil, ErrDocumentTooLarge
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: the file is empty", ErrInvalidDocument)
+	}
+
+	head := make([]byte, 512)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	extension, contentType := DetectFileType(head)
+	switch extension {
+	case "pdf":
+		if err := ValidatePDFStructure(file, size); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+		}
+	case "png", "jpg":
+		if _, _, err := image.DecodeConfig(io.NewSectionReader(file, 0, size)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+		}
+	default:
+		return nil, ErrUnsupportedDocumentType
+	}
+	if documentType != nil && !documentType.AllowsFormat(extension) {
+		return nil, fmt.Errorf("%w: %s accepts %s", ErrDocumentFormatNotAllowed, documentType.Code, documentType.AllowedFormats)
+	}
+
+	store, err := GetStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	body := io.TeeReader(io.NewSectionReader(file, 0, size), hash)
+
+	info, err := store.Put(ctx, "documents/"+name+"."+extension, body, size, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store document: %v", err)
+	}
+
+	return &StoredDocument{
+		Backend:     StorageBackendName(),
+		Key:         info.Key,
+		ContentType: contentType,
+		Extension:   extension,
+		Size:        size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+var (
+	pdfVersionPattern   = regexp.MustCompile(`^%PDF-[12]\.\d`)
+	pdfStartXrefPattern = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF`)
+	pdfXrefPattern      = regexp.MustCompile(`^\s*(?:xref\b|\d+\s+\d+\s+obj\b)`)
+	pdfRootPattern      = regexp.MustCompile(`/Root\s+\d+\s+\d+\s+R`)
+	pdfEncryptPattern   = regexp.MustCompile(`/Encrypt\b`)
+)
+
+// ValidatePDFStructure checks the skeleton of a PDF without loading it: the
+// version header, the end of file marker, a startxref pointing at a
+// cross-reference table or stream, and a trailer naming the document catalog.
+// Encrypted PDFs are refused, they cannot be stamped.
+func ValidatePDFStructure(r io.ReaderAt, size int64) error {
+	head := make([]byte, 16)
+	n, _ := r.ReadAt(head, 0)
+	if !pdfVersionPattern.Match(head[:n]) {
+		return fmt.Errorf("missing PDF version header")
+	}
+
+	tailSize := int64(4096)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := r.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return err
+	}
+	eofWindow := tail
+	if len(eofWindow) > 1024 {
+		eofWindow = eofWindow[len(eofWindow)-1024:]
+	}
+	if !bytes.Contains(eofWindow, []byte("%%EOF")) {
+		return fmt.Errorf("missing end of file marker, the file may be truncated")
+	}
+
+	matches := pdfStartXrefPattern.FindAllSubmatch(tail, -1)
+	if matches == nil {
+		return fmt.Errorf("missing startxref")
+	}
+	startXref, err := strconv.ParseInt(string(matches[len(matches)-1][1]), 10, 64)
+	if err != nil || startXref <= 0 || startXref >= size {
+		return fmt.Errorf("startxref points outside the file")
+	}
+
+	// The trailer is either right after the xref table, or the dictionary of the xref stream
+	xref := make([]byte, 64<<10)
+	n, err = r.ReadAt(xref, startXref)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	xref = xref[:n]
+	if !pdfXrefPattern.Match(xref) {
+		return fmt.Errorf("startxref does not point to a cross-reference section")
+	}
+
+	if !pdfRootPattern.Match(xref) && !pdfRootPattern.Match(tail) {
+		return fmt.Errorf("trailer has no document catalog")
+	}
+	if pdfEncryptPattern.Match(xref) || pdfEncryptPattern.Match(tail) {
+		return fmt.Errorf("encrypted PDFs are not accepted")
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrDocumentContentChanged is returned when a stored file no longer matches the hash recorded for its version
+	ErrDocumentContentChanged = errors.New("document file does not match the registered version")
+	// ErrDocumentUnreadable is returned when the file of a new version cannot be read to record its hash
+	ErrDocumentUnreadable = errors.New("document file could not be read")
+)
+
+// NewDocumentVersion builds a version from the file fields of a document
+func NewDocumentVersion(document *models.Documents, issuedBy, reason string) models.DocumentVersion {
+	return models.DocumentVersion{
+		DocumentUUID:    document.UUID,
+		DocumentDataUrl: document.DocumentDataUrl,
+		StorageBackend:  document.StorageBackend,
+		StorageKey:      document.StorageKey,
+		ContentType:     document.ContentType,
+		FileSize:        document.FileSize,
+		FileHash:        document.FileHash,
+		IssueDate:       document.IssueDate,
+		IssuedBy:        issuedBy,
+		Reason:          reason,
+	}
+}
+
+// AddDocumentVersion appends a version to a stored document and makes it the
+// current one. The document row is locked so concurrent re-issues get
+// distinct version numbers; run it inside the transaction saving the document.
+func AddDocumentVersion(tx *gorm.DB, document *models.Documents, version *models.DocumentVersion) error {
+	var locked models.Documents
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", document.UUID).First(&locked).Error; err != nil {
+		return err
+	}
+
+	var last int
+	if err := tx.Model(&models.DocumentVersion{}).Where("document_uuid = ?", document.UUID).Select("COALESCE(MAX(version), 0)").Scan(&last).Error; err != nil {
+		return err
+	}
+
+	version.UUID = GenerateUUID()
+	version.DocumentUUID = document.UUID
+	version.Version = last + 1
+	version.CreatedAt = time.Now()
+	if err := tx.Create(version).Error; err != nil {
+		return err
+	}
+
+	document.DocumentDataUrl = version.DocumentDataUrl
+	document.StorageBackend = version.StorageBackend
+	document.StorageKey = version.StorageKey
+	document.ContentType = version.ContentType
+	document.FileSize = version.FileSize
+	document.FileHash = version.FileHash
+	document.IssueDate = version.IssueDate
+	document.CurrentVersionUUID = version.UUID
+	document.CurrentVersion = version.Version
+	document.UpdatedAt = time.Now()
+
+	return tx.Model(&models.Documents{}).Where("uuid = ?", document.UUID).Updates(map[string]interface{}{
+		"document_data_url":    document.DocumentDataUrl,
+		"storage_backend":      document.StorageBackend,
+		"storage_key":          document.StorageKey,
+		"content_type":         document.ContentType,
+		"file_size":            document.FileSize,
+		"file_hash":            document.FileHash,
+		"issue_date":           document.IssueDate,
+		"current_version_uuid": document.CurrentVersionUUID,
+		"current_version":      document.CurrentVersion,
+		"updated_at":           document.UpdatedAt,
+	}).Error
+}
+
+// PinDocumentVersion reads the file of a version that was not uploaded through
+// the API (a URL or an object already in a storage backend) and records its
+// SHA-256, size and type, so a later change of the remote content is detected
+// before certification. Run it before the transaction adding the version.
+func PinDocumentVersion(ctx context.Context, version *models.DocumentVersion) error {
+	if version.FileHash != "" {
+		return nil
+	}
+
+	data, err := fetchStoredContent(ctx, version.StorageBackend, version.StorageKey, version.DocumentDataUrl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDocumentUnreadable, err)
+	}
+
+	version.FileHash = HashSHA256(data)
+	version.FileSize = int64(len(data))
+	if version.ContentType == "" {
+		_, version.ContentType = DetectFileType(data)
+	}
+	return nil
+}
+
+// CurrentDocumentVersion returns the version a document points to
+func CurrentDocumentVersion(db *gorm.DB, document *models.Documents) (*models.DocumentVersion, error) {
+	if document.CurrentVersionUUID == "" {
+		return nil, fmt.Errorf("document %s has no version", document.UUID)
+	}
+
+	var version models.DocumentVersion
+	if err := db.Where("uuid = ?", document.CurrentVersionUUID).First(&version).Error; err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// FetchDocumentVersionContent reads the file of a version and checks it
+// against the recorded hash
+func FetchDocumentVersionContent(ctx context.Context, version *models.DocumentVersion) ([]byte, error) {
+	data, err := fetchStoredContent(ctx, version.StorageBackend, version.StorageKey, version.DocumentDataUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if version.FileHash != "" && HashSHA256(data) != version.FileHash {
+		return nil, ErrDocumentContentChanged
+	}
+
+	return data, nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// Audience of the signed URLs of the Google Drive proxy
+	documentDownloadAudience = "document_download"
+	// Audience of the session opened on a kiosk by a fingerprint match
+	kioskSessionAudience = "kiosk_session"
+)
+
+var (
+	ErrDownloadTokenRequired = errors.New("a download token is required")
+	ErrDownloadTokenInvalid  = errors.New("download token is invalid or expired")
+	ErrKioskSessionRequired  = errors.New("the citizen must be identified by fingerprint first")
+	ErrKioskSessionInvalid   = errors.New("kiosk session is invalid or expired")
+	ErrDocumentNotOwned      = errors.New("document does not belong to the identified citizen")
+	ErrDocumentInactive      = errors.New("document is not active")
+	ErrDocumentNotOnDrive    = errors.New("document is not stored on Google Drive")
+	ErrDocumentNotRegistered = errors.New("file does not belong to a registered document")
+)
+
+// DownloadClaims are the claims of a document download token. Subject holds
+// the document UUID; the token is only valid on the kiosk it was issued to
+// when DeviceUUID is set.
+type DownloadClaims struct {
+	jwt.StandardClaims
+	FileID     string `json:"fid"`
+	DeviceUUID string `json:"dev,omitempty"`
+}
+
+// KioskSessionClaims are the claims of a kiosk citizen session. Subject holds
+// the citizen UUID identified by fingerprint on the DeviceUUID kiosk.
+type KioskSessionClaims struct {
+	jwt.StandardClaims
+	DeviceUUID string `json:"dev"`
+}
+
+// GetDocumentDownloadTokenTTL returns the lifetime of download URLs (DOCUMENT_DOWNLOAD_TOKEN_TTL, default 5m)
+func GetDocumentDownloadTokenTTL() time.Duration {
+	return envDuration("DOCUMENT_DOWNLOAD_TOKEN_TTL", 5*time.Minute)
+}
+
+// GetKioskSessionTTL returns how long a fingerprint match opens a kiosk session (KIOSK_SESSION_TTL, default 10m)
+func GetKioskSessionTTL() time.Duration {
+	return envDuration("KIOSK_SESSION_TTL", 10*time.Minute)
+}
+
+// KioskSessionRequired reports whether kiosks must identify the citizen by
+// fingerprint before downloading a document (KIOSK_REQUIRE_CITIZEN_SESSION, default false)
+func KioskSessionRequired() bool {
+	return envBool("KIOSK_REQUIRE_CITIZEN_SESSION", false)
+}
+
+// DocumentDriveFileID returns the Google Drive file of a document, stored on
+// the Drive backend or referenced by its data URL, empty when it has none
+func DocumentDriveFileID(document *models.Documents) string {
+	if document.StorageKey != "" {
+		backend := document.StorageBackend
+		if backend == "" {
+			backend = StorageBackendName()
+		}
+		if backend == StorageDrive {
+			return document.StorageKey
+		}
+		return ""
+	}
+	return ExtractDriveFileID(document.DocumentDataUrl)
+}
+
+// FindDocumentByDriveFileID returns the document a Google Drive file belongs to
+func FindDocumentByDriveFileID(db *gorm.DB, fileID string) (*models.Documents, error) {
+	if fileID == "" {
+		return nil, ErrDocumentNotRegistered
+	}
+
+	var candidates []models.Documents
+	db.Where("storage_key = ? OR (COALESCE(storage_key, '') = '' AND document_data_url LIKE ?)", fileID, "%"+fileID+"%").
+		Find(&candidates)
+
+	// The query is loose, keep the document whose file really is this Drive file
+	for i := range candidates {
+		if DocumentDriveFileID(&candidates[i]) == fileID {
+			return &candidates[i], nil
+		}
+	}
+	return nil, ErrDocumentNotRegistered
+}
+
+// IssueDocumentDownloadToken signs a short-lived token giving access to the
+// Google Drive file of a document, bound to the kiosk when device is not nil
+func IssueDocumentDownloadToken(document *models.Documents, device *models.KioskDevice) (string, time.Time, error) {
+	fileID := DocumentDriveFileID(document)
+	if fileID == "" {
+		return "", time.Time{}, ErrDocumentNotOnDrive
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(GetDocumentDownloadTokenTTL())
+	claims := &DownloadClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Audience:  documentDownloadAudience,
+			Subject:   document.UUID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+		FileID: fileID,
+	}
+	if device != nil {
+		claims.DeviceUUID = device.UUID
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+	return token, expiresAt, err
+}
+
+// ParseDocumentDownloadToken validates a download token and returns its claims
+func ParseDocumentDownloadToken(token string) (*DownloadClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &DownloadClaims{}, signingKey)
+	if err != nil || !parsedToken.Valid {
+		return nil, ErrDownloadTokenInvalid
+	}
+
+	claims := parsedToken.Claims.(*DownloadClaims)
+	if claims.Audience != documentDownloadAudience || claims.Subject == "" || claims.FileID == "" {
+		return nil, ErrDownloadTokenInvalid
+	}
+	return claims, nil
+}
+
+// IssueKioskSession opens a session for a citizen identified on a kiosk
+func IssueKioskSession(citizen *models.Citizens, device *models.KioskDevice) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(GetKioskSessionTTL())
+	claims := &KioskSessionClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Audience:  kioskSessionAudience,
+			Subject:   citizen.UUID.String(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+		DeviceUUID: device.UUID,
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+	return token, expiresAt, err
+}
+
+// ParseKioskSession validates a kiosk session opened on the given device
+func ParseKioskSession(token string, device *models.KioskDevice) (*KioskSessionClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &KioskSessionClaims{}, signingKey)
+	if err != nil || !parsedToken.Valid {
+		return nil, ErrKioskSessionInvalid
+	}
+
+	claims := parsedToken.Claims.(*KioskSessionClaims)
+	if claims.Audience != kioskSessionAudience || claims.Subject == "" || device == nil || claims.DeviceUUID != device.UUID {
+		return nil, ErrKioskSessionInvalid
+	}
+	return claims, nil
+}
@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/google/uuid"
+)
+
+// Supported minutiae template formats
+const (
+	TemplateFormatISO19794 = "iso-19794-2"
+	TemplateFormatANSI378  = "ansi-378"
+)
+
+// Minutia is a single ridge ending or bifurcation of a fingerprint template
+type Minutia struct {
+	X       float64 // normalized to 500 dpi pixels
+	Y       float64 // normalized to 500 dpi pixels
+	Angle   float64 // radians, counter-clockwise
+	Type    int     // 1 = ridge ending, 2 = bifurcation, 0 = other
+	Quality int
+}
+
+// FingerprintTemplate is a parsed minutiae template (first finger view only)
+type FingerprintTemplate struct {
+	Format         string
+	Width          int
+	Height         int
+	FingerPosition int
+	FingerQuality  int
+	Minutiae       []Minutia
+}
+
+// ErrFingerprintEncryption is returned when a template cannot be sealed (e.g. no master key)
+var ErrFingerprintEncryption = errors.New("failed to encrypt fingerprint")
+
+// FingerprintMatcher compares two raw templates and returns a similarity score (0-100).
+// Vendor SDKs can provide their own implementation with RegisterFingerprintMatcher.
+type FingerprintMatcher interface {
+	Name() string
+	Match(probe, candidate []byte) (float64, error)
+}
+
+// FingerprintMatchResult is returned to clients for every verification attempt
+type FingerprintMatchResult struct {
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	Matched   bool    `json:"matched"`
+	Matcher   string  `json:"matcher"`
+}
+
+var (
+	fingerprintMatchersMu sync.RWMutex
+	fingerprintMatchers   = map[string]FingerprintMatcher{
+		"minutiae": &MinutiaeMatcher{},
+	}
+)
+
+// RegisterFingerprintMatcher makes a matcher selectable through FINGERPRINT_MATCHER
+func RegisterFingerprintMatcher(name string, matcher FingerprintMatcher) {
+	fingerprintMatchersMu.Lock()
+	defer fingerprintMatchersMu.Unlock()
+	fingerprintMatchers[name] = matcher
+}
+
+// GetFingerprintMatcher returns the configured matcher (built-in "minutiae" by default)
+func GetFingerprintMatcher() (FingerprintMatcher, error) {
+	name := Env("FINGERPRINT_MATCHER")
+	if name == "" {
+		name = "minutiae"
+	}
+
+	fingerprintMatchersMu.RLock()
+	defer fingerprintMatchersMu.RUnlock()
+
+	matcher, ok := fingerprintMatchers[name]
+	if !ok {
+		return nil, fmt.Errorf("fingerprint matcher %q is not registered", name)
+	}
+	return matcher, nil
+}
+
+// GetFingerprintMatchThreshold returns the minimum score accepted as a match
+func GetFingerprintMatchThreshold() float64 {
+	threshold, err := strconv.ParseFloat(Env("FINGERPRINT_MATCH_THRESHOLD"), 64)
+	if err != nil || threshold <= 0 {
+		return 40
+	}
+	return threshold
+}
+
+// DecodeFingerprintTemplate decodes a base64 template as sent by the kiosk scanners
+func DecodeFingerprintTemplate(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	template, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		if template, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "=")); err != nil {
+			return nil, fmt.Errorf("fingerprint data must be a base64 encoded template")
+		}
+	}
+	return template, nil
+}
+
+// MatchFingerprintTemplates decodes and compares two base64 templates with the configured matcher
+func MatchFingerprintTemplates(probe, candidate string) (FingerprintMatchResult, error) {
+	result := FingerprintMatchResult{Threshold: GetFingerprintMatchThreshold()}
+
+	matcher, err := GetFingerprintMatcher()
+	if err != nil {
+		return result, err
+	}
+	result.Matcher = matcher.Name()
+
+	probeTemplate, err := DecodeFingerprintTemplate(probe)
+	if err != nil {
+		return result, err
+	}
+	candidateTemplate, err := DecodeFingerprintTemplate(candidate)
+	if err != nil {
+		return result, fmt.Errorf("stored template is invalid: %v", err)
+	}
+
+	score, err := matcher.Match(probeTemplate, candidateTemplate)
+	if err != nil {
+		return result, err
+	}
+
+	result.Score = math.Round(score*100) / 100
+	result.Matched = score >= result.Threshold
+	return result, nil
+}
+
+// NewFingerprintEnrollment validates a base64 template and builds the encrypted enrollment record.
+// Finger position, quality and format are read from the template when not provided.
+func NewFingerprintEnrollment(citizensUUID, data string, fingerPosition, quality int, deviceID string) (models.Fingerprint, error) {
+	raw, err := DecodeFingerprintTemplate(data)
+	if err != nil {
+		return models.Fingerprint{}, err
+	}
+	template, err := ParseFingerprintTemplate(raw)
+	if err != nil {
+		return models.Fingerprint{}, err
+	}
+
+	if fingerPosition == 0 {
+		fingerPosition = template.FingerPosition
+	}
+	if fingerPosition < 0 || fingerPosition > 10 {
+		return models.Fingerprint{}, fmt.Errorf("finger position must be between 0 and 10")
+	}
+	if quality == 0 {
+		quality = template.FingerQuality
+	}
+
+	now := time.Now()
+	enrollment := models.Fingerprint{
+		UUID:           uuid.New().String(),
+		CitizensUUID:   citizensUUID,
+		FingerPosition: fingerPosition,
+		TemplateFormat: template.Format,
+		Quality:        quality,
+		DeviceID:       deviceID,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := SealFingerprint(&enrollment, strings.TrimSpace(data)); err != nil {
+		return models.Fingerprint{}, fmt.Errorf("%w: %v", ErrFingerprintEncryption, err)
+	}
+
+	return enrollment, nil
+}
+
+// ParseFingerprintTemplate parses an ISO/IEC 19794-2:2005 or ANSI INCITS 378-2004 record
+func ParseFingerprintTemplate(data []byte) (*FingerprintTemplate, error) {
+	if len(data) < 24 || string(data[:4]) != "FMR\x00" {
+		return nil, fmt.Errorf("not a finger minutiae record")
+	}
+
+	var (
+		format string
+		offset int
+	)
+
+	// Both standards share the magic and version, the length field tells them apart
+	switch {
+	case int(binary.BigEndian.Uint32(data[8:12])) == len(data):
+		format = TemplateFormatISO19794
+		offset = 12
+	case int(binary.BigEndian.Uint16(data[8:10])) == len(data):
+		format = TemplateFormatANSI378
+		offset = 10 + 4 // record length + CBEFF product identifier
+	case binary.BigEndian.Uint16(data[8:10]) == 0 && len(data) >= 14 && int(binary.BigEndian.Uint32(data[10:14])) == len(data):
+		format = TemplateFormatANSI378
+		offset = 14 + 4
+	default:
+		return nil, fmt.Errorf("finger minutiae record length does not match data")
+	}
+
+	// capture equipment (2), width (2), height (2), x resolution (2), y resolution (2), views (1), reserved (1)
+	if len(data) < offset+12+4 {
+		return nil, fmt.Errorf("finger minutiae record is truncated")
+	}
+	header := data[offset:]
+	template := &FingerprintTemplate{
+		Format: format,
+		Width:  int(binary.BigEndian.Uint16(header[2:4])),
+		Height: int(binary.BigEndian.Uint16(header[4:6])),
+	}
+	resolutionX := float64(binary.BigEndian.Uint16(header[6:8]))
+	resolutionY := float64(binary.BigEndian.Uint16(header[8:10]))
+	if header[10] == 0 {
+		return nil, fmt.Errorf("finger minutiae record has no finger view")
+	}
+
+	// Resolutions are pixels per centimeter, 500 dpi is about 197 px/cm
+	scaleX, scaleY := 1.0, 1.0
+	if resolutionX > 0 {
+		scaleX = 197 / resolutionX
+	}
+	if resolutionY > 0 {
+		scaleY = 197 / resolutionY
+	}
+
+	view := header[12:]
+	template.FingerPosition = int(view[0])
+	template.FingerQuality = int(view[2])
+	minutiaeCount := int(view[3])
+	if len(view) < 4+minutiaeCount*6 {
+		return nil, fmt.Errorf("finger minutiae record is truncated")
+	}
+
+	angleUnit := 2 * math.Pi / 256 // ISO: 1.40625 degrees
+	if format == TemplateFormatANSI378 {
+		angleUnit = 2 * math.Pi / 180 // ANSI: 2 degrees
+	}
+
+	for i := 0; i < minutiaeCount; i++ {
+		m := view[4+i*6 : 4+i*6+6]
+		template.Minutiae = append(template.Minutiae, Minutia{
+			Type:    int(m[0] >> 6),
+			X:       float64(binary.BigEndian.Uint16(m[0:2])&0x3FFF) * scaleX,
+			Y:       float64(binary.BigEndian.Uint16(m[2:4])&0x3FFF) * scaleY,
+			Angle:   float64(m[4]) * angleUnit,
+			Quality: int(m[5]),
+		})
+	}
+
+	if len(template.Minutiae) == 0 {
+		return nil, fmt.Errorf("finger minutiae record contains no minutiae")
+	}
+
+	return template, nil
+}
+
+// MinutiaeMatcher is the built-in matcher: it aligns both templates with a
+// Hough transform over rotation/translation and counts paired minutiae.
+type MinutiaeMatcher struct{}
+
+// Name implements FingerprintMatcher
+func (m *MinutiaeMatcher) Name() string {
+	return "minutiae"
+}
+
+const (
+	minutiaeDistanceTolerance = 15.0        // pixels at 500 dpi
+	minutiaeAngleTolerance    = math.Pi / 9 // 20 degrees
+	minutiaeAlignmentsToTry   = 5
+)
+
+type minutiaeAlignment struct {
+	rotation float64
+	dx, dy   float64
+	votes    int
+}
+
+// Match implements FingerprintMatcher and returns a score between 0 and 100
+func (m *MinutiaeMatcher) Match(probe, candidate []byte) (float64, error) {
+	probeTemplate, err := ParseFingerprintTemplate(probe)
+	if err != nil {
+		return 0, fmt.Errorf("invalid probe template: %v", err)
+	}
+	candidateTemplate, err := ParseFingerprintTemplate(candidate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid candidate template: %v", err)
+	}
+
+	best := 0
+	for _, alignment := range findMinutiaeAlignments(probeTemplate.Minutiae, candidateTemplate.Minutiae) {
+		if paired := countPairedMinutiae(probeTemplate.Minutiae, candidateTemplate.Minutiae, alignment); paired > best {
+			best = paired
+		}
+	}
+
+	// Too few common minutiae cannot identify a finger whatever the ratio is
+	if best < 4 {
+		return 0, nil
+	}
+
+	score := 100 * float64(best*best) / float64(len(probeTemplate.Minutiae)*len(candidateTemplate.Minutiae))
+	return math.Min(score, 100), nil
+}
+
+// findMinutiaeAlignments votes for the rotations/translations mapping probe minutiae onto candidate ones
+func findMinutiaeAlignments(probe, candidate []Minutia) []minutiaeAlignment {
+	const (
+		rotationBins    = 36
+		translationStep = 10.0
+	)
+
+	type binKey struct{ r, x, y int }
+	votes := map[binKey]*minutiaeAlignment{}
+
+	for _, p := range probe {
+		for _, c := range candidate {
+			if p.Type != 0 && c.Type != 0 && p.Type != c.Type {
+				continue
+			}
+
+			rotation := normalizeAngle(c.Angle - p.Angle)
+			cos, sin := math.Cos(rotation), math.Sin(rotation)
+			dx := c.X - (p.X*cos - p.Y*sin)
+			dy := c.Y - (p.X*sin + p.Y*cos)
+
+			key := binKey{
+				r: int(rotation / (2 * math.Pi) * rotationBins),
+				x: int(math.Floor(dx / translationStep)),
+				y: int(math.Floor(dy / translationStep)),
+			}
+			if bin, ok := votes[key]; ok {
+				bin.votes++
+			} else {
+				votes[key] = &minutiaeAlignment{rotation: rotation, dx: dx, dy: dy, votes: 1}
+			}
+		}
+	}
+
+	alignments := make([]minutiaeAlignment, 0, len(votes))
+	for _, alignment := range votes {
+		alignments = append(alignments, *alignment)
+	}
+	sort.Slice(alignments, func(i, j int) bool {
+		return alignments[i].votes > alignments[j].votes
+	})
+
+	if len(alignments) > minutiaeAlignmentsToTry {
+		alignments = alignments[:minutiaeAlignmentsToTry]
+	}
+	return alignments
+}
+
+// countPairedMinutiae greedily pairs probe minutiae with candidate minutiae under an alignment
+func countPairedMinutiae(probe, candidate []Minutia, alignment minutiaeAlignment) int {
+	cos, sin := math.Cos(alignment.rotation), math.Sin(alignment.rotation)
+	used := make([]bool, len(candidate))
+	paired := 0
+
+	for _, p := range probe {
+		x := p.X*cos - p.Y*sin + alignment.dx
+		y := p.X*sin + p.Y*cos + alignment.dy
+		angle := normalizeAngle(p.Angle + alignment.rotation)
+
+		bestIndex := -1
+		bestDistance := minutiaeDistanceTolerance
+		for i, c := range candidate {
+			if used[i] {
+				continue
+			}
+			distance := math.Hypot(c.X-x, c.Y-y)
+			if distance > bestDistance {
+				continue
+			}
+			angleDiff := math.Abs(normalizeAngle(c.Angle - angle))
+			if angleDiff > math.Pi {
+				angleDiff = 2*math.Pi - angleDiff
+			}
+			if angleDiff > minutiaeAngleTolerance {
+				continue
+			}
+			bestIndex = i
+			bestDistance = distance
+		}
+
+		if bestIndex >= 0 {
+			used[bestIndex] = true
+			paired++
+		}
+	}
+
+	return paired
+}
+
+// normalizeAngle maps an angle to [0, 2π)
+func normalizeAngle(angle float64) float64 {
+	angle = math.Mod(angle, 2*math.Pi)
+	if angle < 0 {
+		angle += 2 * math.Pi
+	}
+	return angle
+}
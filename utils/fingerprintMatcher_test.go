@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// isoMinutia is a minutia as stored in an ISO/IEC 19794-2 record: pixel
+// coordinates and an angle in units of 1.40625 degrees
+type isoMinutia struct {
+	typ, x, y, angle, quality int
+}
+
+// isoTemplate encodes a single view ISO/IEC 19794-2:2005 finger minutiae record
+func isoTemplate(finger, quality int, resolution uint16, minutiae []isoMinutia) []byte {
+	record := []byte("FMR\x00 20\x00")
+	record = binary.BigEndian.AppendUint32(record, 0) // record length, set below
+	record = binary.BigEndian.AppendUint16(record, 0) // capture equipment
+	record = binary.BigEndian.AppendUint16(record, 500)
+	record = binary.BigEndian.AppendUint16(record, 500)
+	record = binary.BigEndian.AppendUint16(record, resolution)
+	record = binary.BigEndian.AppendUint16(record, resolution)
+	record = append(record, 1, 0) // one finger view, reserved
+
+	record = append(record, byte(finger), 0, byte(quality), byte(len(minutiae)))
+	for _, m := range minutiae {
+		record = binary.BigEndian.AppendUint16(record, uint16(m.typ)<<14|uint16(m.x))
+		record = binary.BigEndian.AppendUint16(record, uint16(m.y))
+		record = append(record, byte(m.angle), byte(m.quality))
+	}
+	record = binary.BigEndian.AppendUint16(record, 0) // no extended data
+
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(record)))
+	return record
+}
+
+// randomMinutiae places n minutiae in the central part of a 500x500 capture
+func randomMinutiae(rng *rand.Rand, n int) []isoMinutia {
+	minutiae := make([]isoMinutia, n)
+	for i := range minutiae {
+		minutiae[i] = isoMinutia{
+			typ:     1 + rng.Intn(2),
+			x:       100 + rng.Intn(300),
+			y:       100 + rng.Intn(300),
+			angle:   rng.Intn(256),
+			quality: 60 + rng.Intn(40),
+		}
+	}
+	return minutiae
+}
+
+// recapture simulates another capture of the same finger: rotated around the
+// centre, shifted, with a pixel of noise, some minutiae missed and some spurious
+func recapture(rng *rand.Rand, minutiae []isoMinutia, degrees float64, dx, dy, missed, spurious int) []isoMinutia {
+	rotation := degrees * math.Pi / 180
+	cos, sin := math.Cos(rotation), math.Sin(rotation)
+
+	var captured []isoMinutia
+	for _, m := range minutiae[missed:] {
+		x, y := float64(m.x-250), float64(m.y-250)
+		captured = append(captured, isoMinutia{
+			typ:     m.typ,
+			x:       int(math.Round(x*cos-y*sin)) + 250 + dx + rng.Intn(3) - 1,
+			y:       int(math.Round(x*sin+y*cos)) + 250 + dy + rng.Intn(3) - 1,
+			angle:   (m.angle + int(math.Round(degrees/1.40625)) + 256) % 256,
+			quality: m.quality,
+		})
+	}
+	return append(captured, randomMinutiae(rng, spurious)...)
+}
+
+func TestParseFingerprintTemplateISO(t *testing.T) {
+	minutiae := []isoMinutia{
+		{typ: 1, x: 120, y: 200, angle: 0, quality: 80},
+		{typ: 2, x: 300, y: 150, angle: 64, quality: 90},
+		{typ: 1, x: 16383, y: 16383, angle: 255, quality: 100},
+	}
+	raw := isoTemplate(3, 75, 197, minutiae)
+
+	template, err := ParseFingerprintTemplate(raw)
+	if err != nil {
+		t.Fatalf("ParseFingerprintTemplate: %v", err)
+	}
+	if template.Format != TemplateFormatISO19794 || template.Width != 500 || template.Height != 500 ||
+		template.FingerPosition != 3 || template.FingerQuality != 75 {
+		t.Errorf("template header = %+v", template)
+	}
+	if len(template.Minutiae) != len(minutiae) {
+		t.Fatalf("parsed %d minutiae, want %d", len(template.Minutiae), len(minutiae))
+	}
+	for i, want := range minutiae {
+		got := template.Minutiae[i]
+		if got.Type != want.typ || got.X != float64(want.x) || got.Y != float64(want.y) || got.Quality != want.quality ||
+			math.Abs(got.Angle-float64(want.angle)*2*math.Pi/256) > 1e-9 {
+			t.Errorf("minutia %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// Coordinates are normalized to 500 dpi (197 px/cm)
+	template, err = ParseFingerprintTemplate(isoTemplate(3, 75, 394, minutiae[:1]))
+	if err != nil {
+		t.Fatalf("ParseFingerprintTemplate at 1000 dpi: %v", err)
+	}
+	if got := template.Minutiae[0]; got.X != 60 || got.Y != 100 {
+		t.Errorf("minutia at 1000 dpi = %+v, want (60, 100)", got)
+	}
+
+	// Enrollment reads the finger and quality from the record, through base64 as sent by the kiosks
+	decoded, err := DecodeFingerprintTemplate(base64.RawURLEncoding.EncodeToString(raw))
+	if err != nil || string(decoded) != string(raw) {
+		t.Errorf("DecodeFingerprintTemplate = %v, want the raw record back", err)
+	}
+}
+
+func TestParseFingerprintTemplateInvalid(t *testing.T) {
+	valid := isoTemplate(1, 80, 197, []isoMinutia{{typ: 1, x: 10, y: 10, angle: 0, quality: 80}})
+
+	badMagic := append([]byte(nil), valid...)
+	copy(badMagic, "XYZ\x00")
+	badLength := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(badLength[8:12], uint32(len(valid)+1))
+	truncated := isoTemplate(1, 80, 197, []isoMinutia{{typ: 1, x: 10, y: 10}})
+	truncated[27] = 5 // announces more minutiae than the record holds
+	noView := append([]byte(nil), valid...)
+	noView[22] = 0
+
+	tests := map[string][]byte{
+		"empty":        nil,
+		"short":        valid[:20],
+		"bad magic":    badMagic,
+		"bad length":   badLength,
+		"truncated":    truncated,
+		"no view":      noView,
+		"no minutiae":  isoTemplate(1, 80, 197, nil),
+		"not a record": []byte("%PDF-1.4 this is not a fingerprint"),
+	}
+	for name, raw := range tests {
+		if _, err := ParseFingerprintTemplate(raw); err == nil {
+			t.Errorf("%s: ParseFingerprintTemplate succeeded", name)
+		}
+	}
+}
+
+func TestMinutiaeMatcher(t *testing.T) {
+	rng := rand.New(rand.NewSource(19794))
+	matcher := &MinutiaeMatcher{}
+	threshold := GetFingerprintMatchThreshold()
+
+	enrolled := randomMinutiae(rng, 30)
+	enrolledRaw := isoTemplate(2, 80, 197, enrolled)
+
+	score, err := matcher.Match(enrolledRaw, enrolledRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != 100 {
+		t.Errorf("same template scored %.2f, want 100", score)
+	}
+
+	tests := []struct {
+		name    string
+		probe   []isoMinutia
+		matched bool
+	}{
+		{"same finger shifted", recapture(rng, enrolled, 0, 25, -15, 0, 0), true},
+		{"same finger rotated", recapture(rng, enrolled, 12, -10, 20, 0, 0), true},
+		{"same finger partial capture", recapture(rng, enrolled, -8, 5, 5, 6, 4), true},
+		{"another finger", randomMinutiae(rng, 30), false},
+		{"another finger, few minutiae", randomMinutiae(rng, 6), false},
+		{"three common minutiae", enrolled[:3], false},
+	}
+	for _, tt := range tests {
+		score, err := matcher.Match(isoTemplate(2, 80, 197, tt.probe), enrolledRaw)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if score < 0 || score > 100 {
+			t.Errorf("%s: score %.2f out of range", tt.name, score)
+		}
+		if matched := score >= threshold; matched != tt.matched {
+			t.Errorf("%s: score %.2f against threshold %.0f, matched = %v, want %v", tt.name, score, threshold, matched, tt.matched)
+		}
+	}
+
+	if _, err := matcher.Match([]byte("not a template"), enrolledRaw); err == nil {
+		t.Error("Match accepted an invalid probe")
+	}
+	if _, err := matcher.Match(enrolledRaw, nil); err == nil {
+		t.Error("Match accepted an invalid candidate")
+	}
+}
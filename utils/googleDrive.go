@@ -81,32 +81,13 @@ func GetGoogleDriveService() (*drive.Service, error) {
 	return srv, nil
 }
 
-// DownloadFileFromDrive downloads a file from Google Drive using the API
+// DownloadFileFromDrive downloads a file from Google Drive using the API,
+// falling back to the public links when the API is not configured
 func DownloadFileFromDrive(fileID string) ([]byte, error) {
-	srv, err := GetGoogleDriveService()
-	if err != nil {
-		// Fall back to direct download if API service is not available
-		return DownloadPublicDriveFile(fileID)
-	}
-
-	// Get file metadata first to check permissions
-	_, err = srv.Files.Get(fileID).Fields("id, name, mimeType, permissions").Do()
-	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve file metadata: %v", err)
-	}
-
-	// Download the file content
-	resp, err := srv.Files.Get(fileID).Download()
+	data, err := ReadObject(context.Background(), GetDriveStorage(), fileID)
 	if err != nil {
 		return nil, fmt.Errorf("unable to download file: %v", err)
 	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read file content: %v", err)
-	}
-
 	return data, nil
 }
 
@@ -8,33 +8,86 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
 var SECRET_KEY string = os.Getenv("SECRET_KEY")
 
-func GenerateJwt(issuer string) (string, error) {
+// AccessClaims are the claims of an access token. Issuer holds the user UUID
+// and TokenVersion must match User.TokenVersion for the token to be accepted.
+type AccessClaims struct {
+	jwt.StandardClaims
+	TokenVersion int `json:"ver"`
+}
+
+// GetAccessTokenTTL returns the access token lifetime (ACCESS_TOKEN_TTL, default 15m)
+func GetAccessTokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(Env("ACCESS_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 15 * time.Minute
+}
 
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
-		Issuer:    issuer,
-		ExpiresAt: time.Now().Add(time.Hour * 72).Unix(), // 3 days
-	})
+// GenerateJwt issues a short-lived access token for a user
+func GenerateJwt(issuer string, tokenVersion int) (string, *AccessClaims, error) {
+	now := time.Now()
+	claims := &AccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Issuer:    issuer,
+			Subject:   issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(GetAccessTokenTTL()).Unix(),
+		},
+		TokenVersion: tokenVersion,
+	}
 
-	token, err := claims.SignedString([]byte(SECRET_KEY))
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
 
-	return token, err
+	return token, claims, err
 }
 
-func VerifyJwt(token string) (string, error) {
+// ParseJwt validates an access token and returns its claims
+func ParseJwt(token string) (*AccessClaims, error) {
+	claims, err := parseClaims(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Access tokens carry no audience, this rejects 2FA challenge tokens
+	if claims.Audience != "" {
+		return nil, errors.New("not an access token")
+	}
 
-	parsedToken, err := jwt.ParseWithClaims(token, &jwt.StandardClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(SECRET_KEY), nil
-	})
+	return claims, nil
+}
 
-	if err != nil || !parsedToken.Valid {
-		return "", err
+func parseClaims(token string) (*AccessClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &AccessClaims{}, signingKey)
+
+	if err != nil {
+		return nil, err
+	}
+	if !parsedToken.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	return parsedToken.Claims.(*AccessClaims), nil
+}
+
+// signingKey returns the HMAC secret, refusing tokens signed with another method
+func signingKey(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.New("unexpected signing method")
 	}
+	return []byte(SECRET_KEY), nil
+}
 
-	claims := parsedToken.Claims.(*jwt.StandardClaims)
+func VerifyJwt(token string) (string, error) {
+	claims, err := ParseJwt(token)
+	if err != nil {
+		return "", err
+	}
 
 	return claims.Issuer, nil
 }
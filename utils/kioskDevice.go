@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CurrentDevice returns the kiosk loaded by the IsKioskDevice middleware
+func CurrentDevice(c *fiber.Ctx) *models.KioskDevice {
+	device, _ := c.Locals("device").(*models.KioskDevice)
+	return device
+}
+
+// GenerateDeviceKey returns a new random API key for a kiosk ("ck_" + 43 chars)
+func GenerateDeviceKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "ck_" + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashDeviceKey is how device API keys are stored, the key itself is only shown once
+func HashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeviceFailureLogKey is the throttle key counting unknown-device requests of a client address
+func DeviceFailureLogKey(ip string) string {
+	return "device:" + ip
+}
+
+// ShouldLogDeviceFailure counts a request from an unknown kiosk device and
+// reports whether it goes to the audit log: only the first one per address
+// every DEVICE_FAILURE_LOG_WINDOW (default 1m). Anonymous traffic then cannot
+// flood the audit chain, whose writes are serialized.
+func ShouldLogDeviceFailure(db *gorm.DB, ip string) bool {
+	key := DeviceFailureLogKey(ip)
+	now := time.Now()
+	windowStart := now.Add(-envDuration("DEVICE_FAILURE_LOG_WINDOW", time.Minute))
+
+	// last_failure_at holds the start of the current window
+	restart := "login_throttles.last_failure_at < ?"
+	err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN "+restart+" THEN 1 ELSE login_throttles.failures + 1 END", windowStart),
+			"last_failure_at": gorm.Expr("CASE WHEN "+restart+" THEN ? ELSE login_throttles.last_failure_at END", windowStart, now),
+			"updated_at":      now,
+		}),
+	}).Create(&models.LoginThrottle{
+		Key:           key,
+		Failures:      1,
+		LastFailureAt: now,
+		UpdatedAt:     now,
+	}).Error
+	if err != nil {
+		return false
+	}
+
+	var throttle models.LoginThrottle
+	if err := db.Where("key = ?", key).First(&throttle).Error; err != nil {
+		return false
+	}
+	return throttle.Failures == 1
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginLockoutPolicy controls brute-force protection of the login endpoints.
+// Every failure blocks the key for an exponentially growing delay, and the
+// account is locked once MaxFailures is reached within FailureWindow.
+type LoginLockoutPolicy struct {
+	MaxFailures     int           // LOGIN_MAX_FAILURES, per account (default 5)
+	IPMaxFailures   int           // LOGIN_IP_MAX_FAILURES, per client address (default 20)
+	LockoutDuration time.Duration // LOGIN_LOCKOUT_DURATION (default 30m)
+	BackoffBase     time.Duration // LOGIN_BACKOFF_BASE, delay after the first failure (default 1s)
+	BackoffMax      time.Duration // LOGIN_BACKOFF_MAX (default 5m)
+	FailureWindow   time.Duration // LOGIN_FAILURE_WINDOW, failures older than this are forgotten (default 1h)
+}
+
+// LoginBlock describes why a login attempt is refused
+type LoginBlock struct {
+	Locked     bool      // Failure limit reached, otherwise a backoff delay
+	Until      time.Time // When attempts are accepted again
+	RetryAfter int64     // Seconds until then
+}
+
+// GetLoginLockoutPolicy reads the lockout policy from the environment
+func GetLoginLockoutPolicy() LoginLockoutPolicy {
+	return LoginLockoutPolicy{
+		MaxFailures:     envInt("LOGIN_MAX_FAILURES", 5),
+		IPMaxFailures:   envInt("LOGIN_IP_MAX_FAILURES", 20),
+		LockoutDuration: envDuration("LOGIN_LOCKOUT_DURATION", 30*time.Minute),
+		BackoffBase:     envDuration("LOGIN_BACKOFF_BASE", time.Second),
+		BackoffMax:      envDuration("LOGIN_BACKOFF_MAX", 5*time.Minute),
+		FailureWindow:   envDuration("LOGIN_FAILURE_WINDOW", time.Hour),
+	}
+}
+
+func envInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(Env(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(Env(key)); err == nil && value > 0 {
+		return value
+	}
+	return fallback
+}
+
+// LoginThrottleUserKey is the throttle key of an account
+func LoginThrottleUserKey(userUUID string) string {
+	return "user:" + userUUID
+}
+
+// LoginThrottleIPKey is the throttle key of a client address
+func LoginThrottleIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// CheckLoginThrottle returns the active block of a key, nil when attempts are allowed
+func CheckLoginThrottle(db *gorm.DB, key string) *LoginBlock {
+	var throttle models.LoginThrottle
+	if err := db.Where("key = ?", key).First(&throttle).Error; err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	if throttle.BlockedUntil == nil || !throttle.BlockedUntil.After(now) {
+		return nil
+	}
+
+	return &LoginBlock{
+		Locked:     throttle.LockedAt != nil,
+		Until:      *throttle.BlockedUntil,
+		RetryAfter: int64(throttle.BlockedUntil.Sub(now).Seconds()) + 1,
+	}
+}
+
+// RecordLoginFailure counts a failed attempt for a key and blocks it for the
+// backoff delay, or for the lockout duration once maxFailures is reached.
+// lockedNow is true only for the failure that triggered the lockout.
+func RecordLoginFailure(db *gorm.DB, key string, maxFailures int) (block *LoginBlock, lockedNow bool, err error) {
+	policy := GetLoginLockoutPolicy()
+	now := time.Now()
+	windowStart := now.Add(-policy.FailureWindow)
+
+	// Start over when the previous failures are stale or a lockout has expired
+	restart := "login_throttles.last_failure_at < ? OR (login_throttles.locked_at IS NOT NULL AND login_throttles.blocked_until < ?)"
+
+	err = db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN "+restart+" THEN 1 ELSE login_throttles.failures + 1 END", windowStart, now),
+			"locked_at":       gorm.Expr("CASE WHEN "+restart+" THEN NULL ELSE login_throttles.locked_at END", windowStart, now),
+			"last_failure_at": now,
+			"updated_at":      now,
+		}),
+	}).Create(&models.LoginThrottle{
+		Key:           key,
+		Failures:      1,
+		LastFailureAt: now,
+		UpdatedAt:     now,
+	}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	var throttle models.LoginThrottle
+	if err := db.Where("key = ?", key).First(&throttle).Error; err != nil {
+		return nil, false, err
+	}
+
+	var until time.Time
+	updates := map[string]interface{}{}
+
+	if throttle.Failures >= maxFailures {
+		if throttle.LockedAt != nil {
+			until = *throttle.BlockedUntil
+		} else {
+			until = now.Add(policy.LockoutDuration)
+			updates["locked_at"] = now
+			lockedNow = true
+		}
+	} else {
+		until = now.Add(loginBackoff(policy, throttle.Failures))
+	}
+	updates["blocked_until"] = until
+
+	if err := db.Model(&models.LoginThrottle{}).Where("key = ?", key).Updates(updates).Error; err != nil {
+		return nil, false, err
+	}
+
+	return &LoginBlock{
+		Locked:     throttle.LockedAt != nil || lockedNow,
+		Until:      until,
+		RetryAfter: int64(until.Sub(now).Seconds()) + 1,
+	}, lockedNow, nil
+}
+
+// loginBackoff doubles the delay with every failure, up to BackoffMax
+func loginBackoff(policy LoginLockoutPolicy, failures int) time.Duration {
+	delay := policy.BackoffBase
+	for i := 1; i < failures && delay < policy.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > policy.BackoffMax {
+		delay = policy.BackoffMax
+	}
+	return delay
+}
+
+// ClearLoginThrottle forgets the failures of a key, after a successful login or an admin unlock
+func ClearLoginThrottle(db *gorm.DB, key string) error {
+	return db.Where("key = ?", key).Delete(&models.LoginThrottle{}).Error
+}
+
+// NotifyAccountLocked emails the owner of an account that was just locked
+func NotifyAccountLocked(user *models.User, until time.Time, ip string) {
+	if user.Email == "" {
+		return
+	}
+
+	subject := "Your CertiKiosk account has been locked"
+	body := fmt.Sprintf(`
+		<!DOCTYPE html>
+		<html>
+		<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
+			<h2>Hello %s,</h2>
+			<p>Your account was temporarily locked after too many failed sign-in attempts.</p>
+			<p><strong>Last attempt from:</strong> %s<br>
+			<strong>Locked until:</strong> %s</p>
+			<p>If this was not you, contact an administrator and change your password once the account is unlocked.</p>
+			<p style="font-size: 12px; color: #777;">This is an automated email. Please do not reply to this message.</p>
+		</body>
+		</html>
+	`, html.EscapeString(user.Fullname), html.EscapeString(ip), until.Format("2006-01-02 15:04 MST"))
+
+	// Sent in the background so the response time does not reveal the lockout
+	go func() {
+		if err := SendEmail(user.Email, subject, body, nil, ""); err != nil {
+			log.Printf("[warn] lockout notification to %s failed: %v", user.Email, err)
+		}
+	}()
+}
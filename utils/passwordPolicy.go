@@ -0,0 +1,275 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// PasswordPolicy is applied to every new password: registration, user
+// creation, password change and reset
+type PasswordPolicy struct {
+	MinLength        int           // PASSWORD_MIN_LENGTH (default 10)
+	RequireUpper     bool          // PASSWORD_REQUIRE_UPPERCASE (default true)
+	RequireLower     bool          // PASSWORD_REQUIRE_LOWERCASE (default true)
+	RequireDigit     bool          // PASSWORD_REQUIRE_DIGIT (default true)
+	RequireSymbol    bool          // PASSWORD_REQUIRE_SYMBOL (default false)
+	HistoryCount     int           // PASSWORD_HISTORY_COUNT, last N passwords that cannot be reused (default 5, 0 disables)
+	MaxAge           time.Duration // PASSWORD_MAX_AGE_DAYS, forces rotation (default 0, disabled)
+	BreachedListFile string        // PASSWORD_BREACHED_LIST_FILE, one password or SHA-1 per line
+}
+
+// PasswordViolation is one failed rule of the password policy
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// GetPasswordPolicy reads the password policy from the environment
+func GetPasswordPolicy() PasswordPolicy {
+	historyCount := 5
+	if value, err := strconv.Atoi(Env("PASSWORD_HISTORY_COUNT")); err == nil && value >= 0 {
+		historyCount = value
+	}
+
+	return PasswordPolicy{
+		MinLength:        envInt("PASSWORD_MIN_LENGTH", 10),
+		RequireUpper:     envBool("PASSWORD_REQUIRE_UPPERCASE", true),
+		RequireLower:     envBool("PASSWORD_REQUIRE_LOWERCASE", true),
+		RequireDigit:     envBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol:    envBool("PASSWORD_REQUIRE_SYMBOL", false),
+		HistoryCount:     historyCount,
+		MaxAge:           time.Duration(envInt("PASSWORD_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+		BreachedListFile: Env("PASSWORD_BREACHED_LIST_FILE"),
+	}
+}
+
+func envBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(Env(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// ValidatePassword checks the rules that do not depend on the account
+func ValidatePassword(password string) []PasswordViolation {
+	policy := GetPasswordPolicy()
+	var violations []PasswordViolation
+
+	if len([]rune(password)) < policy.MinLength {
+		violations = append(violations, PasswordViolation{"min_length", fmt.Sprintf("password must be at least %d characters long", policy.MinLength)})
+	}
+
+	// bcrypt ignores everything past 72 bytes
+	if len(password) > 72 {
+		violations = append(violations, PasswordViolation{"max_length", "password must be at most 72 bytes long"})
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if policy.RequireUpper && !upper {
+		violations = append(violations, PasswordViolation{"uppercase", "password must contain an uppercase letter"})
+	}
+	if policy.RequireLower && !lower {
+		violations = append(violations, PasswordViolation{"lowercase", "password must contain a lowercase letter"})
+	}
+	if policy.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{"digit", "password must contain a digit"})
+	}
+	if policy.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{"symbol", "password must contain a symbol"})
+	}
+
+	if IsBreachedPassword(password) {
+		violations = append(violations, PasswordViolation{"breached", "password appears in a list of leaked passwords, choose another one"})
+	}
+
+	return violations
+}
+
+// ValidateNewPassword checks every rule, including reuse of the user's
+// previous passwords when the account already exists
+func ValidateNewPassword(db *gorm.DB, user *models.User, password string) []PasswordViolation {
+	violations := ValidatePassword(password)
+	if violations != nil || user == nil || user.UUID == "" {
+		return violations
+	}
+
+	policy := GetPasswordPolicy()
+	if policy.HistoryCount == 0 {
+		return nil
+	}
+
+	// The current password counts as the most recent one
+	hashes := []string{user.Password}
+	if policy.HistoryCount > 1 {
+		var history []models.PasswordHistory
+		db.Where("user_uuid = ?", user.UUID).Order("created_at DESC").Limit(policy.HistoryCount - 1).Find(&history)
+		for _, entry := range history {
+			hashes = append(hashes, entry.PasswordHash)
+		}
+	}
+
+	for _, hash := range hashes {
+		if hash != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return []PasswordViolation{{"history", fmt.Sprintf("password must differ from your last %d passwords", policy.HistoryCount)}}
+		}
+	}
+
+	return nil
+}
+
+// SetUserPassword stores a new password for an existing user, keeps the
+// previous hash in the history and restarts the max age
+func SetUserPassword(db *gorm.DB, user *models.User, password string) error {
+	previous := user.Password
+	user.SetPassword(password)
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("uuid = ?", user.UUID).Updates(map[string]interface{}{
+			"password":            user.Password,
+			"password_changed_at": user.PasswordChangedAt,
+		}).Error; err != nil {
+			return err
+		}
+
+		// Keep only what the history check can look at, the current password excluded
+		keep := GetPasswordPolicy().HistoryCount - 1
+		if previous == "" || keep <= 0 {
+			return tx.Where("user_uuid = ?", user.UUID).Delete(&models.PasswordHistory{}).Error
+		}
+
+		if err := tx.Create(&models.PasswordHistory{
+			UUID:         uuid.New().String(),
+			UserUUID:     user.UUID,
+			PasswordHash: previous,
+			CreatedAt:    time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_uuid = ? AND uuid NOT IN (?)", user.UUID,
+			tx.Model(&models.PasswordHistory{}).Select("uuid").Where("user_uuid = ?", user.UUID).Order("created_at DESC").Limit(keep),
+		).Delete(&models.PasswordHistory{}).Error
+	})
+}
+
+// PasswordExpired reports whether the user must change the password before using the API
+func PasswordExpired(user *models.User) bool {
+	maxAge := GetPasswordPolicy().MaxAge
+	if maxAge == 0 || user.PasswordChangedAt == nil {
+		return false
+	}
+	return time.Since(*user.PasswordChangedAt) > maxAge
+}
+
+// commonPasswords are always rejected, PASSWORD_BREACHED_LIST_FILE extends them
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1", "password123",
+	"qwerty", "qwerty123", "azerty", "azerty123", "abc123", "111111", "000000", "iloveyou",
+	"admin", "admin123", "welcome", "welcome1", "letmein", "monkey", "dragon", "football",
+	"motdepasse", "Password1", "Password123", "P@ssw0rd", "P@ssword1", "Azerty123", "Qwerty123",
+	"Welcome1", "Admin123", "Certikiosk1", "Certikiosk123",
+}
+
+var (
+	breachedOnce   sync.Once
+	breachedHashes map[string]struct{}
+)
+
+// IsBreachedPassword checks the password against the built-in list and the
+// local breached list. The file may hold clear passwords or SHA-1 hashes
+// (optionally "HASH:count" as in the Have I Been Pwned downloads).
+func IsBreachedPassword(password string) bool {
+	breachedOnce.Do(loadBreachedPasswords)
+
+	sum := sha1.Sum([]byte(password))
+	if _, found := breachedHashes[strings.ToUpper(hex.EncodeToString(sum[:]))]; found {
+		return true
+	}
+
+	sum = sha1.Sum([]byte(strings.ToLower(password)))
+	_, found := breachedHashes[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return found
+}
+
+func loadBreachedPasswords() {
+	breachedHashes = make(map[string]struct{})
+
+	add := func(password string) {
+		sum := sha1.Sum([]byte(password))
+		breachedHashes[strings.ToUpper(hex.EncodeToString(sum[:]))] = struct{}{}
+	}
+	for _, password := range commonPasswords {
+		add(password)
+		add(strings.ToLower(password))
+	}
+
+	path := GetPasswordPolicy().BreachedListFile
+	if path == "" {
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("[warn] breached password list not loaded: %v", err)
+		return
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash := strings.SplitN(line, ":", 2)[0]
+		if _, err := hex.DecodeString(hash); err == nil && len(hash) == 40 {
+			breachedHashes[strings.ToUpper(hash)] = struct{}{}
+		} else {
+			add(line)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[warn] breached password list partially loaded: %v", err)
+	}
+
+	log.Printf("[info] loaded %d breached password(s) from %s", count, path)
+}
+
+// PasswordPolicyError builds the response body listing every violated rule
+func PasswordPolicyError(violations []PasswordViolation) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  "error",
+		"message": "password does not meet the password policy",
+		"errors":  violations,
+	}
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrPasswordResetInvalid covers unknown, used, superseded and expired tokens alike
+var ErrPasswordResetInvalid = errors.New("invalid or expired reset token")
+
+// GetPasswordResetTTL returns how long a reset link stays valid (PASSWORD_RESET_TTL, default 1h)
+func GetPasswordResetTTL() time.Duration {
+	return envDuration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePasswordReset issues a new reset token for a user and invalidates the
+// previous ones. The clear token is returned for the email only.
+func CreatePasswordReset(db *gorm.DB, user *models.User, ip string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	reset := models.PasswordReset{
+		UUID:           uuid.New().String(),
+		UserUUID:       user.UUID,
+		Email:          user.Email,
+		TokenHash:      hashResetToken(token),
+		ExpirationTime: now.Add(GetPasswordResetTTL()),
+		RequestIP:      ip,
+		CreatedAt:      now,
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := invalidatePasswordResets(tx, user.UUID); err != nil {
+			return err
+		}
+		return tx.Create(&reset).Error
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// FindPasswordReset returns the record of a valid token without using it
+func FindPasswordReset(db *gorm.DB, token string) (*models.PasswordReset, error) {
+	if token == "" {
+		return nil, ErrPasswordResetInvalid
+	}
+
+	var reset models.PasswordReset
+	if err := db.Where("token_hash = ? AND used_at IS NULL", hashResetToken(token)).First(&reset).Error; err != nil {
+		return nil, ErrPasswordResetInvalid
+	}
+	if time.Now().After(reset.ExpirationTime) {
+		return nil, ErrPasswordResetInvalid
+	}
+
+	return &reset, nil
+}
+
+// ConsumePasswordReset marks a valid token as used and returns its record.
+// A token can only be consumed once, even by concurrent requests.
+func ConsumePasswordReset(db *gorm.DB, token string) (*models.PasswordReset, error) {
+	reset, err := FindPasswordReset(db, token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := db.Model(&models.PasswordReset{}).
+		Where("uuid = ? AND used_at IS NULL", reset.UUID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPasswordResetInvalid
+	}
+
+	return reset, nil
+}
+
+// invalidatePasswordResets marks every pending token of a user as used
+func invalidatePasswordResets(db *gorm.DB, userUUID string) error {
+	return db.Model(&models.PasswordReset{}).
+		Where("user_uuid = ? AND used_at IS NULL", userUUID).
+		Update("used_at", time.Now()).Error
+}
+
+// InvalidatePasswordResets drops the pending reset links of a user, e.g. after a password change
+func InvalidatePasswordResets(db *gorm.DB, userUUID string) error {
+	return invalidatePasswordResets(db, userUUID)
+}
+
+// SendPasswordResetEmail emails the reset link in the background so the
+// response time does not reveal whether the address exists
+func SendPasswordResetEmail(user *models.User, token string) {
+	url := Env("RESET_URL") + token
+
+	subject := "Reset your CertiKiosk password"
+	body := fmt.Sprintf(`
+		<!DOCTYPE html>
+		<html>
+		<body style="font-family: Arial, sans-serif; line-height: 1.6; color: #333;">
+			<h2>Hello %s,</h2>
+			<p>A password reset was requested for your account.</p>
+			<p><a href="%s" style="background-color: #4CAF50; color: white; padding: 10px 20px; text-decoration: none; border-radius: 5px; display: inline-block;">Reset my password</a></p>
+			<p>This link can be used once and expires in %s. If you did not request it, you can ignore this email: your password stays unchanged.</p>
+			<p style="font-size: 12px; color: #777;">This is an automated email. Please do not reply to this message.</p>
+		</body>
+		</html>
+	`, html.EscapeString(user.Fullname), url, GetPasswordResetTTL())
+
+	go func() {
+		if err := SendEmail(user.Email, subject, body, nil, ""); err != nil {
+			log.Printf("[warn] password reset email to %s failed: %v", user.Email, err)
+		}
+	}()
+}
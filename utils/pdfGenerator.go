@@ -3,11 +3,19 @@ package utils
 import (
 	"bytes"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
 	"github.com/jung-kurt/gofpdf"
+	"github.com/jung-kurt/gofpdf/contrib/gofpdi"
 )
 
 // PDFStampConfig holds configuration for PDF stamp/watermark
@@ -22,71 +30,244 @@ type PDFStampConfig struct {
 
 // CertificationInfo holds information for document certification
 type CertificationInfo struct {
-	CitizenName   string
-	NationalID    string
-	DocumentType  string
-	CertifiedDate time.Time
-	CertifierName string
-	Signature     string
-	StampDetails  string
+	CitizenName     string
+	NationalID      string
+	DocumentType    string
+	CertifiedDate   time.Time
+	CertifierName   string
+	Signature       string
+	StampDetails    string
+	StampPage       int    // 0 stamps every page
+	StampPosition   string // same values as PDFStampConfig.StampPosition
+	VerificationURL string // encoded in the stamp QR code when set
 }
 
-// Note: This is a placeholder implementation for PDF generation and stamping
-// To use this functionality, you need to install a PDF library such as:
-// - go get github.com/jung-kurt/gofpdf
-// - go get github.com/signintech/gopdf
-// - go get github.com/pdfcpu/pdfcpu
-//
-// Choose based on your needs:
-// - gofpdf: Good for creating PDFs from scratch
-// - gopdf: Similar to gofpdf with more features
-// - pdfcpu: Best for manipulating existing PDFs (adding stamps, watermarks)
+// GenerateCertifiedPDF stamps an existing document with the certification details.
+// PDF sources keep their original pages; PNG/JPEG sources are first placed on an A4 page.
+// When info.StampPage is 0 every page is stamped, otherwise only that page.
+func GenerateCertifiedPDF(info CertificationInfo, sourceData []byte) ([]byte, error) {
+	fileExt, _ := DetectFileType(sourceData)
+
+	pdfData := sourceData
+	if fileExt == "png" || fileExt == "jpg" {
+		converted, err := ConvertImageToPDF(sourceData, fileExt)
+		if err != nil {
+			return nil, err
+		}
+		pdfData = converted
+	} else if fileExt != "pdf" {
+		return nil, fmt.Errorf("unsupported document format, expected PDF, PNG or JPEG")
+	}
 
-/*
-Example implementation using gofpdf:
+	var details []string
+	if info.CitizenName != "" {
+		details = append(details, fmt.Sprintf("Citizen: %s", info.CitizenName))
+	}
+	if info.NationalID != "" {
+		details = append(details, fmt.Sprintf("National ID: %s", info.NationalID))
+	}
+	if info.DocumentType != "" {
+		details = append(details, fmt.Sprintf("Document Type: %s", info.DocumentType))
+	}
+	if info.StampDetails != "" {
+		details = append(details, info.StampDetails)
+	}
 
-import (
-	"github.com/jung-kurt/gofpdf"
-)
+	stampConfig := PDFStampConfig{
+		StampText:     strings.Join(details, "\n"),
+		StampPosition: info.StampPosition,
+		StampDate:     info.CertifiedDate,
+		CertifierName: info.CertifierName,
+		Signature:     info.Signature,
+		QRCode:        info.VerificationURL,
+	}
+
+	return AddStampToPDF(pdfData, info.StampPage, stampConfig)
+}
+
+// AddStampToPDF imports every page of an existing PDF and draws a certification stamp
+// on the requested page (0 stamps all pages). The original page content is preserved.
+func AddStampToPDF(pdfData []byte, page int, stampConfig PDFStampConfig) (output []byte, err error) {
+	if len(pdfData) < 4 || string(pdfData[:4]) != "%PDF" {
+		return nil, fmt.Errorf("source document is not a PDF")
+	}
+	if page < 0 {
+		return nil, fmt.Errorf("invalid stamp page %d", page)
+	}
+
+	// gofpdi panics on malformed input instead of returning an error
+	defer func() {
+		if r := recover(); r != nil {
+			output = nil
+			err = fmt.Errorf("failed to read source PDF: %v", r)
+		}
+	}()
+
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.SetAutoPageBreak(false, 0)
+	importer := gofpdi.NewImporter()
+
+	var rs io.ReadSeeker = bytes.NewReader(pdfData)
+	firstTemplate := importer.ImportPageFromStream(pdf, &rs, 1, "/MediaBox")
+	pageSizes := importer.GetPageSizes()
+	pageCount := len(pageSizes)
+
+	if page > pageCount {
+		return nil, fmt.Errorf("stamp page %d is out of range, document has %d page(s)", page, pageCount)
+	}
+
+	for p := 1; p <= pageCount; p++ {
+		template := firstTemplate
+		if p > 1 {
+			template = importer.ImportPageFromStream(pdf, &rs, p, "/MediaBox")
+		}
+
+		pageWidth := pageSizes[p]["/MediaBox"]["w"]
+		pageHeight := pageSizes[p]["/MediaBox"]["h"]
+
+		pdf.AddPageFormat("P", gofpdf.SizeType{Wd: pageWidth, Ht: pageHeight})
+		importer.UseImportedTemplate(pdf, template, 0, 0, pageWidth, pageHeight)
+
+		if page == 0 || page == p {
+			drawCertificationStamp(pdf, pageWidth, pageHeight, stampConfig)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to generate PDF: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// drawCertificationStamp draws the certification box on the current page (units are points)
+func drawCertificationStamp(pdf *gofpdf.Fpdf, pageWidth, pageHeight float64, stampConfig PDFStampConfig) {
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	margin := 20.0
+	lineHeight := 10.0
+	stampWidth := 260.0
+
+	var lines []string
+	if stampConfig.CertifierName != "" {
+		lines = append(lines, fmt.Sprintf("Certified by: %s", stampConfig.CertifierName))
+	}
+	stampDate := stampConfig.StampDate
+	if stampDate.IsZero() {
+		stampDate = time.Now()
+	}
+	lines = append(lines, fmt.Sprintf("Date: %s", stampDate.Format("Jan 02, 2006 15:04")))
+	for _, line := range strings.Split(stampConfig.StampText, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+
+	stampHeight := 30.0 + float64(len(lines))*lineHeight
+
+	// Reserve a square on the right of the stamp for the verification QR code
+	var qrImageName string
+	qrSize := 0.0
+	if stampConfig.QRCode != "" {
+		if qrData, err := GenerateQRCode(stampConfig.QRCode); err == nil {
+			qrImageName = "verification_qr_" + HashSHA256([]byte(stampConfig.QRCode))
+			pdf.RegisterImageOptionsReader(qrImageName, gofpdf.ImageOptions{ImageType: "png"}, bytes.NewReader(qrData))
+			qrSize = 70.0
+			if stampHeight < qrSize+12 {
+				stampHeight = qrSize + 12
+			}
+			stampWidth += qrSize + 6
+		}
+	}
+	textWidth := stampWidth - 12 - qrSize
+
+	var stampX, stampY float64
+	switch stampConfig.StampPosition {
+	case "top-left":
+		stampX, stampY = margin, margin
+	case "top-right":
+		stampX, stampY = pageWidth-margin-stampWidth, margin
+	case "bottom-left":
+		stampX, stampY = margin, pageHeight-margin-stampHeight
+	case "center":
+		stampX, stampY = (pageWidth-stampWidth)/2, (pageHeight-stampHeight)/2
+	default: // bottom-right
+		stampX, stampY = pageWidth-margin-stampWidth, pageHeight-margin-stampHeight
+	}
+
+	// Stamp background and border
+	pdf.SetAlpha(0.9, "Normal")
+	pdf.SetFillColor(240, 255, 240)
+	pdf.Rect(stampX, stampY, stampWidth, stampHeight, "F")
+	pdf.SetAlpha(1, "Normal")
+	pdf.SetDrawColor(0, 128, 0)
+	pdf.SetLineWidth(1.5)
+	pdf.Rect(stampX, stampY, stampWidth, stampHeight, "D")
+
+	// Header
+	headerText := "CERTIFIED COPY"
+	if stampConfig.Signature != "" {
+		headerText = stampConfig.Signature
+	}
+	pdf.SetFont("Arial", "B", 11)
+	pdf.SetTextColor(0, 128, 0)
+	pdf.SetXY(stampX+6, stampY+6)
+	pdf.CellFormat(textWidth, 12, tr(headerText), "", 0, "L", false, 0, "")
+
+	pdf.SetLineWidth(0.5)
+	pdf.Line(stampX+6, stampY+20, stampX+6+textWidth, stampY+20)
+
+	// Details
+	pdf.SetFont("Arial", "", 8)
+	pdf.SetTextColor(50, 50, 50)
+	for i, line := range lines {
+		pdf.SetXY(stampX+6, stampY+24+float64(i)*lineHeight)
+		pdf.CellFormat(textWidth, lineHeight, tr(line), "", 0, "L", false, 0, "")
+	}
+
+	if qrImageName != "" {
+		pdf.ImageOptions(qrImageName, stampX+stampWidth-6-qrSize, stampY+(stampHeight-qrSize)/2, qrSize, qrSize, false, gofpdf.ImageOptions{ImageType: "png"}, 0, stampConfig.QRCode)
+	}
+}
 
-func GenerateCertifiedPDF(info CertificationInfo, originalPDFPath string, outputPath string) error {
+// ConvertImageToPDF places a PNG/JPEG image on a single A4 page without any stamp
+func ConvertImageToPDF(imageData []byte, imageType string) ([]byte, error) {
 	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetAutoPageBreak(false, 0)
 	pdf.AddPage()
-	pdf.SetFont("Arial", "B", 16)
-
-	// Add certification header
-	pdf.Cell(40, 10, "CERTIFIED DOCUMENT")
-	pdf.Ln(12)
-
-	// Add certification details
-	pdf.SetFont("Arial", "", 12)
-	pdf.Cell(40, 10, fmt.Sprintf("Citizen: %s", info.CitizenName))
-	pdf.Ln(8)
-	pdf.Cell(40, 10, fmt.Sprintf("National ID: %s", info.NationalID))
-	pdf.Ln(8)
-	pdf.Cell(40, 10, fmt.Sprintf("Document Type: %s", info.DocumentType))
-	pdf.Ln(8)
-	pdf.Cell(40, 10, fmt.Sprintf("Certified Date: %s", info.CertifiedDate.Format("2006-01-02")))
-	pdf.Ln(8)
-
-	// Add stamp/signature
-	pdf.SetFont("Arial", "I", 10)
-	pdf.Cell(40, 10, info.StampDetails)
-
-	return pdf.OutputFileAndClose(outputPath)
-}
-*/
 
-// GenerateCertifiedPDF creates a certified version of a PDF document (placeholder)
-func GenerateCertifiedPDF(info CertificationInfo, originalPDFPath string, outputPath string) error {
-	// TODO: Implement actual PDF generation with stamp
-	return fmt.Errorf("PDF generation not configured. Install a PDF library (gofpdf, gopdf, or pdfcpu)")
+	pageWidth, pageHeight := pdf.GetPageSize()
+	margin := 10.0
+
+	imageOpt := gofpdf.ImageOptions{
+		ImageType: imageType,
+		ReadDpi:   false,
+	}
+	imageName := fmt.Sprintf("source_image_%d", time.Now().UnixNano())
+	pdf.RegisterImageOptionsReader(imageName, imageOpt, bytes.NewReader(imageData))
+	pdf.ImageOptions(imageName, margin, margin, pageWidth-(2*margin), pageHeight-(2*margin), false, imageOpt, 0, "")
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, fmt.Errorf("failed to generate PDF: %v", err)
+	}
+
+	return buf.Bytes(), nil
 }
 
-// AddStampToPDF adds a certification stamp to an existing PDF (placeholder)
-func AddStampToPDF(inputPath string, outputPath string, stampConfig PDFStampConfig) error {
-	// TODO: Implement PDF stamping
-	return fmt.Errorf("PDF stamping not configured")
+// DetectFileType detects PDF, PNG and JPEG content from its signature
+func DetectFileType(data []byte) (string, string) {
+	if len(data) >= 4 && string(data[:4]) == "%PDF" {
+		return "pdf", "application/pdf"
+	}
+	if len(data) >= 4 && data[0] == 0x89 && data[1] == 0x50 && data[2] == 0x4E && data[3] == 0x47 {
+		return "png", "image/png"
+	}
+	if len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF {
+		return "jpg", "image/jpeg"
+	}
+	return "", "application/octet-stream"
 }
 
 // GenerateCertificationStamp creates a stamp image for certification (placeholder)
@@ -95,11 +276,40 @@ func GenerateCertificationStamp(config PDFStampConfig) ([]byte, error) {
 	return nil, fmt.Errorf("Stamp generation not configured")
 }
 
-// GenerateQRCode generates a QR code for document verification (placeholder)
+// GenerateQRCode generates a PNG QR code for document verification
 func GenerateQRCode(data string) ([]byte, error) {
-	// TODO: Implement QR code generation
-	// You can use: go get github.com/skip2/go-qrcode
-	return nil, fmt.Errorf("QR code generation not configured")
+	code, err := qr.Encode(data, qr.M, qr.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %v", err)
+	}
+
+	code, err = barcode.Scale(code, 256, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scale QR code: %v", err)
+	}
+
+	// gofpdf only accepts 8-bit PNGs, so redraw the code as 8-bit grayscale
+	gray := image.NewGray(code.Bounds())
+	draw.Draw(gray, gray.Bounds(), code, code.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, gray); err != nil {
+		return nil, fmt.Errorf("failed to encode QR code image: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// GetVerificationURL returns the public verification URL printed in the certification QR code
+func GetVerificationURL(certificationUUID string) string {
+	baseURL := Env("PUBLIC_VERIFY_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8000/api/public/verify/"
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return baseURL + certificationUUID
 }
 
 // MergePDFs merges multiple PDFs into one (placeholder)
@@ -122,11 +332,20 @@ func GetPDFInfo(pdfPath string) (map[string]interface{}, error) {
 	}, nil
 }
 
-// ValidatePDFFile checks if a file is a valid PDF (basic check)
+// ValidatePDFFile checks that a file on disk is a well-formed PDF, whatever its extension
 func ValidatePDFFile(filePath string) bool {
-	// TODO: Implement proper PDF validation
-	// For now, just check file extension
-	return len(filePath) > 4 && filePath[len(filePath)-4:] == ".pdf"
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return ValidatePDFStructure(file, stat.Size()) == nil
 }
 
 // GenerateCertificationMetadata creates metadata for certified document
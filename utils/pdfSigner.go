@@ -0,0 +1,465 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitorus/pkcs7"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// PDFSigner holds the server signing key and its certificate chain
+type PDFSigner struct {
+	PrivateKey  crypto.Signer
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate // intermediates and root, issuer first
+}
+
+// SignatureValidation is the result of validating a signed PDF
+type SignatureValidation struct {
+	Signed               bool      `json:"signed"`
+	Valid                bool      `json:"valid"`
+	TrustedSigner        bool      `json:"trusted_signer"`
+	CoversWholeDocument  bool      `json:"covers_whole_document"`
+	SignerSubject        string    `json:"signer_subject"`
+	SignerFingerprint    string    `json:"signer_fingerprint"`
+	SigningTime          time.Time `json:"signing_time"`
+	Error                string    `json:"error,omitempty"`
+	SignatureCount       int       `json:"signature_count"`
+	ModifiedAfterSigning bool      `json:"modified_after_signing"`
+}
+
+// Size reserved for the hex encoded CMS signature in the /Contents placeholder
+const signatureContentsSize = 16384
+
+var (
+	pdfSigner     *PDFSigner
+	pdfSignerErr  error
+	pdfSignerOnce sync.Once
+
+	// OID for the ESS signing-certificate-v2 attribute required by CAdES/PAdES
+	oidAttributeSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+)
+
+// GetPDFSigner loads the signing key once from the configured PKCS#12 or PEM files.
+// Returns nil, nil when no signing key is configured.
+func GetPDFSigner() (*PDFSigner, error) {
+	pdfSignerOnce.Do(func() {
+		pdfSigner, pdfSignerErr = loadPDFSigner()
+	})
+	return pdfSigner, pdfSignerErr
+}
+
+func loadPDFSigner() (*PDFSigner, error) {
+	if p12File := Env("SIGNING_P12_FILE"); p12File != "" {
+		data, err := os.ReadFile(p12File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing PKCS#12 file: %v", err)
+		}
+
+		key, cert, chain, err := pkcs12.DecodeChain(data, Env("SIGNING_P12_PASSWORD"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signing PKCS#12 file: %v", err)
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("signing key type %T is not supported", key)
+		}
+
+		return &PDFSigner{PrivateKey: signer, Certificate: cert, Chain: chain}, nil
+	}
+
+	certFile := Env("SIGNING_CERT_FILE")
+	keyFile := Env("SIGNING_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing certificate: %v", err)
+	}
+	certs, err := parsePEMCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", keyFile)
+	}
+
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("failed to parse signing key: %v", err)
+			}
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key type %T is not supported", key)
+	}
+
+	return &PDFSigner{PrivateKey: signer, Certificate: certs[0], Chain: certs[1:]}, nil
+}
+
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// CertificateFingerprint returns the hex SHA-256 fingerprint of a certificate
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// TrustPool returns the certificates accepted as signers when validating PDFs
+func (s *PDFSigner) TrustPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate)
+	for _, cert := range s.Chain {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// SignPDF appends an incremental update carrying a detached CAdES signature
+// (ETSI.CAdES.detached) over the whole document. The input must be a PDF with a
+// classic cross-reference table, such as the ones produced by AddStampToPDF.
+func (s *PDFSigner) SignPDF(pdfData []byte, reason, location string) ([]byte, error) {
+	doc, err := parsePDFTrailer(pdfData)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := findPDFObject(pdfData, doc.rootID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(catalog, "/AcroForm") {
+		return nil, fmt.Errorf("document already contains a form, signing is not supported")
+	}
+
+	pageID, page, err := findFirstPage(pdfData)
+	if err != nil {
+		return nil, err
+	}
+
+	sigID := doc.size
+	fieldID := doc.size + 1
+	newSize := doc.size + 2
+
+	var buf bytes.Buffer
+	buf.Write(pdfData)
+	if !bytes.HasSuffix(pdfData, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+
+	offsets := map[int]int{}
+
+	// Signature dictionary with fixed width placeholders
+	byteRangePlaceholder := "/ByteRange [0 0000000000 0000000000 0000000000]"
+	offsets[sigID] = buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /ETSI.CAdES.detached %s /Contents <", sigID, byteRangePlaceholder)
+	contentsStart := buf.Len() - 1
+	buf.WriteString(strings.Repeat("0", signatureContentsSize))
+	buf.WriteString(">")
+	contentsEnd := buf.Len()
+	fmt.Fprintf(&buf, " /M (D:%s) /Name (%s) /Reason (%s) /Location (%s) >>\nendobj\n",
+		time.Now().UTC().Format("20060102150405Z"),
+		escapePDFString(s.Certificate.Subject.CommonName),
+		escapePDFString(reason),
+		escapePDFString(location))
+
+	// Invisible signature field on the first page
+	offsets[fieldID] = buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Annot /Subtype /Widget /FT /Sig /T (CertiKiosk Signature) /V %d 0 R /F 132 /Rect [0 0 0 0] /P %d 0 R >>\nendobj\n",
+		fieldID, sigID, pageID)
+
+	// Catalog with the AcroForm referencing the field
+	offsets[doc.rootID] = buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", doc.rootID,
+		appendToDictionary(catalog, fmt.Sprintf("/AcroForm << /Fields [%d 0 R] /SigFlags 3 >>", fieldID)))
+
+	// First page with the widget added to its annotations
+	offsets[pageID] = buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", pageID, addPageAnnotation(page, fieldID))
+
+	xrefOffset := buf.Len()
+	buf.WriteString("xref\n0 1\n0000000000 65535 f \n")
+	for _, id := range []int{doc.rootID, pageID, sigID, fieldID} {
+		fmt.Fprintf(&buf, "%d 1\n%010d 00000 n \n", id, offsets[id])
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", newSize, doc.rootID, doc.startXref, xrefOffset)
+
+	output := buf.Bytes()
+
+	// Fill in the byte range now that the final length is known
+	byteRange := fmt.Sprintf("/ByteRange [0 %010d %010d %010d]", contentsStart, contentsEnd, len(output)-contentsEnd)
+	byteRangeAt := bytes.LastIndex(output[:contentsStart], []byte(byteRangePlaceholder))
+	copy(output[byteRangeAt:], byteRange)
+
+	signedContent := make([]byte, 0, len(output)-(contentsEnd-contentsStart))
+	signedContent = append(signedContent, output[:contentsStart]...)
+	signedContent = append(signedContent, output[contentsEnd:]...)
+
+	signature, err := s.createSignature(signedContent)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureHex := hex.EncodeToString(signature)
+	if len(signatureHex) > signatureContentsSize {
+		return nil, fmt.Errorf("signature is too large (%d bytes)", len(signature))
+	}
+	copy(output[contentsStart+1:], signatureHex)
+
+	return output, nil
+}
+
+// createSignature builds the detached CMS SignedData over content
+func (s *PDFSigner) createSignature(content []byte) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize signature: %v", err)
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	certHash := sha256.Sum256(s.Certificate.Raw)
+	signingCertificate := struct {
+		Certs []struct {
+			CertHash []byte
+		}
+	}{
+		Certs: []struct {
+			CertHash []byte
+		}{{CertHash: certHash[:]}},
+	}
+
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidAttributeSigningCertificateV2, Value: signingCertificate},
+		},
+	}
+
+	if err := signedData.AddSignerChain(s.Certificate, s.PrivateKey, s.Chain, config); err != nil {
+		return nil, fmt.Errorf("failed to sign document: %v", err)
+	}
+	signedData.Detach()
+
+	return signedData.Finish()
+}
+
+// ValidatePDFSignature checks the last signature of a PDF against the trust pool
+func ValidatePDFSignature(pdfData []byte, trustPool *x509.CertPool) SignatureValidation {
+	var result SignatureValidation
+
+	matches := signatureDictPattern.FindAllSubmatchIndex(pdfData, -1)
+	result.SignatureCount = len(matches)
+	if len(matches) == 0 {
+		result.Error = "document is not signed"
+		return result
+	}
+	result.Signed = true
+
+	m := matches[len(matches)-1]
+	var byteRange [4]int
+	for i := 0; i < 4; i++ {
+		value, err := strconv.Atoi(string(pdfData[m[2+2*i]:m[3+2*i]]))
+		if err != nil {
+			result.Error = "invalid signature byte range"
+			return result
+		}
+		byteRange[i] = value
+	}
+
+	// The gap between the two ranges must be the <hex> /Contents string,
+	// the file is untrusted input so check every bound before slicing
+	if byteRange[0] != 0 || byteRange[1] < 0 || byteRange[3] < 0 ||
+		byteRange[2] < byteRange[1]+2 || byteRange[2] > len(pdfData) || byteRange[3] > len(pdfData)-byteRange[2] ||
+		pdfData[byteRange[1]] != '<' || pdfData[byteRange[2]-1] != '>' {
+		result.Error = "invalid signature byte range"
+		return result
+	}
+
+	result.CoversWholeDocument = byteRange[2]+byteRange[3] == len(pdfData)
+	result.ModifiedAfterSigning = !result.CoversWholeDocument
+
+	contents, err := hex.DecodeString(string(pdfData[byteRange[1]+1 : byteRange[2]-1]))
+	if err != nil {
+		result.Error = "signature contents are not valid hex"
+		return result
+	}
+
+	// The placeholder is zero padded, keep only the DER encoded structure
+	var signature asn1.RawValue
+	if _, err := asn1.Unmarshal(contents, &signature); err != nil {
+		result.Error = fmt.Sprintf("failed to parse signature: %v", err)
+		return result
+	}
+
+	p7, err := pkcs7.Parse(signature.FullBytes)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to parse signature: %v", err)
+		return result
+	}
+
+	signedContent := make([]byte, 0, byteRange[1]+byteRange[3])
+	signedContent = append(signedContent, pdfData[byteRange[0]:byteRange[0]+byteRange[1]]...)
+	signedContent = append(signedContent, pdfData[byteRange[2]:byteRange[2]+byteRange[3]]...)
+	p7.Content = signedContent
+
+	if signer := p7.GetOnlySigner(); signer != nil {
+		result.SignerSubject = signer.Subject.String()
+		result.SignerFingerprint = CertificateFingerprint(signer)
+	}
+
+	var signingTime time.Time
+	if err := p7.UnmarshalSignedAttribute(pkcs7.OIDAttributeSigningTime, &signingTime); err == nil {
+		result.SigningTime = signingTime
+	}
+
+	if err := p7.Verify(); err != nil {
+		result.Error = fmt.Sprintf("signature does not match document content: %v", err)
+		return result
+	}
+
+	// The signature only vouches for the signed ranges, anything appended
+	// afterwards is unsigned content
+	if result.ModifiedAfterSigning {
+		result.Error = "document was modified after signing"
+		return result
+	}
+	result.Valid = true
+
+	if trustPool != nil {
+		if err := p7.VerifyWithChain(trustPool); err != nil {
+			result.Error = fmt.Sprintf("signer is not trusted: %v", err)
+			return result
+		}
+		result.TrustedSigner = true
+	}
+
+	return result
+}
+
+var (
+	signatureDictPattern = regexp.MustCompile(`/ByteRange\s*\[\s*(\d+)\s+(\d+)\s+(\d+)\s+(\d+)\s*\]`)
+	startXrefPattern     = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	trailerSizePattern   = regexp.MustCompile(`/Size\s+(\d+)`)
+	trailerRootPattern   = regexp.MustCompile(`/Root\s+(\d+)\s+0\s+R`)
+	pageObjectPattern    = regexp.MustCompile(`(?s)(\d+) 0 obj\s*(<<\s*/Type\s*/Page\b.*?)\s*endobj`)
+)
+
+type pdfTrailer struct {
+	rootID    int
+	size      int
+	startXref int
+}
+
+func parsePDFTrailer(pdfData []byte) (*pdfTrailer, error) {
+	m := startXrefPattern.FindSubmatch(pdfData)
+	if m == nil {
+		return nil, fmt.Errorf("startxref not found")
+	}
+	startXref, _ := strconv.Atoi(string(m[1]))
+
+	trailerAt := bytes.LastIndex(pdfData, []byte("trailer"))
+	if trailerAt < 0 {
+		return nil, fmt.Errorf("PDF trailer not found, cross-reference streams are not supported")
+	}
+	trailer := pdfData[trailerAt:]
+
+	sizeMatch := trailerSizePattern.FindSubmatch(trailer)
+	rootMatch := trailerRootPattern.FindSubmatch(trailer)
+	if sizeMatch == nil || rootMatch == nil {
+		return nil, fmt.Errorf("PDF trailer is missing /Size or /Root")
+	}
+
+	size, _ := strconv.Atoi(string(sizeMatch[1]))
+	rootID, _ := strconv.Atoi(string(rootMatch[1]))
+
+	return &pdfTrailer{rootID: rootID, size: size, startXref: startXref}, nil
+}
+
+// findPDFObject returns the dictionary of an indirect object (last definition wins)
+func findPDFObject(pdfData []byte, id int) (string, error) {
+	pattern := regexp.MustCompile(fmt.Sprintf(`(?s)(?:^|\s)%d 0 obj\s*(<<.*?)\s*endobj`, id))
+	matches := pattern.FindAllSubmatch(pdfData, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("object %d not found", id)
+	}
+	return string(matches[len(matches)-1][1]), nil
+}
+
+func findFirstPage(pdfData []byte) (int, string, error) {
+	m := pageObjectPattern.FindSubmatch(pdfData)
+	if m == nil {
+		return 0, "", fmt.Errorf("no page object found")
+	}
+	id, _ := strconv.Atoi(string(m[1]))
+	return id, string(m[2]), nil
+}
+
+// appendToDictionary inserts entries before the closing >> of a dictionary
+func appendToDictionary(dict, entries string) string {
+	end := strings.LastIndex(dict, ">>")
+	return dict[:end] + entries + "\n" + dict[end:]
+}
+
+// addPageAnnotation adds a reference to the page /Annots array, creating it if needed
+func addPageAnnotation(page string, annotID int) string {
+	ref := fmt.Sprintf("%d 0 R", annotID)
+	if at := strings.Index(page, "/Annots"); at >= 0 {
+		rest := strings.TrimLeft(page[at+len("/Annots"):], " \r\n")
+		if strings.HasPrefix(rest, "[") {
+			insertAt := len(page) - len(rest) + 1
+			return page[:insertAt] + ref + " " + page[insertAt:]
+		}
+	}
+	return appendToDictionary(page, "/Annots ["+ref+"]")
+}
+
+func escapePDFString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	return replacer.Replace(s)
+}
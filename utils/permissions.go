@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// CurrentUser returns the user loaded by the IsAuthenticated middleware
+func CurrentUser(c *fiber.Ctx) *models.User {
+	user, _ := c.Locals("user").(*models.User)
+	return user
+}
+
+// ResolveUserPermissions returns the permissions of the user's role plus the
+// extra permissions granted directly on the user (User.Permission)
+func ResolveUserPermissions(db *gorm.DB, user *models.User) []string {
+	var permissions []string
+
+	if user.Role != "" {
+		var role models.Role
+		if err := db.Where("LOWER(name) = LOWER(?)", user.Role).First(&role).Error; err == nil {
+			permissions = append(permissions, role.PermissionList()...)
+		}
+	}
+
+	return append(permissions, models.SplitPermissions(user.Permission)...)
+}
+
+// UserHasPermission reports whether the user is granted the permission
+func UserHasPermission(db *gorm.DB, user *models.User, permission string) bool {
+	return models.PermissionGranted(ResolveUserPermissions(db, user), permission)
+}
+
+// RoleExists reports whether a role with this name exists (case insensitive)
+func RoleExists(db *gorm.DB, name string) bool {
+	var count int64
+	db.Model(&models.Role{}).Where("LOWER(name) = LOWER(?)", name).Count(&count)
+	return count > 0
+}
+
+// InvalidPermission returns the first unknown permission of a comma separated list, if any
+func InvalidPermission(permissions string) string {
+	for _, permission := range models.SplitPermissions(permissions) {
+		if !models.ValidPermission(permission) {
+			return permission
+		}
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetDocumentProxyMaxSize returns the largest file the proxy endpoints serve in
+// bytes, DOCUMENT_PROXY_MAX_SIZE in megabytes (default 100)
+func GetDocumentProxyMaxSize() int64 {
+	return int64(envInt("DOCUMENT_PROXY_MAX_SIZE", 100)) << 20
+}
+
+// ServeOptions controls how ServeObject answers
+type ServeOptions struct {
+	Filename   string // Defaults to the object name
+	Attachment bool   // Download instead of displaying inline
+	MaxSize    int64  // 0 for no limit
+}
+
+// ServeObject streams a stored file to the client without loading it in
+// memory. It answers If-None-Match with 304 and a single byte range
+// (Range, optionally guarded by If-Range) with 206. The body is closed once sent.
+func ServeObject(c *fiber.Ctx, body io.ReadCloser, info *ObjectInfo, options ServeOptions) error {
+	size := info.Size // 0 when the backend does not know it
+
+	if options.MaxSize > 0 && size > options.MaxSize {
+		body.Close()
+		return c.Status(413).JSON(fiber.Map{
+			"status":  "error",
+			"message": fmt.Sprintf("File is too large to be served, the limit is %d MB", options.MaxSize>>20),
+			"data":    nil,
+		})
+	}
+
+	etag := ""
+	if info.ETag != "" {
+		etag = `"` + strings.Trim(info.ETag, `"`) + `"`
+		c.Set(fiber.HeaderETag, etag)
+	}
+	if !info.ModTime.IsZero() {
+		c.Set(fiber.HeaderLastModified, info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+
+	if etag != "" && etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		body.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	var reader io.Reader = body
+
+	// Trust the metadata, sniff the content only when it has no usable type
+	contentType := info.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		buffered := bufio.NewReaderSize(body, 512)
+		head, _ := buffered.Peek(512)
+		contentType = http.DetectContentType(head)
+		reader = buffered
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+	filename := options.Filename
+	if filename == "" {
+		filename = info.Name
+	}
+	if filename == "" {
+		filename = "document"
+	}
+	// Only types that cannot run script on the API origin are displayed inline
+	disposition := "inline"
+	if mediaType, _, _ := mime.ParseMediaType(contentType); options.Attachment || !inlineContentTypes[mediaType] {
+		disposition = "attachment"
+	}
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+
+	// Ranges need the size, files of unknown size are always sent whole. Over
+	// the limit the stream is aborted, never sent truncated as a complete file.
+	if size <= 0 {
+		if options.MaxSize > 0 {
+			reader = &maxSizeReader{r: reader, remaining: options.MaxSize}
+		}
+		c.Context().SetBodyStream(readCloser{reader, body}, -1)
+		return nil
+	}
+
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange != "" && (etag == "" || ifRange != etag) {
+		rangeHeader = "" // The client's copy is outdated, send the whole file
+	}
+
+	start, end, ok := parseByteRange(rangeHeader, size)
+	if !ok {
+		body.Close()
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Requested range is not satisfiable",
+			"data":    nil,
+		})
+	}
+	if start == 0 && end == size-1 {
+		c.Context().SetBodyStream(readCloser{reader, body}, int(size))
+		return nil
+	}
+
+	if err := skipBytes(reader, start); err != nil {
+		body.Close()
+		return c.Status(502).JSON(fiber.Map{
+			"status":  "error",
+			"message": "Failed to read file",
+			"error":   err.Error(),
+		})
+	}
+
+	length := end - start + 1
+	c.Status(fiber.StatusPartialContent)
+	c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	c.Context().SetBodyStream(readCloser{io.LimitReader(reader, length), body}, int(length))
+	return nil
+}
+
+// inlineContentTypes can be displayed by the browser, anything else (HTML,
+// SVG...) is downloaded
+var inlineContentTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+}
+
+// parseByteRange reads a single "bytes=" range. Without a range, or with
+// several ranges, the whole file is returned; ok is false when the range
+// cannot be satisfied.
+func parseByteRange(header string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size - 1, true
+	}
+
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return 0, size - 1, true
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// etagMatches checks an If-None-Match header, weak comparison
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// skipBytes moves past the first n bytes, seeking when the reader allows it
+func skipBytes(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// errObjectTooLarge fails a stream that goes over ServeOptions.MaxSize
+var errObjectTooLarge = errors.New("file is larger than the proxy limit")
+
+// maxSizeReader passes at most remaining bytes and fails with
+// errObjectTooLarge when the source has more. The chunked response is then
+// cut without its final chunk, so clients see a failed download.
+type maxSizeReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.remaining <= 0 {
+		var probe [1]byte
+		n, err := io.ReadFull(m.r, probe[:])
+		if n > 0 {
+			return 0, errObjectTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > m.remaining {
+		p = p[:m.remaining]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	return n, err
+}
+
+// readCloser reads from a wrapper of body and closes body, fasthttp closes
+// the stream once the response is sent
+type readCloser struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r readCloser) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseByteRange(t *testing.T) {
+	const size = 100
+
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"", 0, 99, true},
+		{"items=0-9", 0, 99, true},
+		{"bytes=0-9", 0, 9, true},
+		{"bytes= 10 - 19 ", 10, 19, true},
+		{"bytes=50-", 50, 99, true},
+		{"bytes=99-99", 99, 99, true},
+		{"bytes=90-150", 90, 99, true}, // end >= size is cut to the last byte
+		{"bytes=90-100", 90, 99, true},
+		{"bytes=-10", 90, 99, true}, // suffix: the last 10 bytes
+		{"bytes=-100", 0, 99, true},
+		{"bytes=-500", 0, 99, true}, // suffix longer than the file
+		{"bytes=0-9,20-29", 0, 99, true},
+		{"bytes=5", 0, 99, true},
+		{"bytes=100-", 0, 0, false}, // starts past the end
+		{"bytes=100-200", 0, 0, false},
+		{"bytes=20-10", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=-", 0, 0, false},
+		{"bytes=a-10", 0, 0, false},
+		{"bytes=0-b", 0, 0, false},
+		{"bytes=-1-5", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseByteRange(tt.header, size)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v, want %d, %d, %v", tt.header, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"other", "abc"`, true},
+		{` "other" ,W/"abc" `, true},
+		{"*", true},
+		{`"other"`, false},
+		{"abc", false},
+		{`"ABC"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestMaxSizeReader(t *testing.T) {
+	tests := []struct {
+		size    int
+		limit   int64
+		wantErr error
+	}{
+		{0, 10, nil},
+		{9, 10, nil},
+		{10, 10, nil},
+		{11, 10, errObjectTooLarge},
+		{50000, 10, errObjectTooLarge},
+	}
+	for _, tt := range tests {
+		data := strings.Repeat("x", tt.size)
+		got, err := io.ReadAll(&maxSizeReader{r: strings.NewReader(data), remaining: tt.limit})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%d bytes over a %d limit: err = %v, want %v", tt.size, tt.limit, err, tt.wantErr)
+		}
+		if err == nil && string(got) != data {
+			t.Errorf("%d bytes over a %d limit: read %d bytes", tt.size, tt.limit, len(got))
+		}
+	}
+}
+
+// trackedBody is an object stream that records being closed, it hides the
+// Seeker of its reader like a network stream
+type trackedBody struct {
+	r      io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+func (b *trackedBody) Close() error               { b.closed = true; return nil }
+
+type serveCase struct {
+	name    string
+	info    ObjectInfo
+	options ServeOptions
+	headers map[string]string
+
+	status      int
+	body        string
+	wantHeaders map[string]string
+}
+
+func TestServeObject(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	pdf := ObjectInfo{Name: "a.pdf", Size: int64(len(content)), ContentType: "application/pdf", ETag: "v1", ModTime: modTime}
+
+	tests := []serveCase{
+		{
+			name:   "whole file",
+			info:   pdf,
+			status: 200,
+			body:   content,
+			wantHeaders: map[string]string{
+				"ETag":                   `"v1"`,
+				"Last-Modified":          "Fri, 01 Mar 2024 12:00:00 GMT",
+				"Accept-Ranges":          "bytes",
+				"Content-Disposition":    "inline; filename=a.pdf",
+				"X-Content-Type-Options": "nosniff",
+			},
+		},
+		{
+			name:        "not modified",
+			info:        pdf,
+			headers:     map[string]string{"If-None-Match": `W/"v1"`},
+			status:      304,
+			wantHeaders: map[string]string{"ETag": `"v1"`},
+		},
+		{
+			name:        "range",
+			info:        pdf,
+			headers:     map[string]string{"Range": "bytes=2-5"},
+			status:      206,
+			body:        "2345",
+			wantHeaders: map[string]string{"Content-Range": "bytes 2-5/20"},
+		},
+		{
+			name:        "suffix range",
+			info:        pdf,
+			headers:     map[string]string{"Range": "bytes=-3"},
+			status:      206,
+			body:        "hij",
+			wantHeaders: map[string]string{"Content-Range": "bytes 17-19/20"},
+		},
+		{
+			name:        "range guarded by the current etag",
+			info:        pdf,
+			headers:     map[string]string{"Range": "bytes=10-", "If-Range": `"v1"`},
+			status:      206,
+			body:        "abcdefghij",
+			wantHeaders: map[string]string{"Content-Range": "bytes 10-19/20"},
+		},
+		{
+			name:    "range guarded by an outdated etag",
+			info:    pdf,
+			headers: map[string]string{"Range": "bytes=10-", "If-Range": `"v0"`},
+			status:  200,
+			body:    content,
+		},
+		{
+			name:        "unsatisfiable range",
+			info:        pdf,
+			headers:     map[string]string{"Range": "bytes=20-"},
+			status:      416,
+			wantHeaders: map[string]string{"Content-Range": "bytes */20"},
+		},
+		{
+			name:    "too large",
+			info:    pdf,
+			options: ServeOptions{MaxSize: 10},
+			status:  413,
+		},
+		{
+			name:        "forced download",
+			info:        pdf,
+			options:     ServeOptions{Attachment: true, Filename: "certified.pdf"},
+			status:      200,
+			body:        content,
+			wantHeaders: map[string]string{"Content-Disposition": "attachment; filename=certified.pdf"},
+		},
+		{
+			name:   "html is never inline",
+			info:   ObjectInfo{Name: "page.html", Size: 20, ContentType: "text/html; charset=utf-8"},
+			status: 200,
+			body:   content,
+			wantHeaders: map[string]string{
+				"Content-Disposition":    "attachment; filename=page.html",
+				"X-Content-Type-Options": "nosniff",
+			},
+		},
+		{
+			name:        "svg is never inline",
+			info:        ObjectInfo{Name: "logo.svg", Size: 20, ContentType: "image/svg+xml"},
+			status:      200,
+			body:        content,
+			wantHeaders: map[string]string{"Content-Disposition": "attachment; filename=logo.svg"},
+		},
+		{
+			name:        "unknown size is sent whole",
+			info:        ObjectInfo{Name: "a.pdf", ContentType: "application/pdf"},
+			headers:     map[string]string{"Range": "bytes=0-1"},
+			options:     ServeOptions{MaxSize: 100},
+			status:      200,
+			body:        content,
+			wantHeaders: map[string]string{"Accept-Ranges": "", "Content-Range": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &trackedBody{r: strings.NewReader(content)}
+			info := tt.info
+
+			app := fiber.New()
+			app.Get("/", func(c *fiber.Ctx) error {
+				return ServeObject(c, body, &info, tt.options)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(got) != tt.body {
+				t.Errorf("body = %q, want %q", got, tt.body)
+			}
+			for name, want := range tt.wantHeaders {
+				if value := resp.Header.Get(name); value != want {
+					t.Errorf("%s = %q, want %q", name, value, want)
+				}
+			}
+			if !body.closed {
+				t.Error("object body was not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Errors returned when a refresh token cannot be used
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, all sessions of this login have been revoked")
+	ErrAccountDisabled     = errors.New("user account is disabled")
+)
+
+// TokenPair is returned on login and refresh
+type TokenPair struct {
+	AccessToken      string    `json:"access_token"`
+	RefreshToken     string    `json:"refresh_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresIn        int64     `json:"expires_in"` // Access token lifetime in seconds
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+// GetRefreshTokenTTL returns the refresh token lifetime (REFRESH_TOKEN_TTL, default 7 days)
+func GetRefreshTokenTTL() time.Duration {
+	if ttl, err := time.ParseDuration(Env("REFRESH_TOKEN_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 7 * 24 * time.Hour
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// IssueTokenPair starts a new session (refresh token family) for a user
+func IssueTokenPair(db *gorm.DB, c *fiber.Ctx, user *models.User) (*TokenPair, error) {
+	return issueTokenPair(db, c, user, uuid.New().String(), nil)
+}
+
+func issueTokenPair(db *gorm.DB, c *fiber.Ctx, user *models.User, familyID string, replaces *models.RefreshToken) (*TokenPair, error) {
+	accessToken, _, err := GenerateJwt(user.UUID, user.TokenVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.RefreshToken{
+		UUID:      uuid.New().String(),
+		UserUUID:  user.UUID,
+		TokenHash: hashRefreshToken(refreshToken),
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(GetRefreshTokenTTL()),
+		IPAddress: c.IP(),
+		UserAgent: c.Get("User-Agent"),
+		CreatedAt: time.Now(),
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if replaces != nil {
+			now := time.Now()
+			result := tx.Model(&models.RefreshToken{}).
+				Where("uuid = ? AND revoked_at IS NULL", replaces.UUID).
+				Updates(map[string]interface{}{"revoked_at": now, "replaced_by": record.UUID})
+			if result.Error != nil {
+				return result.Error
+			}
+			// Another request rotated the same token concurrently
+			if result.RowsAffected == 0 {
+				return ErrRefreshTokenReused
+			}
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(GetAccessTokenTTL().Seconds()),
+		RefreshExpiresAt: record.ExpiresAt,
+	}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new token pair. Presenting a
+// token that was already rotated revokes its whole family (likely theft).
+func RotateRefreshToken(db *gorm.DB, c *fiber.Ctx, refreshToken string) (*TokenPair, *models.User, error) {
+	var record models.RefreshToken
+	if err := db.Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&record).Error; err != nil {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+
+	if record.RevokedAt != nil {
+		if record.ReplacedBy != "" {
+			RevokeRefreshTokenFamily(db, record.FamilyID)
+			return nil, nil, ErrRefreshTokenReused
+		}
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return nil, nil, ErrRefreshTokenExpired
+	}
+
+	var user models.User
+	if err := db.Where("uuid = ?", record.UserUUID).First(&user).Error; err != nil {
+		return nil, nil, ErrRefreshTokenInvalid
+	}
+	if !user.Status {
+		RevokeRefreshTokenFamily(db, record.FamilyID)
+		return nil, nil, ErrAccountDisabled
+	}
+
+	pair, err := issueTokenPair(db, c, &user, record.FamilyID, &record)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			RevokeRefreshTokenFamily(db, record.FamilyID)
+		}
+		return nil, nil, err
+	}
+
+	return pair, &user, nil
+}
+
+// RevokeRefreshTokenFamily revokes every token of one login session
+func RevokeRefreshTokenFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeSession logs out one session: the access token and the refresh token family it belongs to
+func RevokeSession(db *gorm.DB, claims *AccessClaims, refreshToken string) error {
+	if claims != nil && claims.Id != "" {
+		if err := RevokeAccessToken(db, claims); err != nil {
+			return err
+		}
+	}
+
+	if refreshToken != "" {
+		var record models.RefreshToken
+		if err := db.Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&record).Error; err == nil {
+			if claims == nil || record.UserUUID == claims.Issuer {
+				return RevokeRefreshTokenFamily(db, record.FamilyID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RevokeAccessToken denies an access token until it expires
+func RevokeAccessToken(db *gorm.DB, claims *AccessClaims) error {
+	// Expired entries are useless, prune them on the way
+	db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	return db.Create(&models.RevokedToken{
+		JTI:       claims.Id,
+		UserUUID:  claims.Issuer,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// IsAccessTokenRevoked reports whether an access token was revoked on logout
+func IsAccessTokenRevoked(db *gorm.DB, jti string) bool {
+	if jti == "" {
+		return false
+	}
+	var count int64
+	db.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count)
+	return count > 0
+}
+
+// RevokeUserSessions invalidates every access and refresh token of a user,
+// used for "log out everywhere", password changes and disabled accounts.
+func RevokeUserSessions(db *gorm.DB, userUUID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("uuid = ?", userUUID).
+			Update("token_version", gorm.Expr("token_version + 1")).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_uuid = ? AND revoked_at IS NULL", userUUID).
+			Update("revoked_at", time.Now()).Error
+	})
+}
+
+// CurrentTokenClaims returns the access token claims stored by IsAuthenticated
+func CurrentTokenClaims(c *fiber.Ctx) *AccessClaims {
+	claims, _ := c.Locals("token_claims").(*AccessClaims)
+	return claims
+}
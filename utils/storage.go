@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage holds document files. Keys are slash separated paths, except on
+// Google Drive where Drive assigns file IDs: always keep the key returned by
+// Put rather than the one requested.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (*ObjectInfo, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// ObjectInfo describes a stored file
+type ObjectInfo struct {
+	Key         string    `json:"key"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ModTime     time.Time `json:"mod_time"`
+	ETag        string    `json:"etag,omitempty"`
+}
+
+// Storage backend names, as used in STORAGE_BACKEND and Documents.StorageBackend
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+	StorageDrive = "gdrive"
+)
+
+var (
+	// ErrObjectNotFound is returned when no file exists under the key
+	ErrObjectNotFound = errors.New("object not found in storage")
+
+	// ErrSignedURLUnsupported is returned by backends that cannot hand out
+	// direct links, the file has to be served by the API instead
+	ErrSignedURLUnsupported = errors.New("storage backend does not support signed URLs")
+)
+
+var (
+	storageMu       sync.Mutex
+	storageBackends = map[string]Storage{}
+)
+
+// StorageBackendName returns the configured backend, STORAGE_BACKEND (default local)
+func StorageBackendName() string {
+	if backend := strings.ToLower(Env("STORAGE_BACKEND")); backend != "" {
+		return backend
+	}
+	return StorageLocal
+}
+
+// GetStorage returns the configured storage backend
+func GetStorage() (Storage, error) {
+	return OpenStorage(StorageBackendName())
+}
+
+// GetDriveStorage returns the Google Drive backend, whatever STORAGE_BACKEND
+// is, for documents that reference Drive files
+func GetDriveStorage() Storage {
+	store, _ := OpenStorage(StorageDrive)
+	return store
+}
+
+// OpenStorage returns the named backend, the configured one when name is empty
+func OpenStorage(name string) (Storage, error) {
+	if name == "" {
+		name = StorageBackendName()
+	}
+
+	storageMu.Lock()
+	defer storageMu.Unlock()
+
+	if store, ok := storageBackends[name]; ok {
+		return store, nil
+	}
+
+	var store Storage
+	switch name {
+	case StorageLocal:
+		store = NewLocalStorage(GetLocalStorageDir())
+	case StorageS3:
+		s3, err := NewS3Storage(GetS3Config())
+		if err != nil {
+			return nil, err
+		}
+		store = s3
+	case StorageDrive:
+		drive := NewDriveStorage(Env("GOOGLE_DRIVE_FOLDER_ID"))
+		cached, err := NewDriveCache(drive)
+		if err != nil {
+			log.Printf("[warn] Google Drive downloads are not cached: %v", err)
+			cached = drive
+		}
+		store = cached
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (available: local, s3, gdrive)", name)
+	}
+
+	storageBackends[name] = store
+	return store, nil
+}
+
+// ReadObject reads a whole file from storage
+func ReadObject(ctx context.Context, store Storage, key string) ([]byte, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
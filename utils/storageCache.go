@@ -0,0 +1,429 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CachedStorage keeps a disk copy of the files read from a slow backend
+// (Google Drive). Entries are keyed by file and revision: a copy is served
+// without asking the backend for DRIVE_CACHE_TTL, then revalidated against the
+// file metadata. When the backend is slow or down, a copy validated less than
+// DRIVE_CACHE_STALE_TTL ago is still served. The least recently used files
+// are evicted once the cache exceeds its size.
+type CachedStorage struct {
+	Storage
+
+	dir               string
+	maxBytes          int64
+	ttl               time.Duration
+	staleTTL          time.Duration
+	revalidateTimeout time.Duration
+	fetchTimeout      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // key -> element of lru holding a *cacheEntry
+	lru     *list.List               // most recently used first
+	size    int64
+
+	fetches singleflight.Group
+
+	hits, staleHits, misses, revalidations, errors, evictions uint64
+}
+
+type cacheEntry struct {
+	Key         string     `json:"key"`
+	Version     string     `json:"version"` // Revision of the file, empty when the backend gave none
+	Info        ObjectInfo `json:"info"`
+	Size        int64      `json:"size"`
+	FetchedAt   time.Time  `json:"fetched_at"`
+	ValidatedAt time.Time  `json:"validated_at"`
+}
+
+// CacheStats reports the activity of a CachedStorage
+type CacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Entries       int     `json:"entries"`
+	Bytes         int64   `json:"bytes"`
+	MaxBytes      int64   `json:"max_bytes"`
+	Hits          uint64  `json:"hits"`
+	StaleHits     uint64  `json:"stale_hits"` // Served while the backend was failing
+	Misses        uint64  `json:"misses"`
+	Revalidations uint64  `json:"revalidations"`
+	Errors        uint64  `json:"errors"`
+	Evictions     uint64  `json:"evictions"`
+	HitRatio      float64 `json:"hit_ratio"`
+}
+
+// GetDriveCacheDir returns where Drive files are cached, DRIVE_CACHE_DIR (default "cache/gdrive")
+func GetDriveCacheDir() string {
+	dir := Env("DRIVE_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join("cache", "gdrive")
+	}
+	return dir
+}
+
+// NewDriveCache wraps the Drive backend with the disk cache configured by the
+// DRIVE_CACHE_* variables. DRIVE_CACHE=false disables it.
+func NewDriveCache(drive Storage) (Storage, error) {
+	if !envBool("DRIVE_CACHE", true) {
+		return drive, nil
+	}
+
+	return NewCachedStorage(drive, GetDriveCacheDir(), int64(envInt("DRIVE_CACHE_MAX_SIZE", 512))<<20,
+		envDuration("DRIVE_CACHE_TTL", 5*time.Minute),
+		envDuration("DRIVE_CACHE_STALE_TTL", time.Hour))
+}
+
+// NewCachedStorage caches the files of a backend in dir, up to maxBytes. Files
+// cached by a previous run are picked up again.
+func NewCachedStorage(inner Storage, dir string, maxBytes int64, ttl, staleTTL time.Duration) (*CachedStorage, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	cache := &CachedStorage{
+		Storage:           inner,
+		dir:               dir,
+		maxBytes:          maxBytes,
+		ttl:               ttl,
+		staleTTL:          staleTTL,
+		revalidateTimeout: envDuration("DRIVE_CACHE_REVALIDATE_TIMEOUT", 3*time.Second),
+		fetchTimeout:      envDuration("DRIVE_CACHE_FETCH_TIMEOUT", 2*time.Minute),
+		entries:           map[string]*list.Element{},
+		lru:               list.New(),
+	}
+	cache.load()
+
+	return cache, nil
+}
+
+// Get serves a file from the cache, fetching it from the backend on a miss or
+// when its revision changed. Concurrent misses of a file share one download.
+func (s *CachedStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	entry := s.lookup(key)
+
+	if entry != nil && time.Since(entry.ValidatedAt) < s.ttl {
+		if body, info, err := s.open(entry); err == nil {
+			atomic.AddUint64(&s.hits, 1)
+			return body, info, nil
+		}
+	}
+
+	if entry != nil {
+		statCtx, cancel := context.WithTimeout(ctx, s.revalidateTimeout)
+		info, err := s.Storage.Stat(statCtx, key)
+		cancel()
+
+		switch {
+		case err == nil && entry.Version != "" && cacheVersion(info) == entry.Version:
+			atomic.AddUint64(&s.revalidations, 1)
+			s.validated(entry)
+			if body, info, err := s.open(entry); err == nil {
+				atomic.AddUint64(&s.hits, 1)
+				return body, info, nil
+			}
+		case err == ErrObjectNotFound:
+			s.remove(key)
+			return nil, nil, err
+		case err != nil && errors.Is(err, context.DeadlineExceeded):
+			// The backend is too slow, keep the kiosk working with the last copy
+			if body, info, ok := s.openStale(entry); ok {
+				return body, info, nil
+			}
+		}
+	}
+
+	atomic.AddUint64(&s.misses, 1)
+
+	result, err, _ := s.fetches.Do(key, func() (interface{}, error) {
+		return s.fetch(key)
+	})
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		if entry != nil {
+			if body, info, ok := s.openStale(entry); ok {
+				log.Printf("[warn] serving cached copy of %s: %v", key, err)
+				return body, info, nil
+			}
+		}
+		return nil, nil, err
+	}
+
+	body, info, err := s.open(result.(*cacheEntry))
+	if err != nil {
+		// Evicted right after the download, read it from the backend
+		return s.Storage.Get(ctx, key)
+	}
+	return body, info, nil
+}
+
+// Delete removes the file from the backend and from the cache
+func (s *CachedStorage) Delete(ctx context.Context, key string) error {
+	s.remove(key)
+	return s.Storage.Delete(ctx, key)
+}
+
+// Stats returns the cache counters
+func (s *CachedStorage) Stats() CacheStats {
+	s.mu.Lock()
+	stats := CacheStats{
+		Enabled:  true,
+		Entries:  s.lru.Len(),
+		Bytes:    s.size,
+		MaxBytes: s.maxBytes,
+	}
+	s.mu.Unlock()
+
+	stats.Hits = atomic.LoadUint64(&s.hits)
+	stats.StaleHits = atomic.LoadUint64(&s.staleHits)
+	stats.Misses = atomic.LoadUint64(&s.misses)
+	stats.Revalidations = atomic.LoadUint64(&s.revalidations)
+	stats.Errors = atomic.LoadUint64(&s.errors)
+	stats.Evictions = atomic.LoadUint64(&s.evictions)
+	if total := stats.Hits + stats.StaleHits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.StaleHits) / float64(total)
+	}
+	return stats
+}
+
+// GetDriveCacheStats returns the counters of the Drive cache, disabled when not in use
+func GetDriveCacheStats() CacheStats {
+	if cache, ok := GetDriveStorage().(*CachedStorage); ok {
+		return cache.Stats()
+	}
+	return CacheStats{}
+}
+
+// fetch downloads a file into the cache directory and indexes it
+func (s *CachedStorage) fetch(key string) (*cacheEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.fetchTimeout)
+	defer cancel()
+
+	body, info, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(s.dir, ".fetch-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache file: %v", err)
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		Key:         key,
+		Version:     cacheVersion(info),
+		Info:        *info,
+		Size:        written,
+		FetchedAt:   now,
+		ValidatedAt: now,
+	}
+	entry.Info.Size = written
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), s.dataPath(key)); err != nil {
+		return nil, fmt.Errorf("failed to cache file: %v", err)
+	}
+	s.writeMeta(entry)
+
+	if element, ok := s.entries[key]; ok {
+		s.size -= element.Value.(*cacheEntry).Size
+		element.Value = entry
+		s.lru.MoveToFront(element)
+	} else {
+		s.entries[key] = s.lru.PushFront(entry)
+	}
+	s.size += entry.Size
+	s.evict()
+
+	return entry, nil
+}
+
+// evict drops the least recently used files until the cache fits, always
+// keeping the newest one. Called with mu held.
+func (s *CachedStorage) evict() {
+	for s.size > s.maxBytes && s.lru.Len() > 1 {
+		oldest := s.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.entries, entry.Key)
+		s.size -= entry.Size
+		os.Remove(s.dataPath(entry.Key))
+		os.Remove(s.metaPath(entry.Key))
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+// lookup returns a copy of the entry of a key and marks it recently used
+func (s *CachedStorage) lookup(key string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	entry := *element.Value.(*cacheEntry)
+	return &entry
+}
+
+// validated records that the cached revision is still the current one
+func (s *CachedStorage) validated(entry *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[entry.Key]; ok {
+		current := element.Value.(*cacheEntry)
+		if current.Version == entry.Version {
+			current.ValidatedAt = time.Now()
+			s.writeMeta(current)
+		}
+	}
+}
+
+func (s *CachedStorage) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.size -= element.Value.(*cacheEntry).Size
+		s.lru.Remove(element)
+		delete(s.entries, key)
+	}
+	os.Remove(s.dataPath(key))
+	os.Remove(s.metaPath(key))
+}
+
+func (s *CachedStorage) open(entry *cacheEntry) (io.ReadCloser, *ObjectInfo, error) {
+	file, err := os.Open(s.dataPath(entry.Key))
+	if err != nil {
+		return nil, nil, err
+	}
+	info := entry.Info
+	return file, &info, nil
+}
+
+// openStale serves a copy validated less than the stale TTL ago
+func (s *CachedStorage) openStale(entry *cacheEntry) (io.ReadCloser, *ObjectInfo, bool) {
+	if time.Since(entry.ValidatedAt) >= s.staleTTL {
+		return nil, nil, false
+	}
+	body, info, err := s.open(entry)
+	if err != nil {
+		return nil, nil, false
+	}
+	atomic.AddUint64(&s.staleHits, 1)
+	return body, info, true
+}
+
+// load indexes the files cached by a previous run and clears leftovers
+func (s *CachedStorage) load() {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	var loaded []*cacheEntry
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".fetch-") {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.dir, name))
+		var entry cacheEntry
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err == nil {
+			_, err = os.Stat(s.dataPath(entry.Key))
+		}
+		if err != nil {
+			os.Remove(filepath.Join(s.dir, name))
+			os.Remove(filepath.Join(s.dir, strings.TrimSuffix(name, ".json")+".bin"))
+			continue
+		}
+		loaded = append(loaded, &entry)
+	}
+
+	// Most recently validated first
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ValidatedAt.After(loaded[j].ValidatedAt)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range loaded {
+		s.entries[entry.Key] = s.lru.PushBack(entry)
+		s.size += entry.Size
+	}
+	s.evict()
+}
+
+// writeMeta stores the entry next to its data so the cache survives restarts
+func (s *CachedStorage) writeMeta(entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.metaPath(entry.Key), data, 0640); err != nil {
+		log.Printf("[warn] failed to write cache index for %s: %v", entry.Key, err)
+	}
+}
+
+// Cache files are named after a hash of the key, keys may contain any character
+func (s *CachedStorage) dataPath(key string) string {
+	return filepath.Join(s.dir, cacheFileName(key)+".bin")
+}
+
+func (s *CachedStorage) metaPath(key string) string {
+	return filepath.Join(s.dir, cacheFileName(key)+".json")
+}
+
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheVersion identifies a revision of a file from its checksum and modification time
+func cacheVersion(info *ObjectInfo) string {
+	if info == nil || (info.ETag == "" && info.ModTime.IsZero()) {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", info.ETag, info.ModTime.UnixNano())
+}
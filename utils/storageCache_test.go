@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend serves files from memory and counts the calls the cache makes.
+// Stat waits statDelay, Get waits for release when it is set.
+type fakeBackend struct {
+	Storage
+
+	mu        sync.Mutex
+	files     map[string]string
+	versions  map[string]int
+	statErr   error
+	getErr    error
+	statDelay time.Duration
+	release   chan struct{}
+
+	gets, stats int32
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{files: map[string]string{}, versions: map[string]int{}}
+}
+
+func (f *fakeBackend) set(key, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[key] = content
+	f.versions[key]++
+}
+
+func (f *fakeBackend) info(key string) (*ObjectInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.files[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return &ObjectInfo{
+		Key:         key,
+		Name:        key,
+		Size:        int64(len(content)),
+		ContentType: "application/pdf",
+		ModTime:     time.Unix(int64(f.versions[key]), 0),
+		ETag:        strings.Repeat("v", f.versions[key]),
+	}, nil
+}
+
+func (f *fakeBackend) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	atomic.AddInt32(&f.gets, 1)
+	if f.release != nil {
+		<-f.release
+	}
+	if f.getErr != nil {
+		return nil, nil, f.getErr
+	}
+	info, err := f.info(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return io.NopCloser(strings.NewReader(f.files[key])), info, nil
+}
+
+func (f *fakeBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	atomic.AddInt32(&f.stats, 1)
+	if f.statDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(f.statDelay):
+		}
+	}
+	if f.statErr != nil {
+		return nil, f.statErr
+	}
+	return f.info(key)
+}
+
+func (f *fakeBackend) Delete(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.files, key)
+	return nil
+}
+
+func newTestCache(t *testing.T, backend Storage, maxBytes int64, ttl, staleTTL time.Duration) *CachedStorage {
+	t.Helper()
+	cache, err := NewCachedStorage(backend, t.TempDir(), maxBytes, ttl, staleTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.revalidateTimeout = 50 * time.Millisecond
+	return cache
+}
+
+func readCached(t *testing.T, cache *CachedStorage, key string) string {
+	t.Helper()
+	body, _, err := cache.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", key, err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read %s: %v", key, err)
+	}
+	return string(data)
+}
+
+func checkCacheStats(t *testing.T, cache *CachedStorage, want CacheStats) {
+	t.Helper()
+	got := cache.Stats()
+	if got.Hits != want.Hits || got.StaleHits != want.StaleHits || got.Misses != want.Misses ||
+		got.Revalidations != want.Revalidations || got.Errors != want.Errors || got.Evictions != want.Evictions {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestCachedStorageHit(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, time.Hour, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if got := readCached(t, cache, "a"); got != "first" {
+			t.Fatalf("Get = %q", got)
+		}
+	}
+	if backend.gets != 1 || backend.stats != 0 {
+		t.Errorf("backend saw %d Get and %d Stat, want 1 and 0", backend.gets, backend.stats)
+	}
+	checkCacheStats(t, cache, CacheStats{Hits: 2, Misses: 1})
+
+	// A new cache on the same directory picks the copy up again
+	reloaded, err := NewCachedStorage(backend, cache.dir, 1<<20, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readCached(t, reloaded, "a"); got != "first" || backend.gets != 1 {
+		t.Errorf("after reload Get = %q with %d backend Get, want the cached copy", got, backend.gets)
+	}
+}
+
+func TestCachedStorageRevalidate(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, 0, time.Hour)
+
+	readCached(t, cache, "a")
+	if got := readCached(t, cache, "a"); got != "first" {
+		t.Fatalf("Get = %q", got)
+	}
+	if backend.gets != 1 || backend.stats != 1 {
+		t.Errorf("unchanged file: backend saw %d Get and %d Stat, want 1 and 1", backend.gets, backend.stats)
+	}
+	checkCacheStats(t, cache, CacheStats{Hits: 1, Misses: 1, Revalidations: 1})
+
+	// A new revision is downloaded again
+	backend.set("a", "second")
+	if got := readCached(t, cache, "a"); got != "second" {
+		t.Errorf("changed file: Get = %q, want the new revision", got)
+	}
+	if backend.gets != 2 {
+		t.Errorf("changed file: backend saw %d Get, want 2", backend.gets)
+	}
+	checkCacheStats(t, cache, CacheStats{Hits: 1, Misses: 2, Revalidations: 1})
+}
+
+func TestCachedStorageStaleOnTimeout(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, 0, time.Hour)
+	readCached(t, cache, "a")
+
+	backend.statDelay = time.Second
+	if got := readCached(t, cache, "a"); got != "first" {
+		t.Fatalf("Get = %q", got)
+	}
+	if backend.gets != 1 {
+		t.Errorf("slow backend: %d Get, want the stale copy without download", backend.gets)
+	}
+	checkCacheStats(t, cache, CacheStats{StaleHits: 1, Misses: 1})
+}
+
+func TestCachedStorageNoStaleOnOtherErrors(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, 0, time.Hour)
+	readCached(t, cache, "a")
+
+	// A failing Stat is not a reason to serve the old copy when the file can be downloaded
+	backend.statErr = errors.New("backend error")
+	backend.set("a", "second")
+	if got := readCached(t, cache, "a"); got != "second" {
+		t.Errorf("Get = %q, want the downloaded revision", got)
+	}
+	checkCacheStats(t, cache, CacheStats{Misses: 2})
+
+	// The copy is only used once the download fails too
+	backend.getErr = errors.New("backend down")
+	if got := readCached(t, cache, "a"); got != "second" {
+		t.Errorf("Get = %q, want the cached copy", got)
+	}
+	checkCacheStats(t, cache, CacheStats{StaleHits: 1, Misses: 3, Errors: 1})
+}
+
+func TestCachedStorageStaleTTL(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, 0, 0)
+	readCached(t, cache, "a")
+
+	backend.statDelay = time.Second
+	backend.getErr = errors.New("backend down")
+	if _, _, err := cache.Get(context.Background(), "a"); err == nil {
+		t.Error("Get served a copy older than the stale TTL")
+	}
+	checkCacheStats(t, cache, CacheStats{Misses: 2, Errors: 1})
+}
+
+func TestCachedStorageNotFound(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	cache := newTestCache(t, backend, 1<<20, 0, time.Hour)
+	readCached(t, cache, "a")
+
+	backend.Delete(context.Background(), "a")
+	if _, _, err := cache.Get(context.Background(), "a"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Get of a deleted file = %v, want ErrObjectNotFound", err)
+	}
+	if cache.lookup("a") != nil {
+		t.Error("deleted file is still cached")
+	}
+}
+
+func TestCachedStorageMiss(t *testing.T) {
+	cache := newTestCache(t, newFakeBackend(), 1<<20, time.Hour, time.Hour)
+
+	if _, _, err := cache.Get(context.Background(), "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Get = %v, want ErrObjectNotFound", err)
+	}
+	checkCacheStats(t, cache, CacheStats{Misses: 1, Errors: 1})
+}
+
+func TestCachedStorageEvictWhileOpen(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "aaaaaaaaaa")
+	backend.set("b", "bbbbbbbbbb")
+	cache := newTestCache(t, backend, 15, time.Hour, time.Hour)
+
+	body, _, err := cache.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	// b does not fit next to a, the least recently used file goes
+	readCached(t, cache, "b")
+	if cache.lookup("a") != nil {
+		t.Error("a was not evicted")
+	}
+	checkCacheStats(t, cache, CacheStats{Misses: 2, Evictions: 1})
+	if stats := cache.Stats(); stats.Bytes != 10 || stats.Entries != 1 {
+		t.Errorf("cache holds %d bytes in %d entries, want 10 in 1", stats.Bytes, stats.Entries)
+	}
+
+	// The copy being sent is still complete
+	if data, err := io.ReadAll(body); err != nil || string(data) != "aaaaaaaaaa" {
+		t.Errorf("open copy of an evicted file = %q, %v", data, err)
+	}
+
+	if got := readCached(t, cache, "a"); got != "aaaaaaaaaa" || backend.gets != 3 {
+		t.Errorf("Get after eviction = %q with %d backend Get, want a new download", got, backend.gets)
+	}
+}
+
+func TestCachedStorageSingleFlight(t *testing.T) {
+	backend := newFakeBackend()
+	backend.set("a", "first")
+	backend.release = make(chan struct{})
+	cache := newTestCache(t, backend, 1<<20, time.Hour, time.Hour)
+
+	const readers = 8
+	var wg sync.WaitGroup
+	results := make([]string, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, _, err := cache.Get(context.Background(), "a")
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			defer body.Close()
+			data, _ := io.ReadAll(body)
+			results[i] = string(data)
+		}(i)
+	}
+
+	// Let every reader reach the download before it completes
+	time.Sleep(100 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	if backend.gets != 1 {
+		t.Errorf("%d concurrent misses made %d downloads, want 1", readers, backend.gets)
+	}
+	for i, got := range results {
+		if got != "first" {
+			t.Errorf("reader %d got %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// DriveStorage keeps files in Google Drive. Keys are Drive file IDs; new files
+// are created in GOOGLE_DRIVE_FOLDER_ID, named after the requested key.
+type DriveStorage struct {
+	folderID string
+}
+
+const driveFileFields = "id, name, mimeType, size, modifiedTime, md5Checksum"
+
+// NewDriveStorage stores new files in the given Drive folder (the root when empty)
+func NewDriveStorage(folderID string) *DriveStorage {
+	return &DriveStorage{folderID: folderID}
+}
+
+func (s *DriveStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	srv, err := GetGoogleDriveService()
+	if err != nil {
+		return nil, err
+	}
+
+	file := &drive.File{Name: key}
+	if s.folderID != "" {
+		file.Parents = []string{s.folderID}
+	}
+
+	created, err := srv.Files.Create(file).
+		Media(r, googleapi.ContentType(contentType)).
+		Fields(driveFileFields).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to upload file to Drive: %v", err)
+	}
+
+	return driveObjectInfo(created), nil
+}
+
+// Get downloads a file through the Drive API, or through the public download
+// links when the API is not configured
+func (s *DriveStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	srv, err := GetGoogleDriveService()
+	if err != nil {
+		data, err := DownloadPublicDriveFile(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), &ObjectInfo{
+			Key:         key,
+			Name:        key,
+			Size:        int64(len(data)),
+			ContentType: http.DetectContentType(data),
+		}, nil
+	}
+
+	file, err := srv.Files.Get(key).Fields(driveFileFields).Context(ctx).Do()
+	if err != nil {
+		return nil, nil, driveError(err)
+	}
+
+	resp, err := srv.Files.Get(key).Context(ctx).Download()
+	if err != nil {
+		return nil, nil, driveError(err)
+	}
+
+	return resp.Body, driveObjectInfo(file), nil
+}
+
+func (s *DriveStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	srv, err := GetGoogleDriveService()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := srv.Files.Get(key).Fields(driveFileFields).Context(ctx).Do()
+	if err != nil {
+		return nil, driveError(err)
+	}
+
+	return driveObjectInfo(file), nil
+}
+
+// Delete removes the file for good, it does not go to the trash
+func (s *DriveStorage) Delete(ctx context.Context, key string) error {
+	srv, err := GetGoogleDriveService()
+	if err != nil {
+		return err
+	}
+
+	if err := srv.Files.Delete(key).Context(ctx).Do(); err != nil {
+		if err := driveError(err); err != ErrObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the files of the folder whose name starts with prefix
+func (s *DriveStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	srv, err := GetGoogleDriveService()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "trashed = false"
+	if s.folderID != "" {
+		query = fmt.Sprintf("'%s' in parents and %s", strings.ReplaceAll(s.folderID, "'", `\'`), query)
+	}
+
+	var objects []ObjectInfo
+	err = srv.Files.List().
+		Q(query).
+		Fields(googleapi.Field("nextPageToken, files("+driveFileFields+")")).
+		Context(ctx).
+		Pages(ctx, func(page *drive.FileList) error {
+			for _, file := range page.Files {
+				if strings.HasPrefix(file.Name, prefix) {
+					objects = append(objects, *driveObjectInfo(file))
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, driveError(err)
+	}
+
+	return objects, nil
+}
+
+// SignedURL is not available, Drive links need the viewer's own Google session
+func (s *DriveStorage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+func driveObjectInfo(file *drive.File) *ObjectInfo {
+	modTime, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+
+	return &ObjectInfo{
+		Key:         file.Id,
+		Name:        file.Name,
+		Size:        file.Size,
+		ContentType: file.MimeType,
+		ModTime:     modTime,
+		ETag:        file.Md5Checksum,
+	}
+}
+
+func driveError(err error) error {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	return fmt.Errorf("Google Drive: %v", err)
+}
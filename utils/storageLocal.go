@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps files in a directory of the server
+type LocalStorage struct {
+	root string
+}
+
+// GetLocalStorageDir returns the root of the local backend, STORAGE_LOCAL_DIR (default "storage")
+func GetLocalStorageDir() string {
+	dir := Env("STORAGE_LOCAL_DIR")
+	if dir == "" {
+		dir = "storage"
+	}
+	return dir
+}
+
+// NewLocalStorage stores files under root
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+// path maps a key to a file under the root, keys cannot escape it
+func (s *LocalStorage) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean[1:])), nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (*ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+
+	// Write next to the target and rename, readers never see a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0640); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+
+	return s.Stat(ctx, key)
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, localObjectInfo(key, stat), nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if stat.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return localObjectInfo(key, stat), nil
+}
+
+// Delete removes a file, deleting a missing file is not an error
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		stat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *localObjectInfo(key, stat))
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s *LocalStorage) SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return "", ErrSignedURLUnsupported
+}
+
+func localObjectInfo(key string, stat os.FileInfo) *ObjectInfo {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return &ObjectInfo{
+		Key:         key,
+		Name:        path.Base(key),
+		Size:        stat.Size(),
+		ContentType: contentType,
+		ModTime:     stat.ModTime(),
+		ETag:        fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
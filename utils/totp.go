@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Danny19977/certikiosk.git/models"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TOTP (RFC 6238) parameters, the defaults understood by every authenticator app
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // Accepted steps before and after the current one
+
+	recoveryCodeCount = 10
+
+	// Audience of the challenge token returned by the password step of a 2FA login
+	twoFactorChallengeAudience = "2fa_challenge"
+)
+
+// Errors returned by the second login step
+var (
+	ErrTwoFactorChallengeInvalid = errors.New("invalid or expired two-factor challenge")
+	ErrTwoFactorCodeInvalid      = errors.New("invalid two-factor code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160-bit secret, base32 encoded
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI builds the otpauth:// URI scanned by authenticator apps
+func TOTPProvisioningURI(account, secret string) string {
+	issuer := Env("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "CertiKiosk"
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TOTPQRCode renders the provisioning URI as a PNG data URI
+func TOTPQRCode(uri string) (string, error) {
+	png, err := GenerateQRCode(uri)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+// totpCode computes the code of one time step
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// ValidateTOTP checks a code against the secret around the given time. It
+// returns the matched time step, which must be greater than lastStep so a
+// code cannot be replayed.
+func ValidateTOTP(secret, code string, at time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := at.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpEncryptionKey derives the key protecting TOTP secrets at rest from
+// TOTP_ENCRYPTION_KEY, falling back to SECRET_KEY
+func totpEncryptionKey() ([]byte, error) {
+	secret := Env("TOTP_ENCRYPTION_KEY")
+	if secret == "" {
+		secret = SECRET_KEY
+	}
+	if secret == "" {
+		return nil, errors.New("neither TOTP_ENCRYPTION_KEY nor SECRET_KEY is configured")
+	}
+	key := sha256.Sum256([]byte("certikiosk-totp:" + secret))
+	return key[:], nil
+}
+
+// SealTOTPSecret encrypts a TOTP secret bound to its user
+func SealTOTPSecret(userUUID, secret string) (string, error) {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := gcmSeal(key, []byte(secret), []byte(userUUID))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenTOTPSecret decrypts the TOTP secret of a user
+func OpenTOTPSecret(userUUID, sealed string) (string, error) {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	secret, err := gcmOpen(key, raw, []byte(userUUID))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// VerifyUserTOTP validates a code for a user with 2FA configured and records
+// the used time step. The secret may still be pending confirmation.
+func VerifyUserTOTP(db *gorm.DB, user *models.User, code string) (bool, error) {
+	if user.TwoFactorSecret == "" {
+		return false, nil
+	}
+
+	secret, err := OpenTOTPSecret(user.UUID, user.TwoFactorSecret)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := ValidateTOTP(secret, code, time.Now(), user.TwoFactorLastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Conditional update so two concurrent requests cannot both use the same code
+	result := db.Model(&models.User{}).
+		Where("uuid = ? AND two_factor_last_step < ?", user.UUID, step).
+		Update("two_factor_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.TwoFactorLastStep = step
+
+	return true, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of a user and returns them
+// in clear text, they are only shown once
+func GenerateRecoveryCodes(db *gorm.DB, userUUID string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]models.TwoFactorRecoveryCode, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(hex.EncodeToString(raw))
+		code := encoded[:5] + "-" + encoded[5:]
+
+		codes = append(codes, code)
+		records = append(records, models.TwoFactorRecoveryCode{
+			UUID:      uuid.New().String(),
+			UserUUID:  userUUID,
+			CodeHash:  hashRecoveryCode(code),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_uuid = ?", userUUID).Delete(&models.TwoFactorRecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one unused recovery code of a user
+func UseRecoveryCode(db *gorm.DB, userUUID, code string) (bool, error) {
+	result := db.Model(&models.TwoFactorRecoveryCode{}).
+		Where("user_uuid = ? AND code_hash = ? AND used_at IS NULL", userUUID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// RemainingRecoveryCodes counts the unused recovery codes of a user
+func RemainingRecoveryCodes(db *gorm.DB, userUUID string) int64 {
+	var count int64
+	db.Model(&models.TwoFactorRecoveryCode{}).Where("user_uuid = ? AND used_at IS NULL", userUUID).Count(&count)
+	return count
+}
+
+// ResetTwoFactor disables 2FA for a user and removes the secret and recovery codes
+func ResetTwoFactor(db *gorm.DB, userUUID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("uuid = ?", userUUID).Updates(map[string]interface{}{
+			"two_factor_enabled":   false,
+			"two_factor_secret":    "",
+			"two_factor_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_uuid = ?", userUUID).Delete(&models.TwoFactorRecoveryCode{}).Error
+	})
+}
+
+// GetTwoFactorChallengeTTL returns how long the second login step stays open (TWO_FACTOR_CHALLENGE_TTL, default 5m)
+func GetTwoFactorChallengeTTL() time.Duration {
+	if ttl, err := time.ParseDuration(Env("TWO_FACTOR_CHALLENGE_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 5 * time.Minute
+}
+
+// GenerateTwoFactorChallenge issues the token exchanged for a session once
+// the second factor is verified. It is never accepted as an access token.
+func GenerateTwoFactorChallenge(user *models.User) (string, error) {
+	now := time.Now()
+	claims := &AccessClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Audience:  twoFactorChallengeAudience,
+			Issuer:    user.UUID,
+			Subject:   user.UUID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(GetTwoFactorChallengeTTL()).Unix(),
+		},
+		TokenVersion: user.TokenVersion,
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(SECRET_KEY))
+}
+
+// ParseTwoFactorChallenge validates a challenge token and returns its claims
+func ParseTwoFactorChallenge(token string) (*AccessClaims, error) {
+	claims, err := parseClaims(token)
+	if err != nil || claims.Audience != twoFactorChallengeAudience {
+		return nil, ErrTwoFactorChallengeInvalid
+	}
+	return claims, nil
+}